@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const adminUsage = `usage:
+  cepher [flags] locks list
+      lists the mount and create locks and their holders
+  cepher [flags] locks release [--owner=ID] [--blocklist|--blocklist-all] mount|create pool/image
+      force releases a lock. --owner releases only the locks held by the given
+      lock session/lease ID (see 'locks list'). --blocklist blocklists the Ceph
+      clients of the previous holders on the image before releasing the lock, so
+      that a partitioned but alive host can't write to the image anymore.
+      --blocklist-all blocklists all the Ceph clients watching the image, for
+      holders whose addresses are not known
+  cepher [flags] ceph-config
+      writes the Ceph keyring and ceph.conf from the configured sources and exits`
+
+var lockKindPrefixes = map[string]string{
+	"mount":  "/cepher-mount/",
+	"create": "/cepher-create/",
+}
+
+type imageWatcher struct {
+	Address string `json:"address"`
+	Client  uint64 `json:"client"`
+	Cookie  uint64 `json:"cookie"`
+}
+
+// runAdminCommand executes an administrative subcommand instead of starting the plugin
+func (d *cephRBDVolumeDriver) runAdminCommand(args []string) error {
+	if len(args) == 1 && args[0] == "ceph-config" {
+		return d.provisionCephConfig()
+	}
+	if len(args) < 2 || args[0] != "locks" || (args[1] != "list" && args[1] != "release") {
+		return errors.New(adminUsage)
+	}
+
+	locks, err := d.newLockProvider(nil)
+	if err != nil {
+		return err
+	}
+	if locks == nil {
+		return errors.New("no lock backend configured. Use --lock-etcd, --lock-consul or --lock-file-dir")
+	}
+	d.locks = locks
+	defer d.locks.Close()
+
+	if args[1] == "list" {
+		return d.adminListLocks()
+	}
+	return d.adminReleaseLock(args[2:])
+}
+
+func (d *cephRBDVolumeDriver) adminListLocks() error {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tVOLUME\tMODE\tHOST\tNODE\tCALLER\tOWNER\tSINCE")
+	for _, kind := range []string{"mount", "create"} {
+		prefix := lockKindPrefixes[kind]
+		keys, err := d.locks.Locks(prefix)
+		if err != nil {
+			return fmt.Errorf("error listing %s locks: %s", kind, err)
+		}
+		for _, key := range keys {
+			volumeName := strings.TrimPrefix(key, prefix)
+			holders, err := d.locks.Holders(key)
+			if err != nil {
+				return fmt.Errorf("error getting holders of %s: %s", key, err)
+			}
+			if len(holders) == 0 {
+				fmt.Fprintf(w, "%s\t%s\t?\t?\t?\t?\t?\t?\n", kind, volumeName)
+			}
+			for _, h := range holders {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", kind, volumeName, h.Mode, h.Hostname, h.NodeID, h.CallerID, h.Owner, h.AcquiredAt.Format(time.RFC3339))
+			}
+		}
+	}
+	return w.Flush()
+}
+
+func (d *cephRBDVolumeDriver) adminReleaseLock(args []string) error {
+	flags := flag.NewFlagSet("release", flag.ContinueOnError)
+	owner := flags.String("owner", "", "Release only the locks held by this lock session/lease ID")
+	blocklist := flags.Bool("blocklist", false, "Blocklist the Ceph clients of the previous holders before releasing the lock")
+	blocklistAll := flags.Bool("blocklist-all", false, "Blocklist all the Ceph clients watching the image before releasing the lock")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		return errors.New(adminUsage)
+	}
+	prefix, ok := lockKindPrefixes[flags.Arg(0)]
+	if !ok {
+		return fmt.Errorf("invalid lock kind '%s'. Options are 'mount' or 'create'", flags.Arg(0))
+	}
+	pool, name, _, _, err := d.parseImagePoolName(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("%s%s/%s", prefix, pool, name)
+
+	holders, err := d.locks.Holders(key)
+	if err != nil {
+		return fmt.Errorf("error getting holders of %s: %s", key, err)
+	}
+	released := make([]lockHolder, 0)
+	for _, h := range holders {
+		if *owner == "" || h.Owner == *owner {
+			released = append(released, h)
+		}
+	}
+	if *owner != "" && len(released) == 0 {
+		return fmt.Errorf("no holder of %s has owner %s. See 'locks list'", key, *owner)
+	}
+	logrus.Infof("Releasing %s lock of %s/%s held by %v", flags.Arg(0), pool, name, released)
+
+	if *blocklist || *blocklistAll {
+		if err := d.blocklistLockHolders(pool, name, released, *blocklistAll); err != nil {
+			return fmt.Errorf("error blocklisting previous lock holders. Lock was not released: %s", err)
+		}
+	}
+
+	if err := d.locks.ForceRelease(key, *owner); err != nil {
+		return fmt.Errorf("error releasing lock %s: %s", key, err)
+	}
+	logrus.Infof("Lock %s released", key)
+	return nil
+}
+
+// blocklistLockHolders blocklists the Ceph clients watching the image from the
+// addresses of the given holders. With all, every watcher of the image is blocklisted
+func (d *cephRBDVolumeDriver) blocklistLockHolders(pool, name string, holders []lockHolder, all bool) error {
+	addresses := make(map[string]bool)
+	for _, h := range holders {
+		for _, a := range h.Addresses {
+			addresses[a] = true
+		}
+	}
+	if all {
+		logrus.Warnf("Blocklisting all watchers of %s/%s", pool, name)
+		addresses = make(map[string]bool)
+	} else if len(addresses) == 0 {
+		// blocklisting every watcher would cut off the host currently using the image
+		return fmt.Errorf("no addresses known for the lock holders of %s/%s. Use --blocklist-all to blocklist all image watchers", pool, name)
+	}
+	watchers, err := d.rbdImageWatchers(pool, name)
+	if err != nil {
+		return err
+	}
+	for _, w := range watchers {
+		host, err := watcherHost(w.Address)
+		if err != nil {
+			return err
+		}
+		if len(addresses) > 0 && !addresses[host] {
+			logrus.Debugf("Skipping watcher %s of %s/%s", w.Address, pool, name)
+			continue
+		}
+		logrus.Infof("Blocklisting Ceph client %s (client.%d) watching %s/%s", w.Address, w.Client, pool, name)
+		if err := blocklistClient(w.Address); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rbdImageWatchers returns the Ceph clients currently watching the image
+func (d *cephRBDVolumeDriver) rbdImageWatchers(pool, name string) ([]imageWatcher, error) {
+	resp, err := d.rbdsh(pool, "status", name, "--format", "json")
+	if err != nil {
+		return nil, err
+	}
+	var status struct {
+		Watchers []imageWatcher `json:"watchers"`
+	}
+	if err := json.Unmarshal([]byte(resp), &status); err != nil {
+		return nil, err
+	}
+	return status.Watchers, nil
+}
+
+// watcherHost returns the IP from a watcher address like 10.0.0.1:0/3442390131
+func watcherHost(address string) (string, error) {
+	hostPort := strings.SplitN(address, "/", 2)[0]
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return "", fmt.Errorf("invalid watcher address %s: %s", address, err)
+	}
+	return host, nil
+}
+
+// blocklistClient adds the client address to the OSD blocklist. Older Ceph releases call it 'blacklist'
+func blocklistClient(address string) error {
+	_, err := shWithDefaultTimeout("ceph", "osd", "blocklist", "add", address)
+	if err != nil {
+		logrus.Debugf("ceph osd blocklist failed, trying blacklist: %s", err)
+		_, err = shWithDefaultTimeout("ceph", "osd", "blacklist", "add", address)
+	}
+	return err
+}
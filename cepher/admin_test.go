@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestUniqueLockKeys(t *testing.T) {
+	entries := []string{
+		"/cepher-mount/volumes/image2/write/7b9a4c4e",
+		"/cepher-mount/volumes/image1/read/1f0e5d2a",
+		"/cepher-mount/volumes/image1/read/9c3b0a11",
+		"/cepher-mount/volumes/image3/write",
+		"/cepher-mount/invalid",
+	}
+	want := []string{"/cepher-mount/volumes/image1", "/cepher-mount/volumes/image2", "/cepher-mount/volumes/image3"}
+	if keys := uniqueLockKeys(entries); !reflect.DeepEqual(keys, want) {
+		t.Fatalf("expected %v but got %v", want, keys)
+	}
+}
+
+func TestWatcherHost(t *testing.T) {
+	host, err := watcherHost("10.0.0.1:0/3442390131")
+	if err != nil || host != "10.0.0.1" {
+		t.Fatalf("expected 10.0.0.1 but got %s %v", host, err)
+	}
+	host, err = watcherHost("[fd00::1]:0/3442390131")
+	if err != nil || host != "fd00::1" {
+		t.Fatalf("expected fd00::1 but got %s %v", host, err)
+	}
+	if _, err := watcherHost("invalid"); err == nil {
+		t.Fatal("expected error for invalid watcher address")
+	}
+}
+
+func TestAdminReleaseLockUnknownOwner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cepher-admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	locks, err := newFileLockProvider(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := cephRBDVolumeDriver{locks: locks, defaultCephPool: "volumes"}
+	err = d.adminReleaseLock([]string{"--owner=mistyped", "--blocklist", "mount", "volumes/myimage"})
+	if err == nil || !strings.Contains(err.Error(), "no holder") {
+		t.Fatalf("expected release with an unknown owner to be refused but got %v", err)
+	}
+}
+
+func TestBlocklistLockHoldersWithoutAddresses(t *testing.T) {
+	d := cephRBDVolumeDriver{}
+	err := d.blocklistLockHolders("volumes", "myimage", []lockHolder{{Owner: "694d6d1c2b3a8f21"}}, false)
+	if err == nil || !strings.Contains(err.Error(), "--blocklist-all") {
+		t.Fatalf("expected blocklist without holder addresses to be refused but got %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// values of the 'mode' volume option
+const (
+	modeFilesystem = "filesystem"
+	modeBlock      = "block"
+)
+
+// blockDeviceNodeName is the name of the device node of block mode volumes in their mount directory
+const blockDeviceNodeName = "device"
+
+// parseModeOption returns true for block mode volumes, which expose the mapped device instead of a filesystem
+func parseModeOption(value string) (bool, error) {
+	switch value {
+	case "", modeFilesystem:
+		return false, nil
+	case modeBlock:
+		return true, nil
+	}
+	return false, fmt.Errorf("invalid mode option '%s'. Must be '%s' or '%s'", value, modeFilesystem, modeBlock)
+}
+
+// exposeBlockDevice creates a device node for device in the mount directory, so that containers
+// get the block device itself at [volume destination]/device. Returns the node path
+func exposeBlockDevice(device, mountpath string, readonly bool) (string, error) {
+	rdev, err := deviceNumber(device)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(mountpath, os.ModeDir|os.FileMode(int(0775))); err != nil {
+		return "", fmt.Errorf("error creating mount directory %s: %s", mountpath, err)
+	}
+	node := filepath.Join(mountpath, blockDeviceNodeName)
+	if err := os.Remove(node); err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("error removing old device node %s: %s", node, err)
+	}
+	perm := uint32(0660)
+	if readonly {
+		perm = 0440
+	}
+	if err := syscall.Mknod(node, syscall.S_IFBLK|perm, int(rdev)); err != nil {
+		return "", fmt.Errorf("error creating device node %s for %s: %s", node, device, err)
+	}
+	return node, nil
+}
+
+// removeBlockDevice removes the device node of a block mode volume
+func removeBlockDevice(mountpath string) error {
+	node := filepath.Join(mountpath, blockDeviceNodeName)
+	if err := os.Remove(node); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// findBlockMount returns the mount directory holding a device node for device, which means that
+// the mapped device is in use by a block mode volume
+func (d *cephRBDVolumeDriver) findBlockMount(pool, name, device string) (string, bool) {
+	rdev, err := deviceNumber(device)
+	if err != nil {
+		return "", false
+	}
+	for _, readonly := range []bool{false, true} {
+		mountpath := d.mountpoint(pool, name, readonly)
+		nodeRdev, err := deviceNumber(filepath.Join(mountpath, blockDeviceNodeName))
+		if err == nil && nodeRdev == rdev {
+			return mountpath, true
+		}
+	}
+	return "", false
+}
+
+// deviceNumber returns the device number of a block device node
+func deviceNumber(path string) (uint64, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	if fi.Mode()&os.ModeDevice == 0 || fi.Mode()&os.ModeCharDevice != 0 {
+		return 0, fmt.Errorf("%s is not a block device", path)
+	}
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fmt.Errorf("unable to get device number of %s", path)
+	}
+	return uint64(st.Rdev), nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseModeOption(t *testing.T) {
+	for value, expected := range map[string]bool{"": false, "filesystem": false, "block": true} {
+		block, err := parseModeOption(value)
+		if err != nil || block != expected {
+			t.Errorf("expected %v for mode '%s' but got %v %v", expected, value, block, err)
+		}
+	}
+	if _, err := parseModeOption("raw"); err == nil {
+		t.Fatal("expected error for invalid mode option")
+	}
+}
+
+func TestExposeBlockDevice(t *testing.T) {
+	if _, err := deviceNumber("/dev/null"); err == nil {
+		t.Fatal("expected error for character device")
+	}
+
+	// any block device of the host will do
+	device := ""
+	files, _ := ioutil.ReadDir("/dev")
+	for _, f := range files {
+		if _, err := deviceNumber(filepath.Join("/dev", f.Name())); err == nil {
+			device = filepath.Join("/dev", f.Name())
+			break
+		}
+	}
+	if device == "" {
+		t.Skip("no block device found")
+	}
+
+	dir, err := ioutil.TempDir("", "cepher-block")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	d := &cephRBDVolumeDriver{rootMountDir: dir}
+	mountpath := d.mountpoint("volumes", "db", false)
+	if _, err := exposeBlockDevice(device, mountpath, false); err != nil {
+		t.Skipf("unable to create device nodes: %s", err)
+	}
+	if found, ok := d.findBlockMount("volumes", "db", device); !ok || found != mountpath {
+		t.Fatalf("expected block mount at %s but got %s %v", mountpath, found, ok)
+	}
+	if err := removeBlockDevice(mountpath); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.findBlockMount("volumes", "db", device); ok {
+		t.Fatal("expected no block mount after removal")
+	}
+}
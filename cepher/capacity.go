@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+const mb = 1024 * 1024
+
+// poolLimits are the checks applied before creating images in a pool. Zero values disable a check
+type poolLimits struct {
+	maxImageSizeMB   uint64
+	maxVolumes       uint64
+	maxProvisionedMB uint64
+	// overcommitRatio is how many times the provisioned size of the images may exceed the pool
+	// capacity (or its byte quota). Images are thin provisioned, so ratios above 1 are usual
+	overcommitRatio float64
+}
+
+// poolLimitOptions are the names of the limits in the pool-limits configuration
+var poolLimitOptions = []string{"max-image-size", "max-volumes", "max-provisioned", "overcommit-ratio"}
+
+// set parses a limit. Sizes are in MB, or with a K, M, G, T or P suffix
+func (l *poolLimits) set(name, value string) error {
+	var err error
+	switch name {
+	case "max-image-size":
+		l.maxImageSizeMB, err = parseSizeMB(value)
+	case "max-volumes":
+		l.maxVolumes, err = strconv.ParseUint(value, 10, 64)
+	case "max-provisioned":
+		l.maxProvisionedMB, err = parseSizeMB(value)
+	case "overcommit-ratio":
+		l.overcommitRatio, err = strconv.ParseFloat(value, 64)
+		if err == nil && l.overcommitRatio < 0 {
+			err = fmt.Errorf("must not be negative")
+		}
+	default:
+		return fmt.Errorf("unknown pool limit '%s'. Options are %s", name, strings.Join(poolLimitOptions, ", "))
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s '%s': %s", name, value, err)
+	}
+	return nil
+}
+
+// parsePoolLimits parses per pool limits like 'volumes:max-image-size=1T,max-volumes=100;fast:overcommit-ratio=1'.
+// Limits not set for a pool are taken from defaults
+func parsePoolLimits(defaults poolLimits, spec string) (map[string]poolLimits, error) {
+	limits := make(map[string]poolLimits)
+	for _, poolSpec := range strings.Split(spec, ";") {
+		poolSpec = strings.TrimSpace(poolSpec)
+		if poolSpec == "" {
+			continue
+		}
+		parts := strings.SplitN(poolSpec, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid pool limits '%s'. Use [pool]:[limit]=[value],...", poolSpec)
+		}
+		l := defaults
+		for _, kv := range strings.Split(parts[1], ",") {
+			nv := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+			if len(nv) != 2 {
+				return nil, fmt.Errorf("invalid pool limit '%s' for pool %s. Use [limit]=[value]", kv, parts[0])
+			}
+			if err := l.set(nv[0], nv[1]); err != nil {
+				return nil, fmt.Errorf("pool %s: %s", parts[0], err)
+			}
+		}
+		limits[parts[0]] = l
+	}
+	return limits, nil
+}
+
+// parseSizeMB parses sizes in MB, or with a K, M, G, T or P suffix
+func parseSizeMB(value string) (uint64, error) {
+	value = strings.ToUpper(strings.TrimSuffix(strings.TrimSpace(value), "B"))
+	multipliers := map[string]float64{"K": 1.0 / 1024, "M": 1, "G": 1024, "T": 1024 * 1024, "P": 1024 * 1024 * 1024}
+	multiplier := 1.0
+	if len(value) > 0 {
+		if m, ok := multipliers[value[len(value)-1:]]; ok {
+			multiplier = m
+			value = value[:len(value)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", value)
+	}
+	return uint64(n * multiplier), nil
+}
+
+// parseCapacityLimits parses the limits configured for all pools and the per pool overrides
+func (d *cephRBDVolumeDriver) parseCapacityLimits() error {
+	defaults := poolLimits{}
+	values := map[string]string{
+		"max-image-size":   d.maxImageSize,
+		"max-volumes":      d.maxVolumes,
+		"max-provisioned":  d.maxProvisioned,
+		"overcommit-ratio": d.overcommitRatio,
+	}
+	for _, name := range poolLimitOptions {
+		if values[name] == "" {
+			continue
+		}
+		if err := defaults.set(name, values[name]); err != nil {
+			return err
+		}
+	}
+	limits, err := parsePoolLimits(defaults, d.poolLimitsSpec)
+	if err != nil {
+		return err
+	}
+	d.defaultPoolLimits = defaults
+	d.poolLimits = limits
+	return nil
+}
+
+// limitsForPool returns the limits configured for the pool
+func (d *cephRBDVolumeDriver) limitsForPool(pool string) poolLimits {
+	if l, ok := d.poolLimits[pool]; ok {
+		return l
+	}
+	return d.defaultPoolLimits
+}
+
+// poolUsage is the space used, available and the quotas of a pool
+type poolUsage struct {
+	storedBytes    uint64
+	maxAvailBytes  uint64
+	objects        uint64
+	quotaMaxBytes  uint64
+	quotaMaxObject uint64
+}
+
+// capacityBytes is the size of the data in the pool plus the space still available to it
+func (u poolUsage) capacityBytes() uint64 {
+	return u.storedBytes + u.maxAvailBytes
+}
+
+// checkCapacity rejects new images that would break the limits of the pool or overcommit its
+// capacity or quota. Space is checked in dataPool, when set, as it receives the image data. The
+// provisioned size is the one of the images in pool only: images of other pools sharing dataPool
+// aren't counted, as finding them takes an 'rbd info' per image.
+// Images claimed from the warm pool (claim) are already counted in the provisioned size, so only
+// the image size and volume count limits are checked for them
+func (d *cephRBDVolumeDriver) checkCapacity(pool, dataPool string, sizeMB int, claim bool) error {
+	limits := d.limitsForPool(pool)
+	size := uint64(sizeMB)
+	if limits.maxImageSizeMB > 0 && size > limits.maxImageSizeMB {
+		return fmt.Errorf("image size %dMB exceeds the maximum image size of pool %s (%dMB)", size, pool, limits.maxImageSizeMB)
+	}
+	if limits.maxVolumes == 0 && (claim || (limits.maxProvisionedMB == 0 && limits.overcommitRatio == 0)) {
+		return nil
+	}
+
+	count, provisionedBytes, err := d.poolProvisioned(pool)
+	if err != nil {
+		return fmt.Errorf("error getting provisioned size of pool %s: %s", pool, err)
+	}
+	if limits.maxVolumes > 0 && count+1 > limits.maxVolumes {
+		return fmt.Errorf("pool %s already has %d volumes, the maximum allowed", pool, count)
+	}
+	if claim {
+		return nil
+	}
+	newProvisioned := provisionedBytes + size*mb
+	if limits.maxProvisionedMB > 0 && newProvisioned > limits.maxProvisionedMB*mb {
+		return fmt.Errorf("image size %dMB would raise the provisioned size of pool %s to %dMB, over its limit of %dMB", size, pool, newProvisioned/mb, limits.maxProvisionedMB)
+	}
+	if limits.overcommitRatio == 0 {
+		return nil
+	}
+
+	spacePool := pool
+	if dataPool != "" {
+		spacePool = dataPool
+	}
+	usage, err := poolUsageStats(spacePool)
+	if err != nil {
+		return fmt.Errorf("error getting usage of pool %s: %s", spacePool, err)
+	}
+	logrus.Debugf("pool %s: provisioned=%d usage=%+v limits=%+v", pool, provisionedBytes, usage, limits)
+	if usage.quotaMaxObject > 0 && usage.objects >= usage.quotaMaxObject {
+		return fmt.Errorf("pool %s reached its quota of %d objects", spacePool, usage.quotaMaxObject)
+	}
+	if usage.quotaMaxBytes > 0 {
+		allowed := uint64(float64(usage.quotaMaxBytes) * limits.overcommitRatio)
+		if newProvisioned > allowed {
+			return fmt.Errorf("image size %dMB would provision %dMB in pool %s, over its quota of %dMB with overcommit ratio %g", size, newProvisioned/mb, spacePool, usage.quotaMaxBytes/mb, limits.overcommitRatio)
+		}
+	}
+	allowed := uint64(float64(usage.capacityBytes()) * limits.overcommitRatio)
+	if newProvisioned > allowed {
+		return fmt.Errorf("image size %dMB would provision %dMB in pool %s, over its capacity of %dMB (%dMB available) with overcommit ratio %g", size, newProvisioned/mb, spacePool, usage.capacityBytes()/mb, usage.maxAvailBytes/mb, limits.overcommitRatio)
+	}
+	return nil
+}
+
+// poolProvisioned returns the number of volumes in the pool and the sum of their sizes. Trashed and warm images are
+// counted in the provisioned size, because they use space, but not as volumes
+func (d *cephRBDVolumeDriver) poolProvisioned(pool string) (count uint64, provisionedBytes uint64, err error) {
+	out, err := d.rbdshTimeout(listShellTimeout, pool, "ls", "-l", "--format", "json")
+	if err != nil {
+		return 0, 0, err
+	}
+	return parsePoolProvisioned(out)
+}
+
+func parsePoolProvisioned(out string) (count uint64, provisionedBytes uint64, err error) {
+	if strings.TrimSpace(out) == "" {
+		return 0, 0, nil
+	}
+	var images []struct {
+		Image    string `json:"image"`
+		Snapshot string `json:"snapshot"`
+		Size     uint64 `json:"size"`
+	}
+	if err := json.Unmarshal([]byte(out), &images); err != nil {
+		return 0, 0, fmt.Errorf("error parsing rbd ls output: %s", err)
+	}
+	for _, i := range images {
+		if i.Snapshot != "" {
+			continue
+		}
+		provisionedBytes += i.Size
+		if !isTrashImageName(i.Image) && !isWarmImageName(i.Image) {
+			count++
+		}
+	}
+	return count, provisionedBytes, nil
+}
+
+// poolUsageStats returns the usage and quotas of the pool
+func poolUsageStats(pool string) (poolUsage, error) {
+	usage := poolUsage{}
+	df, err := ExecShellTimeout(listShellTimeout, "ceph", "df", "detail", "--format", "json")
+	if err != nil {
+		return usage, err
+	}
+	quota, err := shWithDefaultTimeout("ceph", "osd", "pool", "get-quota", pool, "--format", "json")
+	if err != nil {
+		return usage, err
+	}
+	return parsePoolUsage(pool, df, quota)
+}
+
+func parsePoolUsage(pool, df, quota string) (poolUsage, error) {
+	usage := poolUsage{}
+	var dfStats struct {
+		Pools []struct {
+			Name  string `json:"name"`
+			Stats struct {
+				Stored    uint64 `json:"stored"`
+				BytesUsed uint64 `json:"bytes_used"`
+				MaxAvail  uint64 `json:"max_avail"`
+				Objects   uint64 `json:"objects"`
+			} `json:"stats"`
+		} `json:"pools"`
+	}
+	if err := json.Unmarshal([]byte(df), &dfStats); err != nil {
+		return usage, fmt.Errorf("error parsing ceph df output: %s", err)
+	}
+	found := false
+	for _, p := range dfStats.Pools {
+		if p.Name != pool {
+			continue
+		}
+		found = true
+		// 'stored' is the user data since Nautilus. Older releases report it as 'bytes_used'
+		usage.storedBytes = p.Stats.Stored
+		if usage.storedBytes == 0 {
+			usage.storedBytes = p.Stats.BytesUsed
+		}
+		usage.maxAvailBytes = p.Stats.MaxAvail
+		usage.objects = p.Stats.Objects
+	}
+	if !found {
+		return usage, fmt.Errorf("pool %s not found in ceph df", pool)
+	}
+	var quotas struct {
+		MaxBytes   uint64 `json:"quota_max_bytes"`
+		MaxObjects uint64 `json:"quota_max_objects"`
+	}
+	if err := json.Unmarshal([]byte(quota), &quotas); err != nil {
+		return usage, fmt.Errorf("error parsing pool quota: %s", err)
+	}
+	usage.quotaMaxBytes = quotas.MaxBytes
+	usage.quotaMaxObject = quotas.MaxObjects
+	return usage, nil
+}
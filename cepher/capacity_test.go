@@ -0,0 +1,76 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParsePoolLimits(t *testing.T) {
+	d := &cephRBDVolumeDriver{maxImageSize: "2T", overcommitRatio: "3", poolLimitsSpec: "fast:overcommit-ratio=1.5,max-volumes=10; small:max-image-size=512"}
+	if err := d.parseCapacityLimits(); err != nil {
+		t.Fatal(err)
+	}
+	if l := d.limitsForPool("volumes"); l.maxImageSizeMB != 2*1024*1024 || l.overcommitRatio != 3 || l.maxVolumes != 0 {
+		t.Fatalf("unexpected default limits %+v", l)
+	}
+	if l := d.limitsForPool("fast"); l.maxImageSizeMB != 2*1024*1024 || l.overcommitRatio != 1.5 || l.maxVolumes != 10 {
+		t.Fatalf("unexpected limits for pool fast %+v", l)
+	}
+	if l := d.limitsForPool("small"); l.maxImageSizeMB != 512 {
+		t.Fatalf("unexpected limits for pool small %+v", l)
+	}
+	for _, spec := range []string{"fast", "fast:max-volumes", "fast:unknown=1", "fast:overcommit-ratio=-1", "fast:max-image-size=big"} {
+		if _, err := parsePoolLimits(poolLimits{}, spec); err == nil {
+			t.Errorf("expected error for pool limits '%s'", spec)
+		}
+	}
+}
+
+func TestParseSizeMB(t *testing.T) {
+	for value, expected := range map[string]uint64{"100": 100, "100M": 100, "1.5G": 1536, "50TB": 50 * 1024 * 1024, "2048k": 2} {
+		size, err := parseSizeMB(value)
+		if err != nil || size != expected {
+			t.Errorf("expected %d for '%s' but got %d %v", expected, value, size, err)
+		}
+	}
+}
+
+func TestParsePoolProvisioned(t *testing.T) {
+	out := `[{"image":"a","size":1073741824,"format":2},{"image":"a","snapshot":"s1","size":1073741824,"format":2},{"image":"trash_1_b","size":2147483648,"format":2}]`
+	count, provisioned, err := parsePoolProvisioned(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || provisioned != 3*1024*1024*1024 {
+		t.Fatalf("expected 1 volume with 3GB provisioned but got %d %d", count, provisioned)
+	}
+}
+
+func TestParsePoolUsage(t *testing.T) {
+	df := `{"stats":{},"pools":[{"name":"other","id":1,"stats":{"stored":1}},{"name":"volumes","id":2,"stats":{"bytes_used":1073741824,"max_avail":10737418240,"objects":300}}]}`
+	quota := `{"pool_name":"volumes","pool_id":2,"quota_max_objects":0,"quota_max_bytes":5368709120}`
+	usage, err := parsePoolUsage("volumes", df, quota)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.capacityBytes() != 11*1024*1024*1024 || usage.quotaMaxBytes != 5*1024*1024*1024 || usage.objects != 300 {
+		t.Fatalf("unexpected usage %+v", usage)
+	}
+	if _, err := parsePoolUsage("missing", df, quota); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("expected pool not found error but got %v", err)
+	}
+}
+
+func TestCheckCapacityMaxImageSize(t *testing.T) {
+	d := &cephRBDVolumeDriver{defaultPoolLimits: poolLimits{maxImageSizeMB: 1024 * 1024}}
+	err := d.checkCapacity("volumes", "", 50*1024*1024, false)
+	if err == nil || !strings.Contains(err.Error(), "maximum image size") {
+		t.Fatalf("expected maximum image size error but got %v", err)
+	}
+	if err := d.checkCapacity("volumes", "", 1024, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.checkCapacity("volumes", "", 50*1024*1024, true); err == nil {
+		t.Fatal("expected maximum image size to be checked for warm images too")
+	}
+}
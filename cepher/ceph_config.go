@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/sirupsen/logrus"
+)
+
+// cephConfigPollInterval is how often file sources (like Docker secrets) are checked for changes
+var cephConfigPollInterval = 30 * time.Second
+
+// cephConfigSource is a place where the keyring or ceph.conf contents can be found.
+// Sources are tried in order: env (base64), file and then the ETCD key
+type cephConfigSource struct {
+	name    string // 'keyring' or 'ceph.conf'
+	base64  string
+	file    string
+	etcdKey string
+	target  string
+	perm    os.FileMode
+}
+
+// cephConfigSources returns the keyring and ceph.conf sources configured for the driver
+func (d *cephRBDVolumeDriver) cephConfigSources() []cephConfigSource {
+	cluster := d.cephCluster
+	if cluster == "" {
+		cluster = "ceph"
+	}
+	etcdKeyring, etcdConfig := "", ""
+	if d.lockEtcdServers != "" {
+		etcdKeyring = fmt.Sprintf("/%s/keyring", cluster)
+		etcdConfig = fmt.Sprintf("/%s/ceph.conf", cluster)
+	}
+	return []cephConfigSource{
+		{
+			name:    "keyring",
+			base64:  d.cephKeyringBase64,
+			file:    d.cephKeyringSrcFile,
+			etcdKey: etcdKeyring,
+			target:  d.cephKeyringFile,
+			perm:    0600,
+		},
+		{
+			name:    "ceph.conf",
+			base64:  d.cephConfigBase64,
+			file:    d.cephConfigSrcFile,
+			etcdKey: etcdConfig,
+			target:  d.cephConfigFile,
+			perm:    0644,
+		},
+	}
+}
+
+// cephConfigEtcdClientConfig returns the ETCD connection settings for reading the Ceph config.
+// The lock key prefix is not used, because the keyring is written by the Ceph cluster containers
+func (d *cephRBDVolumeDriver) cephConfigEtcdClientConfig() etcdClientConfig {
+	config := d.etcdClientConfig()
+	config.prefix = ""
+	return config
+}
+
+// provisionCephConfig writes the Ceph keyring and ceph.conf from the configured sources.
+// If no ceph.conf source is found but monitor hosts are known, ceph.conf is generated from them.
+// Existing files are kept when no source is configured
+func (d *cephRBDVolumeDriver) provisionCephConfig() error {
+	var cli *clientv3.Client
+	if d.lockEtcdServers != "" {
+		c, err := newEtcdClient(d.cephConfigEtcdClientConfig())
+		if err != nil {
+			return fmt.Errorf("error connecting to ETCD for Ceph config: %s", err)
+		}
+		defer c.Close()
+		cli = c
+	}
+
+	for _, source := range d.cephConfigSources() {
+		data, err := source.read(cli)
+		if err != nil {
+			return err
+		}
+		if data == nil && source.name == "ceph.conf" && d.cephMonitors != "" {
+			logrus.Debugf("Generating %s for monitors %s", source.target, d.cephMonitors)
+			data = d.generateCephConfig()
+		}
+		if data == nil {
+			if _, err := os.Stat(source.target); err != nil {
+				logrus.Warnf("No %s source configured and %s was not found", source.name, source.target)
+			}
+			continue
+		}
+		if err := source.write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// generateCephConfig returns a minimal ceph.conf pointing to the monitor hosts
+func (d *cephRBDVolumeDriver) generateCephConfig() []byte {
+	auth := d.cephAuth
+	if auth == "" {
+		auth = "cephx"
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "[global]\n")
+	fmt.Fprintf(&b, "mon host = %s\n", d.cephMonitors)
+	fmt.Fprintf(&b, "auth cluster required = %s\n", auth)
+	fmt.Fprintf(&b, "auth service required = %s\n", auth)
+	fmt.Fprintf(&b, "auth client required = %s\n", auth)
+	fmt.Fprintf(&b, "keyring = %s\n", d.cephKeyringFile)
+	return b.Bytes()
+}
+
+// watchCephConfig keeps the keyring and ceph.conf up to date when their sources change,
+// so that rotated cephx keys are used without restarting the plugin
+func (d *cephRBDVolumeDriver) watchCephConfig() {
+	for _, source := range d.cephConfigSources() {
+		if source.base64 != "" {
+			// ENVs can't change while running
+			continue
+		}
+		if source.file != "" {
+			go source.pollFile()
+			continue
+		}
+		if source.etcdKey != "" {
+			go source.watchEtcd(d.cephConfigEtcdClientConfig())
+		}
+	}
+}
+
+// read returns the source contents or nil if it is not available
+func (s cephConfigSource) read(cli *clientv3.Client) ([]byte, error) {
+	if s.base64 != "" {
+		data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s.base64))
+		if err != nil {
+			return nil, fmt.Errorf("error decoding base64 %s from ENV: %s", s.name, err)
+		}
+		return data, nil
+	}
+	if s.file != "" {
+		data, err := ioutil.ReadFile(s.file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s from %s: %s", s.name, s.file, err)
+		}
+		return data, nil
+	}
+	if s.etcdKey != "" && cli != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		resp, err := cli.Get(ctx, s.etcdKey)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s from ETCD key %s: %s", s.name, s.etcdKey, err)
+		}
+		if len(resp.Kvs) == 0 {
+			logrus.Debugf("ETCD key %s not found", s.etcdKey)
+			return nil, nil
+		}
+		return decodeEtcdValue(s.name, resp.Kvs[0].Value)
+	}
+	return nil, nil
+}
+
+// decodeEtcdValue decodes base64 encoded values. Plain text values are accepted as well
+func decodeEtcdValue(name string, value []byte) ([]byte, error) {
+	trimmed := strings.TrimSpace(string(value))
+	if strings.Contains(trimmed, "[") {
+		// keyring and ceph.conf sections. not base64
+		return value, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(trimmed)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding base64 %s from ETCD: %s", name, err)
+	}
+	return data, nil
+}
+
+// write replaces the target file atomically if its contents changed
+func (s cephConfigSource) write(data []byte) error {
+	current, err := ioutil.ReadFile(s.target)
+	if err == nil && bytes.Equal(current, data) {
+		logrus.Debugf("%s is up to date", s.target)
+		return nil
+	}
+	if err := writeFileAtomic(s.target, data, s.perm); err != nil {
+		return fmt.Errorf("error writing %s to %s: %s", s.name, s.target, err)
+	}
+	logrus.Infof("Updated %s at %s", s.name, s.target)
+	return nil
+}
+
+func (s cephConfigSource) pollFile() {
+	for {
+		time.Sleep(cephConfigPollInterval)
+		data, err := s.read(nil)
+		if err != nil {
+			logrus.Warnf("%s", err)
+			continue
+		}
+		if err := s.write(data); err != nil {
+			logrus.Errorf("%s", err)
+		}
+	}
+}
+
+func (s cephConfigSource) watchEtcd(config etcdClientConfig) {
+	for {
+		cli, err := newEtcdClient(config)
+		if err != nil {
+			logrus.Warnf("error connecting to ETCD for watching %s: %s", s.etcdKey, err)
+			time.Sleep(10 * time.Second)
+			continue
+		}
+		// catch up with changes made while not watching
+		if data, err := s.read(cli); err != nil {
+			logrus.Warnf("%s", err)
+		} else if data != nil {
+			if err := s.write(data); err != nil {
+				logrus.Errorf("%s", err)
+			}
+		}
+		logrus.Debugf("Watching ETCD key %s for %s changes", s.etcdKey, s.name)
+		for resp := range cli.Watch(clientv3.WithRequireLeader(context.Background()), s.etcdKey) {
+			if err := resp.Err(); err != nil {
+				logrus.Warnf("error watching ETCD key %s: %s", s.etcdKey, err)
+				break
+			}
+			for _, ev := range resp.Events {
+				if ev.Type != clientv3.EventTypePut {
+					logrus.Warnf("ETCD key %s was deleted. Keeping current %s", s.etcdKey, s.target)
+					continue
+				}
+				data, err := decodeEtcdValue(s.name, ev.Kv.Value)
+				if err != nil {
+					logrus.Errorf("%s", err)
+					continue
+				}
+				if err := s.write(data); err != nil {
+					logrus.Errorf("%s", err)
+				}
+			}
+		}
+		cli.Close()
+		time.Sleep(10 * time.Second)
+	}
+}
+
+// writeFileAtomic writes data to a temporary file in the same dir and renames it over path,
+// so that readers never see a partially written file
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, os.ModeDir|os.FileMode(int(0755))); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
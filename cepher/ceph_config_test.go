@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProvisionCephConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cepher-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyring := "[client.admin]\n\tkey = AQBm\n"
+	secret := filepath.Join(dir, "secret")
+	if err := ioutil.WriteFile(secret, []byte(keyring), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &cephRBDVolumeDriver{
+		cephConfigFile:     filepath.Join(dir, "etc", "ceph.conf"),
+		cephKeyringFile:    filepath.Join(dir, "etc", "keyring"),
+		cephKeyringSrcFile: secret,
+		cephMonitors:       "10.0.0.1:6789,10.0.0.2:6789",
+	}
+	if err := d.provisionCephConfig(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(d.cephKeyringFile)
+	if err != nil || string(data) != keyring {
+		t.Fatalf("expected keyring to be copied from source file but got '%s' %v", data, err)
+	}
+	info, _ := os.Stat(d.cephKeyringFile)
+	if info.Mode().Perm() != 0600 {
+		t.Fatalf("expected keyring mode 0600 but got %v", info.Mode().Perm())
+	}
+	data, err = ioutil.ReadFile(d.cephConfigFile)
+	if err != nil || !strings.Contains(string(data), "mon host = 10.0.0.1:6789,10.0.0.2:6789") || !strings.Contains(string(data), "auth client required = cephx") {
+		t.Fatalf("expected ceph.conf to be generated from monitors but got '%s' %v", data, err)
+	}
+
+	// env source has precedence and rotated keys are rewritten
+	rotated := "[client.admin]\n\tkey = AQCn\n"
+	d.cephKeyringBase64 = base64.StdEncoding.EncodeToString([]byte(rotated))
+	if err := d.provisionCephConfig(); err != nil {
+		t.Fatal(err)
+	}
+	data, _ = ioutil.ReadFile(d.cephKeyringFile)
+	if string(data) != rotated {
+		t.Fatalf("expected rotated keyring but got '%s'", data)
+	}
+	files, _ := ioutil.ReadDir(filepath.Dir(d.cephKeyringFile))
+	if len(files) != 2 {
+		t.Fatalf("expected only keyring and ceph.conf but found %d files", len(files))
+	}
+}
+
+func TestDecodeEtcdValue(t *testing.T) {
+	keyring := "[client.admin]\n\tkey = AQBm\n"
+	for _, value := range []string{keyring, base64.StdEncoding.EncodeToString([]byte(keyring)) + "\n"} {
+		data, err := decodeEtcdValue("keyring", []byte(value))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != keyring {
+			t.Fatalf("expected '%s' but got '%s'", keyring, data)
+		}
+	}
+	if _, err := decodeEtcdValue("keyring", []byte("not base64!")); err == nil {
+		t.Fatal("expected error decoding invalid value")
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Images are marked as initializing in their metadata from 'rbd create' until the filesystem and
+// the volume metadata are in place. Images still initializing were left behind by a create that
+// failed or was interrupted, and are removed instead of being reused
+const (
+	stateImageMetaKey = "cepher.state"
+	initializingState = "initializing"
+)
+
+// initializingGracePeriod is how long an image may stay initializing before it is considered left
+// behind when there is no lock backend. Until then, it may still be being created by another host
+const initializingGracePeriod = 15 * time.Minute
+
+// beginCreate marks a newly created image as initializing. The create is also recorded in the
+// inventory, so that it is rolled back when the plugin restarts after a crash
+func (d *cephRBDVolumeDriver) beginCreate(pool, name string) error {
+	d.inventory.startCreate(pool + "/" + name)
+	state := fmt.Sprintf("%s since %s", initializingState, time.Now().UTC().Format(time.RFC3339))
+	if err := d.setImageMeta(pool, name, stateImageMetaKey, state); err != nil {
+		return fmt.Errorf("error marking RBD Image %s/%s as initializing: %s", pool, name, err)
+	}
+	return nil
+}
+
+// finishCreate marks the image as ready
+func (d *cephRBDVolumeDriver) finishCreate(pool, name string) error {
+	if err := d.removeImageMeta(pool, name, stateImageMetaKey); err != nil {
+		return fmt.Errorf("error marking RBD Image %s/%s as ready: %s", pool, name, err)
+	}
+	d.inventory.finishCreate(pool + "/" + name)
+	return nil
+}
+
+// rollbackCreate removes a half created image and its encryption key. If the image can't be removed
+// it stays marked as initializing and is cleaned up by the next create of the volume or plugin start
+func (d *cephRBDVolumeDriver) rollbackCreate(pool, name string) error {
+	logrus.Warnf("Rolling back creation of RBD Image %s/%s", pool, name)
+	keyID, err := d.getImageMeta(pool, name, cryptKeyIDImageMetaKey)
+	if err != nil && !strings.Contains(err.Error(), "No such file or directory") {
+		logrus.Warnf("unable to get key ID of RBD Image %s/%s: %s", pool, name, err)
+	}
+	if err := d.removeRBDImage(pool, name); err != nil && !strings.Contains(err.Error(), "No such file or directory") {
+		return fmt.Errorf("error rolling back creation of RBD Image %s/%s: %s", pool, name, err)
+	}
+	if keyID != "" && d.keys != nil {
+		if err := d.keys.DeleteKey(keyID); err != nil {
+			logrus.Warnf("RBD Image %s/%s was rolled back but its encryption key %s couldn't be deleted: %s", pool, name, keyID, err)
+		}
+	}
+	d.inventory.finishCreate(pool + "/" + name)
+	d.imageListCache.invalidate()
+	logrus.Infof("Creation of RBD Image %s/%s rolled back", pool, name)
+	return nil
+}
+
+// isInitializing returns true if the image is being created or was left behind by a failed or
+// interrupted create, and since when it is initializing
+func (d *cephRBDVolumeDriver) isInitializing(pool, name string) (bool, time.Time, error) {
+	state, err := d.getImageMeta(pool, name, stateImageMetaKey)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	initializing, since := parseInitializingState(state)
+	return initializing, since, nil
+}
+
+// parseInitializingState parses the state image metadata. Images marked by older versions have no
+// start time, which is returned as the zero time
+func parseInitializingState(state string) (bool, time.Time) {
+	if state == initializingState {
+		return true, time.Time{}
+	}
+	prefix := initializingState + " since "
+	if !strings.HasPrefix(state, prefix) {
+		return false, time.Time{}
+	}
+	since, err := time.Parse(time.RFC3339, strings.TrimPrefix(state, prefix))
+	if err != nil {
+		return true, time.Time{}
+	}
+	return true, since
+}
+
+// checkRollbackInitializing returns an error if an image initializing since the given time may still
+// be being created. With a lock backend, the caller holds the create lock, so no other create of the
+// image is running. Without one, another host may be creating it until initializingGracePeriod passes
+func (d *cephRBDVolumeDriver) checkRollbackInitializing(pool, name string, since time.Time) error {
+	if d.locks != nil {
+		return nil
+	}
+	if age := time.Since(since); age < initializingGracePeriod {
+		return fmt.Errorf("RBD Image %s/%s is initializing since %s ago. It may still be being created by another host. Try again after %s", pool, name, age.Round(time.Second), initializingGracePeriod)
+	}
+	return nil
+}
+
+// recoverInterruptedCreates rolls back the creates that were running on this host when the plugin stopped
+func (d *cephRBDVolumeDriver) recoverInterruptedCreates() {
+	for _, volumeName := range d.inventory.pendingCreates() {
+		parts := strings.SplitN(volumeName, "/", 2)
+		if len(parts) != 2 {
+			d.inventory.finishCreate(volumeName)
+			continue
+		}
+		if err := d.recoverInterruptedCreate(parts[0], parts[1]); err != nil {
+			logrus.Warnf("unable to recover interrupted creation of volume %s: %s", volumeName, err)
+		}
+	}
+}
+
+func (d *cephRBDVolumeDriver) recoverInterruptedCreate(pool, name string) error {
+	mutex, err := d.lockCreateVolume(pool, name)
+	if err != nil {
+		return err
+	}
+	defer d.unlockCreateVolume(mutex)
+
+	exists, err := d.rbdImageExists(pool, name)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		d.inventory.finishCreate(pool + "/" + name)
+		return nil
+	}
+	initializing, since, err := d.isInitializing(pool, name)
+	if err != nil {
+		return err
+	}
+	if !initializing {
+		// the create completed and only the inventory wasn't updated
+		d.inventory.finishCreate(pool + "/" + name)
+		return nil
+	}
+	if err := d.checkRollbackInitializing(pool, name, since); err != nil {
+		return err
+	}
+	logrus.Infof("Found RBD Image %s/%s from an interrupted create", pool, name)
+	return d.rollbackCreate(pool, name)
+}
+
+// startCreate records a create in progress
+func (inv *inventory) startCreate(volumeName string) {
+	if inv == nil {
+		return
+	}
+	inv.m.Lock()
+	defer inv.m.Unlock()
+	if inv.Creating == nil {
+		inv.Creating = make(map[string]time.Time)
+	}
+	inv.Creating[volumeName] = time.Now()
+	inv.save()
+}
+
+func (inv *inventory) finishCreate(volumeName string) {
+	if inv == nil {
+		return
+	}
+	inv.m.Lock()
+	defer inv.m.Unlock()
+	if _, ok := inv.Creating[volumeName]; !ok {
+		return
+	}
+	delete(inv.Creating, volumeName)
+	inv.save()
+}
+
+// pendingCreates returns the creates that didn't finish
+func (inv *inventory) pendingCreates() []string {
+	if inv == nil {
+		return nil
+	}
+	inv.m.Lock()
+	defer inv.m.Unlock()
+	names := make([]string, 0)
+	for name := range inv.Creating {
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func TestPendingCreates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cepher-inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "inventory.json")
+
+	inv, err := loadInventory(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv.startCreate("volumes/a")
+	inv.startCreate("volumes/b")
+	inv.finishCreate("volumes/b")
+
+	inv, err = loadInventory(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := inv.pendingCreates()
+	if len(pending) != 1 || pending[0] != "volumes/a" {
+		t.Fatalf("expected volumes/a to be pending but got %v", pending)
+	}
+
+	var nilInventory *inventory
+	nilInventory.startCreate("volumes/a")
+	if len(nilInventory.pendingCreates()) != 0 {
+		t.Fatal("expected no pending creates in nil inventory")
+	}
+}
+
+func TestParseVolumeMetadataState(t *testing.T) {
+	meta := volumeMetadata{Options: make(map[string]string), Labels: make(map[string]string)}
+	if err := parseVolumeMetadata(`{"cepher.state":"initializing","cepher.opt.size":"1024"}`, &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.State != initializingState || meta.Options["size"] != "1024" {
+		t.Fatalf("unexpected metadata %+v", meta)
+	}
+}
+
+func TestCreateRejectsInvalidPoolNames(t *testing.T) {
+	d := cephRBDVolumeDriver{defaultCephPool: "volumes", defaultImageSizeMB: 1024}
+	invalid := []map[string]string{
+		{"data-pool": "ec; rm -rf /"},
+		{"data-pool": "ec", "data-pool-erasure-profile": "$(reboot)"},
+		{"pool": "volumes`id`"},
+	}
+	for _, options := range invalid {
+		err := d.CreateInternal(&volume.CreateRequest{Name: "volumes/myimage", Options: options})
+		if err == nil || !strings.Contains(err.Error(), "invalid") {
+			t.Fatalf("expected %v to be rejected but got %v", options, err)
+		}
+	}
+}
+
+func TestParseInitializingState(t *testing.T) {
+	if initializing, _ := parseInitializingState(""); initializing {
+		t.Fatal("expected ready image not to be initializing")
+	}
+	initializing, since := parseInitializingState("initializing")
+	if !initializing || !since.IsZero() {
+		t.Fatalf("expected legacy state to be initializing with no start time but got %v %v", initializing, since)
+	}
+	initializing, since = parseInitializingState("initializing since 2020-01-02T03:04:05Z")
+	if !initializing || !since.Equal(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Fatalf("unexpected state %v %v", initializing, since)
+	}
+}
+
+func TestCheckRollbackInitializingWithoutLocks(t *testing.T) {
+	d := cephRBDVolumeDriver{}
+	if err := d.checkRollbackInitializing("volumes", "a", time.Now()); err == nil {
+		t.Fatal("expected image being initialized by another host not to be rolled back")
+	}
+	if err := d.checkRollbackInitializing("volumes", "a", time.Now().Add(-initializingGracePeriod)); err != nil {
+		t.Fatalf("expected image left behind to be rolled back but got %s", err)
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// image metadata keys of encrypted volumes
+const (
+	encryptionImageMetaKey = "cepher.encryption"
+	cryptKeyIDImageMetaKey = "cepher.crypt-key-id"
+)
+
+// etcdCryptKeysPrefix is where the etcd key provider stores the volume passphrases
+const etcdCryptKeysPrefix = "/cepher-keys/"
+
+// cryptMappingPrefix starts the names of the dm-crypt mappings of encrypted volumes
+const cryptMappingPrefix = "cepher-"
+
+// sysDevBlockDir links the block device numbers to their devices
+var sysDevBlockDir = "/sys/dev/block"
+
+// keyProvider stores and retrieves the passphrases of encrypted volumes. Keys are identified
+// by a random key ID stored in the image metadata, so that they survive image renames
+type keyProvider interface {
+	// CreateKey creates and stores a new passphrase
+	CreateKey(keyID string) ([]byte, error)
+	// GetKey returns a passphrase previously created with CreateKey
+	GetKey(keyID string) ([]byte, error)
+	// DeleteKey removes the passphrase. The volume data can't be read anymore
+	DeleteKey(keyID string) error
+}
+
+// newKeyProvider creates the key provider selected by cryptKeyProvider.
+// Returns nil without error when encryption is not configured
+func (d *cephRBDVolumeDriver) newKeyProvider() (keyProvider, error) {
+	switch d.cryptKeyProvider {
+	case "":
+		return nil, nil
+	case "file":
+		if d.cryptKeyFile == "" {
+			return nil, errors.New("crypt-key-file parameter is required for key provider 'file'")
+		}
+		return &fileKeyProvider{file: d.cryptKeyFile}, nil
+	case "etcd":
+		if d.lockEtcdServers == "" {
+			return nil, errors.New("lock-etcd parameter is required for key provider 'etcd'")
+		}
+		cli, err := newEtcdClient(d.etcdClientConfig())
+		if err != nil {
+			return nil, err
+		}
+		return &etcdKeyProvider{client: cli}, nil
+	case "http":
+		if d.cryptKeyURL == "" {
+			return nil, errors.New("crypt-key-url parameter is required for key provider 'http'")
+		}
+		return &httpKeyProvider{url: strings.TrimSuffix(d.cryptKeyURL, "/"), token: d.cryptKeyToken, client: &http.Client{Timeout: 30 * time.Second}}, nil
+	default:
+		return nil, fmt.Errorf("unknown key provider '%s'. Options are 'file', 'etcd' or 'http'", d.cryptKeyProvider)
+	}
+}
+
+// randomPassphrase returns a new random passphrase
+func randomPassphrase() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return []byte(hex.EncodeToString(key)), nil
+}
+
+// fileKeyProvider derives the volume passphrases from a master key file, which must
+// be the same in all hosts. Nothing is stored, so DeleteKey does nothing
+type fileKeyProvider struct {
+	file string
+}
+
+func (p *fileKeyProvider) CreateKey(keyID string) ([]byte, error) {
+	return p.GetKey(keyID)
+}
+
+func (p *fileKeyProvider) GetKey(keyID string) ([]byte, error) {
+	master, err := ioutil.ReadFile(p.file)
+	if err != nil {
+		return nil, fmt.Errorf("error reading master key file: %s", err)
+	}
+	master = bytes.TrimSpace(master)
+	if len(master) < 16 {
+		return nil, fmt.Errorf("master key file %s must have at least 16 bytes", p.file)
+	}
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte(keyID))
+	return []byte(hex.EncodeToString(mac.Sum(nil))), nil
+}
+
+func (p *fileKeyProvider) DeleteKey(keyID string) error {
+	return nil
+}
+
+// etcdKeyProvider stores random passphrases in etcd. Use etcd TLS and authentication to protect them
+type etcdKeyProvider struct {
+	client *clientv3.Client
+}
+
+func (p *etcdKeyProvider) CreateKey(keyID string) ([]byte, error) {
+	key, err := randomPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := p.client.Put(ctx, etcdCryptKeysPrefix+keyID, string(key)); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (p *etcdKeyProvider) GetKey(keyID string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := p.client.Get(ctx, etcdCryptKeysPrefix+keyID)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, fmt.Errorf("key %s not found in ETCD", keyID)
+	}
+	return resp.Kvs[0].Value, nil
+}
+
+func (p *etcdKeyProvider) DeleteKey(keyID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err := p.client.Delete(ctx, etcdCryptKeysPrefix+keyID)
+	return err
+}
+
+// httpKeyProvider stores random passphrases in a key management service with a simple
+// REST interface: PUT, GET and DELETE [url]/[key id], with the passphrase as the body
+type httpKeyProvider struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (p *httpKeyProvider) CreateKey(keyID string) ([]byte, error) {
+	key, err := randomPassphrase()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.call("PUT", keyID, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func (p *httpKeyProvider) GetKey(keyID string) ([]byte, error) {
+	key, err := p.call("GET", keyID, nil)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(key), nil
+}
+
+func (p *httpKeyProvider) DeleteKey(keyID string) error {
+	_, err := p.call("DELETE", keyID, nil)
+	return err
+}
+
+func (p *httpKeyProvider) call(method, keyID string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, p.url+"/"+keyID, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("key service returned %s for %s %s", resp.Status, method, keyID)
+	}
+	return data, nil
+}
+
+// cryptMappingName returns the dm-crypt mapping name of a volume, like cepher-volumes:myimage:ro.
+// Pool and image names can't have ':', so names of different volumes never collide
+func cryptMappingName(pool, name string, readonly bool) string {
+	mapping := fmt.Sprintf("%s%s:%s", cryptMappingPrefix, pool, name)
+	if readonly {
+		mapping = mapping + ":ro"
+	}
+	return mapping
+}
+
+// volumeKey returns the passphrase of an encrypted volume or nil if the volume is not encrypted
+func (d *cephRBDVolumeDriver) volumeKey(pool, name string) ([]byte, error) {
+	encryption, err := d.getImageMeta(pool, name, encryptionImageMetaKey)
+	if err != nil {
+		return nil, err
+	}
+	if encryption == "" {
+		return nil, nil
+	}
+	if d.keys == nil {
+		return nil, fmt.Errorf("volume %s/%s is encrypted but no key provider is configured", pool, name)
+	}
+	keyID, err := d.getImageMeta(pool, name, cryptKeyIDImageMetaKey)
+	if err != nil {
+		return nil, err
+	}
+	if keyID == "" {
+		return nil, fmt.Errorf("key ID of encrypted volume %s/%s not found", pool, name)
+	}
+	return d.keys.GetKey(keyID)
+}
+
+// newVolumeKey creates the key for a new encrypted volume and stores its ID in the image metadata
+func (d *cephRBDVolumeDriver) newVolumeKey(pool, name string) ([]byte, error) {
+	if d.keys == nil {
+		return nil, errors.New("encrypted volumes require a key provider (--crypt-key-provider)")
+	}
+	keyID := uuid.New().String()
+	key, err := d.keys.CreateKey(keyID)
+	if err != nil {
+		return nil, fmt.Errorf("error creating key for %s/%s: %s", pool, name, err)
+	}
+	if err := d.setImageMeta(pool, name, cryptKeyIDImageMetaKey, keyID); err != nil {
+		return nil, err
+	}
+	if err := d.setImageMeta(pool, name, encryptionImageMetaKey, "luks"); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// withKeyFile writes key to a temporary file readable only by root and calls fn with its path.
+// cryptsetup reads the passphrase from it, so that it doesn't show up in the process list
+func withKeyFile(key []byte, fn func(keyFile string) error) error {
+	dir := "/run"
+	if _, err := os.Stat(dir); err != nil {
+		dir = ""
+	}
+	f, err := ioutil.TempFile(dir, "cepher-key")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return err
+	}
+	if _, err := f.Write(key); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return fn(f.Name())
+}
+
+// luksFormat creates a LUKS container on the device
+func luksFormat(device string, key []byte) error {
+	return withKeyFile(key, func(keyFile string) error {
+		_, err := ExecShellTimeout(mkfsShellTimeout, "cryptsetup", "luksFormat", "--batch-mode", "--key-file", keyFile, device)
+		return err
+	})
+}
+
+// luksOpen unlocks the LUKS container on device and returns the dm-crypt device path
+func luksOpen(device string, mapping string, key []byte, readonly bool) (string, error) {
+	err := withKeyFile(key, func(keyFile string) error {
+		args := []string{"open", "--type", "luks", "--key-file", keyFile}
+		if readonly {
+			args = append(args, "--readonly")
+		}
+		args = append(args, device, mapping)
+		_, err := ExecShellTimeout(mapShellTimeout, "cryptsetup", args...)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return "/dev/mapper/" + mapping, nil
+}
+
+// luksClose removes the dm-crypt mapping
+func luksClose(mapping string) error {
+	_, err := ExecShellTimeout(mapShellTimeout, "cryptsetup", "close", mapping)
+	return err
+}
+
+// listCryptMappings returns the cepher dm-crypt mappings by their underlying device.
+// All mappings are read with a single 'dmsetup table', which doesn't show the keys
+func listCryptMappings() (map[string]string, error) {
+	mappings := make(map[string]string)
+	result, err := shWithDefaultTimeout("dmsetup", "table", "--target", "crypt")
+	if err != nil {
+		if strings.Contains(err.Error(), "command not found") {
+			return mappings, nil
+		}
+		return nil, err
+	}
+	for devNum, mapping := range parseCryptTable(result) {
+		link, err := os.Readlink(filepath.Join(sysDevBlockDir, devNum))
+		if err != nil {
+			logrus.Warnf("couldn't find underlying device %s of dm-crypt mapping %s: %s", devNum, mapping, err)
+			continue
+		}
+		mappings["/dev/"+filepath.Base(link)] = mapping
+	}
+	return mappings, nil
+}
+
+// parseCryptTable returns the cepher mappings by the number (major:minor) of their underlying
+// device from the output of 'dmsetup table --target crypt', with lines like
+// 'cepher-volumes:a: 0 2093056 crypt aes-xts-plain64 :64:logon:cryptsetup:... 0 43:0 4096'
+func parseCryptTable(table string) map[string]string {
+	mappings := make(map[string]string)
+	for _, line := range strings.Split(table, "\n") {
+		sep := strings.Index(line, ": ")
+		if sep < 0 || !strings.HasPrefix(line, cryptMappingPrefix) {
+			continue
+		}
+		// start, length, 'crypt', cipher, key, iv offset, device, offset
+		fields := strings.Fields(line[sep+2:])
+		if len(fields) < 7 || fields[2] != "crypt" {
+			continue
+		}
+		mappings[fields[6]] = line[:sep]
+	}
+	return mappings
+}
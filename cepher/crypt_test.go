@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestFileKeyProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cepher-crypt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	master := filepath.Join(dir, "master")
+	if err := ioutil.WriteFile(master, []byte("0123456789abcdef0123\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p := &fileKeyProvider{file: master}
+	key1, err := p.CreateKey("id1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := p.GetKey("id1")
+	if string(key1) != string(again) {
+		t.Fatalf("expected the same key for the same key ID but got '%s' and '%s'", key1, again)
+	}
+	key2, _ := p.GetKey("id2")
+	if string(key1) == string(key2) {
+		t.Fatal("expected different keys for different key IDs")
+	}
+
+	if err := ioutil.WriteFile(master, []byte("short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.GetKey("id1"); err == nil {
+		t.Fatal("expected error for short master key")
+	}
+}
+
+func TestHTTPKeyProvider(t *testing.T) {
+	var m sync.Mutex
+	keys := make(map[string]string)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		m.Lock()
+		defer m.Unlock()
+		id := strings.TrimPrefix(r.URL.Path, "/keys/")
+		switch r.Method {
+		case "PUT":
+			body, _ := ioutil.ReadAll(r.Body)
+			keys[id] = string(body)
+		case "GET":
+			key, ok := keys[id]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(key + "\n"))
+		case "DELETE":
+			delete(keys, id)
+		}
+	}))
+	defer server.Close()
+
+	d := &cephRBDVolumeDriver{cryptKeyProvider: "http", cryptKeyURL: server.URL + "/keys/", cryptKeyToken: "secret"}
+	p, err := d.newKeyProvider()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := p.CreateKey("id1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := p.GetKey("id1")
+	if err != nil || string(got) != string(key) {
+		t.Fatalf("expected key '%s' but got '%s' %v", key, got, err)
+	}
+	if err := p.DeleteKey("id1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.GetKey("id1"); err == nil {
+		t.Fatal("expected error getting deleted key")
+	}
+
+	d.cryptKeyToken = "wrong"
+	p, _ = d.newKeyProvider()
+	if _, err := p.CreateKey("id2"); err == nil {
+		t.Fatal("expected error with invalid token")
+	}
+}
+
+func TestCryptMappingName(t *testing.T) {
+	if cryptMappingName("a-b", "c", false) == cryptMappingName("a", "b-c", false) {
+		t.Fatal("expected different mapping names for a-b/c and a/b-c")
+	}
+	if cryptMappingName("a", "b-ro", false) == cryptMappingName("a", "b", true) {
+		t.Fatal("expected different mapping names for a/b-ro and read-only a/b")
+	}
+	if name := cryptMappingName("volumes", "myimage", true); name != "cepher-volumes:myimage:ro" {
+		t.Fatalf("unexpected mapping name %s", name)
+	}
+}
+
+func TestParseCryptTable(t *testing.T) {
+	table := "cepher-volumes:a: 0 2093056 crypt aes-xts-plain64 :64:logon:cryptsetup:1d6c-d0 0 43:0 4096\n" +
+		"cepher-volumes:b:ro: 0 2093056 crypt aes-xts-plain64 :64:logon:cryptsetup:2e7d-d0 0 43:32 4096 1 allow_discards\n" +
+		"luks-home: 0 1000 crypt aes-xts-plain64 :64:logon:cryptsetup:3f8e-d0 0 8:2 4096\n"
+	mappings := parseCryptTable(table)
+	if len(mappings) != 2 || mappings["43:0"] != "cepher-volumes:a" || mappings["43:32"] != "cepher-volumes:b:ro" {
+		t.Fatalf("unexpected mappings %v", mappings)
+	}
+}
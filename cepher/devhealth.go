@@ -0,0 +1,411 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// kinds of device health events
+const (
+	eventDeviceUnhealthy = "device-unhealthy"
+	eventDeviceRecovered = "device-recovered"
+)
+
+// sysBlockDir and procDir are where device and process state is read from
+var (
+	sysBlockDir = "/sys/block"
+	procDir     = "/proc"
+)
+
+// canaryRead reads the first block of device, bypassing the page cache, so that devices whose
+// I/O hangs or fails are detected before containers notice
+var canaryRead = func(device string, timeout time.Duration) error {
+	_, err := ExecShellTimeout(timeout, "dd", "if="+device, "of=/dev/null", "bs=4096", "count=1", "iflag=direct")
+	return err
+}
+
+// deviceHealthState is the result of the last health check of a mapped device
+type deviceHealthState struct {
+	Pool           string     `json:"pool"`
+	Name           string     `json:"name"`
+	Device         string     `json:"device"`
+	Mountpath      string     `json:"mountpath,omitempty"`
+	Healthy        bool       `json:"healthy"`
+	Reason         string     `json:"reason,omitempty"`
+	CheckedAt      time.Time  `json:"checkedAt"`
+	UnhealthySince *time.Time `json:"unhealthySince,omitempty"`
+	Recoveries     int        `json:"recoveries"`
+	RecoveryError  string     `json:"recoveryError,omitempty"`
+}
+
+// deviceHealth keeps the health of the mapped devices for volume status, metrics and events.
+// A nil deviceHealth keeps nothing
+type deviceHealth struct {
+	m                sync.Mutex
+	devices          map[string]*deviceHealthState
+	canaries         map[string]time.Time // device -> start of canary reads still in flight
+	checks           uint64
+	recoveries       uint64
+	recoveryFailures uint64
+	events           []reconcileFinding
+}
+
+func newDeviceHealth() *deviceHealth {
+	return &deviceHealth{devices: make(map[string]*deviceHealthState), canaries: make(map[string]time.Time)}
+}
+
+// watchDeviceHealth checks the mapped devices periodically
+func (d *cephRBDVolumeDriver) watchDeviceHealth(interval time.Duration) {
+	for d.sleepOrStop(interval) {
+		if err := d.checkDevices(); err != nil {
+			logrus.Warnf("error checking device health: %s", err)
+		}
+	}
+}
+
+// checkDevices checks that the devices mapped on the host are alive. Devices with a dead rbd-nbd
+// daemon aren't listed as mapped anymore, so the devices mapped by the plugin that are still
+// mounted are checked too. Unhealthy rbd-nbd devices are reattached when deviceRecovery is set.
+// d.m is not held while checking, as reads of unhealthy devices may hang
+func (d *cephRBDVolumeDriver) checkDevices() error {
+	mapped, err := d.listMappedDevices()
+	if err != nil {
+		return fmt.Errorf("error getting mapped devices: %s", err)
+	}
+	mounts, err := d.listMounts()
+	if err != nil {
+		return fmt.Errorf("error getting current mounts: %s", err)
+	}
+	cryptMappings, err := listCryptMappings()
+	if err != nil {
+		return fmt.Errorf("error getting dm-crypt mappings: %s", err)
+	}
+
+	devices := make(map[string]*deviceHealthState)
+	for _, v := range mapped {
+		devices[v.Device] = &deviceHealthState{Pool: v.Pool, Name: v.Name, Device: v.Device}
+	}
+	for device, t := range d.inventory.mappedDevices() {
+		if _, listed := devices[device]; !listed {
+			devices[device] = &deviceHealthState{Pool: t.Pool, Name: t.Name, Device: device}
+		}
+	}
+	for device, s := range devices {
+		s.Mountpath = d.deviceMountpath(s.Pool, s.Name, device, mounts, cryptMappings)
+		if s.Mountpath == "" && !d.isListed(mapped, device) {
+			// unmapped outside the plugin. Forgotten by the reconciler
+			delete(devices, device)
+		}
+	}
+
+	for _, s := range devices {
+		checkErr := d.checkDevice(s.Device)
+		if checkErr != nil && d.deviceRecovery && !d.useRBDKernelModule {
+			checkErr = d.recoverDevice(s, checkErr)
+		}
+		d.deviceHealth.update(s, checkErr)
+	}
+	d.deviceHealth.forget(devices)
+	return nil
+}
+
+func (d *cephRBDVolumeDriver) isListed(mapped []*Volume, device string) bool {
+	for _, v := range mapped {
+		if v.Device == device {
+			return true
+		}
+	}
+	return false
+}
+
+// deviceMountpath returns where device is mounted or exposed as a block device, if anywhere
+func (d *cephRBDVolumeDriver) deviceMountpath(pool, name, device string, mounts []*Volume, cryptMappings map[string]string) string {
+	mountDevice := device
+	if cryptName := cryptMappings[device]; cryptName != "" {
+		mountDevice = "/dev/mapper/" + cryptName
+	}
+	for _, m := range mounts {
+		if m.Device == mountDevice {
+			return m.Mountpath
+		}
+	}
+	if mountpath, found := d.findBlockMount(pool, name, mountDevice); found {
+		return mountpath
+	}
+	return ""
+}
+
+// checkDevice checks the connection behind device and reads from it
+func (d *cephRBDVolumeDriver) checkDevice(device string) error {
+	var err error
+	if d.useRBDKernelModule {
+		err = checkKernelDevice(device)
+	} else {
+		err = checkNbdConnection(device)
+	}
+	if err != nil {
+		return err
+	}
+	return d.deviceHealth.canary(device, d.deviceCanaryTimeout)
+}
+
+// checkNbdConnection checks that the nbd device is connected and its rbd-nbd daemon is running
+func checkNbdConnection(device string) error {
+	dev := filepath.Base(device)
+	pidBytes, err := ioutil.ReadFile(filepath.Join(sysBlockDir, dev, "pid"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("nbd device %s is disconnected", device)
+		}
+		return fmt.Errorf("error reading pid of nbd device %s: %s", device, err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(pidBytes)))
+	if err != nil {
+		return fmt.Errorf("invalid pid of nbd device %s: %s", device, err)
+	}
+	comm, err := ioutil.ReadFile(filepath.Join(procDir, strconv.Itoa(pid), "comm"))
+	if err != nil || !strings.HasPrefix(strings.TrimSpace(string(comm)), "rbd-nbd") {
+		return fmt.Errorf("rbd-nbd daemon (pid %d) of nbd device %s is gone", pid, device)
+	}
+	return nil
+}
+
+// checkKernelDevice checks that the kernel RBD device still exists
+func checkKernelDevice(device string) error {
+	if _, err := os.Stat(filepath.Join(sysBlockDir, filepath.Base(device))); err != nil {
+		return fmt.Errorf("kernel RBD device %s is gone: %s", device, err)
+	}
+	return nil
+}
+
+// recoverDevice reattaches an unhealthy rbd-nbd device to its image, so that the mount on it works
+// again. Returns nil if the device is healthy afterwards. The kernel RBD module reconnects by itself
+func (d *cephRBDVolumeDriver) recoverDevice(s *deviceHealthState, checkErr error) error {
+	if s.Mountpath == "" {
+		// nobody uses it. Unmapped by the reconciler
+		return checkErr
+	}
+	if err := d.health.checkAvailable(fmt.Sprintf("recovery of device %s", s.Device)); err != nil {
+		return fmt.Errorf("%s. %s", checkErr, err)
+	}
+	d.m.Lock()
+	defer d.m.Unlock()
+	if t, tracked := d.inventory.mappedDevices()[s.Device]; tracked && (t.Pool != s.Pool || t.Name != s.Name) {
+		return checkErr
+	}
+	if err := checkNbdConnection(s.Device); err == nil {
+		// reattached in the meantime, or only the canary read failed. The daemon is running, so
+		// there is nothing to reattach
+		return checkErr
+	}
+
+	mode := "--exclusive"
+	if strings.HasSuffix(s.Mountpath, ":ro") {
+		mode = "--read-only"
+	}
+	logrus.Warnf("Reattaching unhealthy device %s of RBD Image %s/%s: %s", s.Device, s.Pool, s.Name, checkErr)
+	_, err := ExecShellTimeout(mapShellTimeout, "rbd-nbd", "attach", "--device", s.Device, mode, s.Pool+"/"+s.Name)
+	d.deviceHealth.recordRecovery(s, err)
+	if err != nil {
+		return fmt.Errorf("%s. Reattach failed: %s", checkErr, err)
+	}
+	d.inventory.setMapped(s.Device, s.Pool, s.Name)
+	if err := d.checkDevice(s.Device); err != nil {
+		return fmt.Errorf("%s. Still unhealthy after reattach: %s", checkErr, err)
+	}
+	logrus.Infof("Device %s of RBD Image %s/%s reattached", s.Device, s.Pool, s.Name)
+	return nil
+}
+
+// canary runs a canary read of device. A read still in flight from a previous check means that
+// the device I/O hangs, so no other read is started
+func (h *deviceHealth) canary(device string, timeout time.Duration) error {
+	if h == nil {
+		return nil
+	}
+	h.m.Lock()
+	if started, inFlight := h.canaries[device]; inFlight {
+		h.m.Unlock()
+		return fmt.Errorf("canary read of %s hangs since %s", device, started.Format(time.RFC3339))
+	}
+	h.canaries[device] = time.Now()
+	h.m.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		err := canaryRead(device, timeout)
+		h.m.Lock()
+		delete(h.canaries, device)
+		h.m.Unlock()
+		done <- err
+	}()
+	// processes blocked on device I/O may not die when the read times out
+	select {
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("canary read of %s failed: %s", device, err)
+		}
+		return nil
+	case <-time.After(timeout + time.Second):
+		return fmt.Errorf("canary read of %s hangs for more than %s", device, timeout)
+	}
+}
+
+// update stores the result of a device check and emits an event when the device health changes
+func (h *deviceHealth) update(s *deviceHealthState, checkErr error) {
+	if h == nil {
+		return
+	}
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.checks++
+	now := time.Now()
+	prev, found := h.devices[s.Device]
+	if found && (prev.Pool != s.Pool || prev.Name != s.Name) {
+		found = false
+	}
+	state := *s
+	state.CheckedAt = now
+	state.Healthy = checkErr == nil
+	if found {
+		state.Recoveries = prev.Recoveries
+		state.RecoveryError = prev.RecoveryError
+		state.UnhealthySince = prev.UnhealthySince
+	}
+	event := reconcileFinding{Volume: s.Pool + "/" + s.Name, Device: s.Device, Path: s.Mountpath, Time: now}
+	if checkErr != nil {
+		state.Reason = checkErr.Error()
+		if state.UnhealthySince == nil {
+			state.UnhealthySince = &now
+			event.Kind = eventDeviceUnhealthy
+			event.Detail = state.Reason
+		}
+	} else if state.UnhealthySince != nil {
+		state.UnhealthySince = nil
+		state.RecoveryError = ""
+		event.Kind = eventDeviceRecovered
+		event.Detail = "device is healthy again"
+		event.Fixed = true
+	}
+	h.devices[s.Device] = &state
+	if event.Kind == "" {
+		return
+	}
+	fields := logrus.Fields{"event": "device-health", "kind": event.Kind, "volume": event.Volume, "device": event.Device, "path": event.Path}
+	if event.Kind == eventDeviceUnhealthy {
+		logrus.WithFields(fields).Errorf("Device %s of volume %s is unhealthy: %s", event.Device, event.Volume, event.Detail)
+	} else {
+		logrus.WithFields(fields).Infof("Device %s of volume %s is healthy again", event.Device, event.Volume)
+	}
+	h.events = append(h.events, event)
+	if len(h.events) > maxReconcileEvents {
+		h.events = h.events[len(h.events)-maxReconcileEvents:]
+	}
+}
+
+func (h *deviceHealth) recordRecovery(s *deviceHealthState, err error) {
+	if h == nil {
+		return
+	}
+	h.m.Lock()
+	defer h.m.Unlock()
+	state, found := h.devices[s.Device]
+	if !found {
+		state = &deviceHealthState{Pool: s.Pool, Name: s.Name, Device: s.Device}
+		h.devices[s.Device] = state
+	}
+	if err != nil {
+		h.recoveryFailures++
+		state.RecoveryError = err.Error()
+		return
+	}
+	h.recoveries++
+	state.Recoveries++
+	state.RecoveryError = ""
+}
+
+// forget drops the devices that are not mapped anymore
+func (h *deviceHealth) forget(devices map[string]*deviceHealthState) {
+	if h == nil {
+		return
+	}
+	h.m.Lock()
+	defer h.m.Unlock()
+	for device := range h.devices {
+		if _, found := devices[device]; !found {
+			delete(h.devices, device)
+		}
+	}
+}
+
+// volumeStates returns the health of the devices of an image
+func (h *deviceHealth) volumeStates(pool, name string) []deviceHealthState {
+	if h == nil {
+		return nil
+	}
+	h.m.Lock()
+	defer h.m.Unlock()
+	var states []deviceHealthState
+	for _, s := range h.devices {
+		if s.Pool == pool && s.Name == name {
+			states = append(states, *s)
+		}
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Device < states[j].Device })
+	return states
+}
+
+// recentEvents returns the recent device health changes, newest last
+func (h *deviceHealth) recentEvents() []reconcileFinding {
+	if h == nil {
+		return nil
+	}
+	h.m.Lock()
+	defer h.m.Unlock()
+	events := make([]reconcileFinding, len(h.events))
+	copy(events, h.events)
+	return events
+}
+
+// writeMetrics writes the device health metrics in the Prometheus text format
+func (h *deviceHealth) writeMetrics(w io.Writer) {
+	if h == nil {
+		return
+	}
+	h.m.Lock()
+	defer h.m.Unlock()
+	fmt.Fprintln(w, "# HELP cepher_device_checks_total Health checks of mapped devices")
+	fmt.Fprintln(w, "# TYPE cepher_device_checks_total counter")
+	fmt.Fprintf(w, "cepher_device_checks_total %d\n", h.checks)
+	fmt.Fprintln(w, "# HELP cepher_device_recoveries_total Unhealthy devices reattached")
+	fmt.Fprintln(w, "# TYPE cepher_device_recoveries_total counter")
+	fmt.Fprintf(w, "cepher_device_recoveries_total %d\n", h.recoveries)
+	fmt.Fprintln(w, "# HELP cepher_device_recovery_failures_total Failed reattaches of unhealthy devices")
+	fmt.Fprintln(w, "# TYPE cepher_device_recovery_failures_total counter")
+	fmt.Fprintf(w, "cepher_device_recovery_failures_total %d\n", h.recoveryFailures)
+	fmt.Fprintln(w, "# HELP cepher_device_healthy Whether the last health check of a mapped device succeeded")
+	fmt.Fprintln(w, "# TYPE cepher_device_healthy gauge")
+	devices := make([]string, 0, len(h.devices))
+	for device := range h.devices {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+	for _, device := range devices {
+		s := h.devices[device]
+		healthy := 0
+		if s.Healthy {
+			healthy = 1
+		}
+		fmt.Fprintf(w, "cepher_device_healthy{device=%q,volume=%q} %d\n", device, s.Pool+"/"+s.Name, healthy)
+	}
+}
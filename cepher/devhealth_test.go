@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckNbdConnection(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cepher-devhealth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(sys, proc string) { sysBlockDir, procDir = sys, proc }(sysBlockDir, procDir)
+	sysBlockDir = filepath.Join(dir, "sys")
+	procDir = filepath.Join(dir, "proc")
+	for _, p := range []string{filepath.Join(sysBlockDir, "nbd0"), filepath.Join(sysBlockDir, "nbd1"), filepath.Join(sysBlockDir, "nbd2"), filepath.Join(procDir, "100"), filepath.Join(procDir, "200")} {
+		if err := os.MkdirAll(p, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files := map[string]string{
+		filepath.Join(sysBlockDir, "nbd0", "pid"): "100\n",
+		filepath.Join(procDir, "100", "comm"):     "rbd-nbd\n",
+		filepath.Join(sysBlockDir, "nbd1", "pid"): "200\n",
+		filepath.Join(procDir, "200", "comm"):     "bash\n",
+	}
+	for p, content := range files {
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := checkNbdConnection("/dev/nbd0"); err != nil {
+		t.Fatalf("expected /dev/nbd0 to be healthy: %s", err)
+	}
+	if err := checkNbdConnection("/dev/nbd1"); err == nil || !strings.Contains(err.Error(), "is gone") {
+		t.Fatalf("expected dead daemon for /dev/nbd1 but got %v", err)
+	}
+	if err := checkNbdConnection("/dev/nbd2"); err == nil || !strings.Contains(err.Error(), "disconnected") {
+		t.Fatalf("expected /dev/nbd2 to be disconnected but got %v", err)
+	}
+}
+
+func TestDeviceHealthCanaryHang(t *testing.T) {
+	defer func(read func(string, time.Duration) error) { canaryRead = read }(canaryRead)
+	release := make(chan struct{})
+	canaryRead = func(device string, timeout time.Duration) error {
+		<-release
+		return nil
+	}
+
+	h := newDeviceHealth()
+	if err := h.canary("/dev/nbd0", 10*time.Millisecond); err == nil || !strings.Contains(err.Error(), "more than") {
+		t.Fatalf("expected hung canary read but got %v", err)
+	}
+	if err := h.canary("/dev/nbd0", 10*time.Millisecond); err == nil || !strings.Contains(err.Error(), "hangs since") {
+		t.Fatalf("expected canary read in flight but got %v", err)
+	}
+	close(release)
+	for i := 0; i < 100; i++ {
+		h.m.Lock()
+		_, inFlight := h.canaries["/dev/nbd0"]
+		h.m.Unlock()
+		if !inFlight {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := h.canary("/dev/nbd0", time.Second); err != nil {
+		t.Fatalf("expected canary read to succeed after the device recovered: %s", err)
+	}
+}
+
+func TestDeviceHealthUpdate(t *testing.T) {
+	h := newDeviceHealth()
+	s := &deviceHealthState{Pool: "volumes", Name: "a", Device: "/dev/nbd0", Mountpath: "/mnt/cepher/volumes/a:rw"}
+	h.update(s, nil)
+	h.update(s, errors.New("nbd device /dev/nbd0 is disconnected"))
+	h.update(s, errors.New("nbd device /dev/nbd0 is disconnected"))
+	h.recordRecovery(s, errors.New("attach failed"))
+
+	states := h.volumeStates("volumes", "a")
+	if len(states) != 1 || states[0].Healthy || states[0].UnhealthySince == nil || states[0].RecoveryError != "attach failed" {
+		t.Fatalf("expected unhealthy device but got %+v", states)
+	}
+	h.recordRecovery(s, nil)
+	h.update(s, nil)
+	states = h.volumeStates("volumes", "a")
+	if len(states) != 1 || !states[0].Healthy || states[0].UnhealthySince != nil || states[0].Recoveries != 1 {
+		t.Fatalf("expected recovered device but got %+v", states)
+	}
+
+	events := h.recentEvents()
+	if len(events) != 2 || events[0].Kind != eventDeviceUnhealthy || events[1].Kind != eventDeviceRecovered {
+		t.Fatalf("expected unhealthy and recovered events but got %+v", events)
+	}
+
+	var buf bytes.Buffer
+	h.writeMetrics(&buf)
+	for _, expected := range []string{
+		"cepher_device_checks_total 4\n",
+		"cepher_device_recoveries_total 1\n",
+		"cepher_device_recovery_failures_total 1\n",
+		`cepher_device_healthy{device="/dev/nbd0",volume="volumes/a"} 1` + "\n",
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Fatalf("expected %q in metrics:\n%s", expected, buf.String())
+		}
+	}
+
+	h.forget(map[string]*deviceHealthState{})
+	if len(h.volumeStates("volumes", "a")) != 0 {
+		t.Fatal("expected unmapped device to be forgotten")
+	}
+
+	var nilHealth *deviceHealth
+	nilHealth.update(s, nil)
+	if err := nilHealth.canary("/dev/nbd0", time.Second); err != nil || nilHealth.volumeStates("volumes", "a") != nil {
+		t.Fatal("expected nil device health to keep nothing")
+	}
+}
@@ -27,10 +27,10 @@ package main
  */
 
 import (
-	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -40,10 +40,7 @@ import (
 	"sync"
 	"time"
 
-	"github.com/coreos/etcd/clientv3"
-	"github.com/coreos/etcd/clientv3/concurrency"
 	"github.com/docker/go-plugins-helpers/volume"
-	"github.com/flaviostutz/etcd-lock/etcdlock"
 	"github.com/sirupsen/logrus"
 )
 
@@ -51,6 +48,7 @@ var (
 	rbdUnmapBusyRegexp         = regexp.MustCompile(`^exit status 16$`)
 	spaceDelimitedFieldsRegexp = regexp.MustCompile(`([^\s]+)`)
 	imageNameRegexp            = regexp.MustCompile(`^(([-_.[:alnum:]]+)/)?([-_.[:alnum:]]+)(#(ro))?$`)
+	trashImageNameRegexp       = regexp.MustCompile(`^trash_[0-9]{1,3}_`)
 )
 
 // Volume is our local struct to store info about RBD Image
@@ -59,20 +57,24 @@ type Volume struct {
 	Name      string // RBD Image name
 	Device    string // local host kernel device (e.g. /dev/rbd1)
 	Mountpath string
+	CryptName string // dm-crypt mapping of encrypted volumes (e.g. cepher-volumes:myvol)
+	Block     bool   // block mode volume, exposed as a device node in Mountpath instead of mounted
 }
 
 type imageInfo struct {
-	Name            string   `json:"name"`
-	Size            uint64   `json:"size"`
-	Objects         uint64   `json:"objects"`
-	ObjectSize      uint64   `json:"object_size"`
-	Order           int      `json:"order"`
-	BlockNamePrefix string   `json:"block_name_prefix"`
-	Format          uint64   `json:"format"`
-	Features        []string `json:"features"`
-	Flags           []string `json:"flags"`
-	CreateTimestamp string   `json:"create_timestamp"`
-	Journal         string   `json:"journal"`
+	Name            string       `json:"name"`
+	Size            uint64       `json:"size"`
+	Objects         uint64       `json:"objects"`
+	ObjectSize      uint64       `json:"object_size"`
+	Order           int          `json:"order"`
+	BlockNamePrefix string       `json:"block_name_prefix"`
+	Format          uint64       `json:"format"`
+	Features        []string     `json:"features"`
+	Flags           []string     `json:"flags"`
+	CreateTimestamp string       `json:"create_timestamp"`
+	Journal         string       `json:"journal"`
+	DataPool        string       `json:"data_pool"`
+	Parent          *imageParent `json:"parent"`
 }
 
 // our driver type for impl func
@@ -80,21 +82,93 @@ type cephRBDVolumeDriver struct {
 	cephCluster          string
 	cephUser             string
 	defaultCephPool      string
+	createDefaultPool    bool
+	defaultPoolQuota     string
+	poolPrepareTimeout   time.Duration
+	poolDefaults         poolOptions
 	rootMountDir         string
 	cephConfigFile       string
+	cephConfigSrcFile    string
+	cephConfigBase64     string
+	cephKeyringFile      string
+	cephKeyringSrcFile   string
+	cephKeyringBase64    string
+	cephMonitors         string
+	cephAuth             string
 	canCreateVolumes     bool
 	canCreatePools       bool
 	defaultImageSizeMB   int
 	defaultImageFSType   string
 	defaultImageFeatures string
+	defaultDataPool      string
+	defaultDataPoolEC    string
 	defaultRemoveAction  string
 	defaultPoolPgNum     string
 	useRBDKernelModule   bool
+	lockBackend          string
 	lockEtcdServers      string
+	lockEtcdCertFile     string
+	lockEtcdKeyFile      string
+	lockEtcdCAFile       string
+	lockEtcdUsername     string
+	lockEtcdPassword     string
+	lockEtcdPrefix       string
+	lockEtcdDialTimeout  time.Duration
+	lockConsulServers    string
+	lockFileDir          string
 	lockTimeoutMillis    uint64
+	lockWait             string
+	lockHandoff          bool
+	cryptKeyProvider     string
+	cryptKeyFile         string
+	cryptKeyURL          string
+	cryptKeyToken        string
+	listLabels           string
+	listPoolNames        string
+	listWorkers          int
+	listCacheTTL         time.Duration
+	imageListCache       *imageListCache
+	inventoryFile        string
+	inventory            *inventory
+	cephReadTimeout      time.Duration
+	healthCheckInterval  time.Duration
+	breakerThreshold     int
+	breakerCooldown      time.Duration
+	health               *clusterHealth
+	reconcileInterval    time.Duration
+	orphanGracePeriod    time.Duration
+	reconcileFix         string
+	reconcileFixKinds    map[string]bool
+	reconcileReport      *reconcileReport
+	dockerSocket         string
+	metricsAddr          string
+	deviceHealthInterval time.Duration
+	deviceCanaryTimeout  time.Duration
+	deviceRecovery       bool
+	deviceHealth         *deviceHealth
+	shutdownTimeout      time.Duration
+	shutdownLocks        string
+	stopping             chan struct{}
+	operations           *operationTracker
+	lockSession          *lockSession
+	maxImageSize         string
+	maxVolumes           string
+	maxProvisioned       string
+	overcommitRatio      string
+	poolLimitsSpec       string
+	defaultPoolLimits    poolLimits
+	poolLimits           map[string]poolLimits
+	warmPoolSpec         string
+	warmPoolInterval     time.Duration
+	warmProfiles         []warmProfile
+	nodeID               string
+	hostname             string
+	hostAddresses        []string
 	m                    *sync.Mutex
-	etcdLockSession      *concurrency.Session
-	volumeMountLocks     map[string]map[string]*etcdlock.RWMutex
+	locks                lockProvider
+	keys                 keyProvider
+	volumeMountLocks     map[string]map[string]volumeLock
+	releaseRequests      map[string][]lockHolder
 }
 
 func (d *cephRBDVolumeDriver) init() error {
@@ -102,42 +176,123 @@ func (d *cephRBDVolumeDriver) init() error {
 		logrus.Warn("The driver is configured to use the RBD Kernel Module. It has better performance but currently supports only image features layering, stripping and exclusive-lock")
 	}
 
-	//TODO reconstruct locks from real kernel mapped devices on driver restart
-	if d.lockEtcdServers != "" {
-		logrus.Debugf("Setting up ETCD client to %s", d.lockEtcdServers)
-		endpoints := strings.Split(d.lockEtcdServers, ",")
-		cli, err := clientv3.New(clientv3.Config{Endpoints: endpoints})
-		if err != nil {
-			return err
+	hostname, err := os.Hostname()
+	if err != nil {
+		logrus.Warnf("unable to get hostname: %s", err)
+		hostname = "HOST_UNKNOWN"
+	}
+	d.hostname = hostname
+	if d.nodeID == "" {
+		d.nodeID = hostname
+		if machineID, err := ioutil.ReadFile("/etc/machine-id"); err == nil && strings.TrimSpace(string(machineID)) != "" {
+			d.nodeID = strings.TrimSpace(string(machineID))
 		}
-		logrus.Debugf("ETCD client initiated")
+	}
+	d.hostAddresses = hostIPAddresses()
+	logrus.Debugf("hostname=%s nodeID=%s addresses=%v", d.hostname, d.nodeID, d.hostAddresses)
 
-		logrus.Debugf("Creating ETCD Lock Session")
-		d.etcdLockSession, err = concurrency.NewSession(cli, concurrency.WithTTL(int(d.lockTimeoutMillis/1000)))
-		if err != nil {
-			return err
-		}
-		logrus.Debugf("ETCD lock session ok %v", d.etcdLockSession)
-		d.volumeMountLocks = make(map[string]map[string]*etcdlock.RWMutex)
-
-		// starts routine to recover session when lease is orphaned, expires, or is otherwise no longer being refreshed.
-		go func() {
-			for {
-				<-d.etcdLockSession.Done()
-				logrus.Errorf("ETCD session channel was closed")
-				d.volumeMountLocks = make(map[string]map[string]*etcdlock.RWMutex)
-				for {
-					time.Sleep(time.Second * 10)
-					logrus.Debugf("recreating ETCD session")
-					if d.etcdLockSession, err = concurrency.NewSession(cli, concurrency.WithTTL(int(d.lockTimeoutMillis/1000))); err != nil {
-						logrus.Debugf("error recreating ETCD session: %s", err.Error())
-						continue
-					}
-					logrus.Debugf("ETCD session recreated %v", d.etcdLockSession)
-					break
-				}
-			}
-		}()
+	inv, err := loadInventory(d.inventoryFile)
+	if err != nil {
+		logrus.Warnf("Unable to load volume inventory. Starting a new one: %s", err)
+		inv = &inventory{file: d.inventoryFile, Volumes: make(map[string]*inventoryVolume), Mounts: make(map[string]*Volume)}
+	}
+	d.inventory = inv
+
+	if d.lockWait == "" {
+		d.lockWait = defaultLockWait
+	}
+	if _, err := parseLockWait(d.lockWait); err != nil {
+		return err
+	}
+
+	if err := d.parseCapacityLimits(); err != nil {
+		return err
+	}
+
+	warmProfiles, err := d.parseWarmProfiles(d.warmPoolSpec)
+	if err != nil {
+		return err
+	}
+	d.warmProfiles = warmProfiles
+
+	fixKinds, err := parseReconcileFix(d.reconcileFix)
+	if err != nil {
+		return err
+	}
+	d.reconcileFixKinds = fixKinds
+	d.reconcileReport = newReconcileReport()
+	d.deviceHealth = newDeviceHealth()
+
+	if d.shutdownLocks == "" {
+		d.shutdownLocks = shutdownKeepLocks
+	}
+	if err := validateShutdownLocks(d.shutdownLocks); err != nil {
+		return err
+	}
+	d.stopping = make(chan struct{})
+	d.operations = &operationTracker{}
+	d.lockSession = newLockSession()
+
+	if d.poolDefaults.pgNum == "" {
+		d.poolDefaults.pgNum = d.defaultPoolPgNum
+	}
+	if err := d.poolDefaults.validate(); err != nil {
+		return err
+	}
+
+	// the providers come before any Ceph step, so that the plugin never serves without the
+	// distributed mount locks when the cluster can't be prepared
+	keys, err := d.newKeyProvider()
+	if err != nil {
+		return err
+	}
+	d.keys = keys
+
+	//TODO reconstruct locks from real kernel mapped devices on driver restart
+	d.volumeMountLocks = make(map[string]map[string]volumeLock)
+	d.releaseRequests = make(map[string][]lockHolder)
+	locks, err := d.newLockProvider(func() {
+		d.lockSession.markLost()
+		// the new session is only created after this returns, so no lock of it is forgotten here
+		d.m.Lock()
+		defer d.m.Unlock()
+		d.volumeMountLocks = make(map[string]map[string]volumeLock)
+	})
+	if err != nil {
+		return err
+	}
+	d.locks = locks
+
+	if err := d.provisionCephConfig(); err != nil {
+		return err
+	}
+	d.watchCephConfig()
+
+	d.health = newClusterHealth(d.breakerThreshold, d.breakerCooldown)
+	if d.healthCheckInterval > 0 {
+		interval := d.healthCheckInterval
+		d.goBackground(func() { d.watchClusterHealth(interval) })
+	}
+
+	if err := d.prepareDefaultPool(); err != nil {
+		return err
+	}
+
+	if d.locks != nil && d.lockHandoff {
+		d.goBackground(d.watchReleaseRequests)
+	}
+	d.goBackground(d.recoverInterruptedCreates)
+	if d.reconcileInterval > 0 {
+		d.goBackground(func() { d.watchReconcile(d.reconcileInterval) })
+	}
+	if d.deviceHealthInterval > 0 {
+		d.goBackground(func() { d.watchDeviceHealth(d.deviceHealthInterval) })
+	}
+	if d.metricsAddr != "" {
+		go d.serveMetrics(d.metricsAddr)
+	}
+	if len(d.warmProfiles) > 0 && d.canCreateVolumes && d.warmPoolInterval > 0 {
+		d.goBackground(func() { d.refillWarmPool(d.warmPoolInterval) })
 	}
 
 	logrus.Debugf("Driver initialized")
@@ -187,6 +342,10 @@ func (d *cephRBDVolumeDriver) Capabilities() *volume.CapabilitiesResponse {
 //    Respond with a string error if an error occurred.
 //
 func (d *cephRBDVolumeDriver) Create(r *volume.CreateRequest) error {
+	if err := d.startRequest("create"); err != nil {
+		return err
+	}
+	defer d.operations.done()
 	d.m.Lock()
 	defer d.m.Unlock()
 	logrus.Infof("")
@@ -204,6 +363,11 @@ func (d *cephRBDVolumeDriver) CreateInternal(r *volume.CreateRequest) error {
 		return errors.New(err)
 	}
 
+	if err := d.health.checkWritable(fmt.Sprintf("create of %s/%s", pool, name)); err != nil {
+		logrus.Error(err)
+		return err
+	}
+
 	mutex, err := d.lockCreateVolume(pool, name)
 	if err != nil {
 		logrus.Errorf("error locking volume %s for create: %s", r.Name, err.Error())
@@ -215,6 +379,12 @@ func (d *cephRBDVolumeDriver) CreateInternal(r *volume.CreateRequest) error {
 		}
 	}()
 
+	createOptions, labels, err := splitCreateOptions(r.Options)
+	if err != nil {
+		logrus.Error(err)
+		return err
+	}
+
 	fstype := d.defaultImageFSType
 	imageFeatures := d.defaultImageFeatures
 
@@ -242,6 +412,75 @@ func (d *cephRBDVolumeDriver) CreateInternal(r *volume.CreateRequest) error {
 	if r.Options["features"] != "" {
 		imageFeatures = r.Options["features"]
 	}
+	dataPool := d.defaultDataPool
+	if r.Options["data-pool"] != "" {
+		dataPool = r.Options["data-pool"]
+	}
+	if dataPool == pool {
+		dataPool = ""
+	}
+	// they end up in ceph and rbd command lines
+	for _, option := range []string{"pool", "name", "data-pool", "data-pool-erasure-profile"} {
+		if value := r.Options[option]; value != "" && !cephNameRegexp.MatchString(value) {
+			err := fmt.Sprintf("invalid %s '%s'. Use letters, numbers, '-', '_' and '.'", option, value)
+			logrus.Error(err)
+			return errors.New(err)
+		}
+	}
+	lockWait := r.Options["lock-wait"]
+	if lockWait != "" {
+		if _, err := parseLockWait(lockWait); err != nil {
+			logrus.Error(err)
+			return err
+		}
+	}
+
+	encrypted := false
+	if r.Options["encrypted"] != "" {
+		encrypted, err = strconv.ParseBool(r.Options["encrypted"])
+		if err != nil {
+			err := fmt.Sprintf("invalid encrypted option '%s'. Must be true or false", r.Options["encrypted"])
+			logrus.Error(err)
+			return errors.New(err)
+		}
+	}
+	lazyFormat, err := parseFormatOption(r.Options["format"])
+	if err != nil {
+		logrus.Error(err)
+		return err
+	}
+	block, err := parseModeOption(r.Options["mode"])
+	if err != nil {
+		logrus.Error(err)
+		return err
+	}
+	if block {
+		if lazyFormat {
+			err := "format=on-first-mount can't be used with mode=block. Block mode volumes have no filesystem"
+			logrus.Error(err)
+			return errors.New(err)
+		}
+		// no filesystem is created
+		fstype = ""
+	}
+
+	if encrypted && d.keys == nil {
+		err := "encrypted volumes require a key provider. Set --crypt-key-provider"
+		logrus.Error(err)
+		return errors.New(err)
+	}
+
+	qosLimits, err := parseQoSOptions(r.Options)
+	if err != nil {
+		logrus.Error(err)
+		return err
+	}
+
+	poolOpts, err := d.poolDefaults.withCreateOptions(r.Options)
+	if err != nil {
+		logrus.Error(err)
+		return err
+	}
 
 	// verify if pool exists
 	poolExists, err := poolExists(pool)
@@ -251,31 +490,98 @@ func (d *cephRBDVolumeDriver) CreateInternal(r *volume.CreateRequest) error {
 		return errors.New(err)
 	}
 	if !poolExists {
-		err := d.createPool(pool)
+		err := d.createPool(pool, poolOpts)
 		if err != nil {
 			return err
 		}
+	} else if hasPoolCreateOptions(r.Options) {
+		logrus.Infof("Pool %s already exists. Ignoring pool-* options", pool)
 	}
 
 	logrus.Debug("verify if image already exists on RBD cluster")
 	exists, err := d.rbdImageExists(pool, name)
+	if err == nil && !exists && dataPool != "" {
+		err = d.prepareDataPool(dataPool, r.Options)
+		if err != nil {
+			return err
+		}
+	}
 	if err != nil {
 		err := fmt.Sprintf("error while checking RBD Image %s/%s: %s", pool, name, err)
 		logrus.Errorf("%s", err)
 		return errors.New(err)
 	}
+	if exists {
+		initializing, since, err := d.isInitializing(pool, name)
+		if err != nil {
+			err := fmt.Sprintf("error checking state of RBD Image %s/%s: %s", pool, name, err)
+			logrus.Error(err)
+			return errors.New(err)
+		}
+		if initializing {
+			if err := d.checkRollbackInitializing(pool, name, since); err != nil {
+				logrus.Error(err)
+				return err
+			}
+			logrus.Warnf("RBD Image %s/%s was left behind by a failed or interrupted create. Creating it again", pool, name)
+			if err := d.rollbackCreate(pool, name); err != nil {
+				logrus.Error(err)
+				return err
+			}
+			exists = false
+			if dataPool != "" {
+				if err := d.prepareDataPool(dataPool, r.Options); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	created := false
+	completed := false
+	defer func() {
+		if created && !completed {
+			if err := d.rollbackCreate(pool, name); err != nil {
+				logrus.Errorf("%s", err)
+			}
+		}
+	}()
 	if !exists {
 		logrus.Debugf("Ceph Image doesn't exist yet")
 		if d.canCreateVolumes {
-			logrus.Debugf("create image on RBD Cluster")
-			err = d.createRBDImage(pool, name, size, fstype, imageFeatures)
-			if err != nil {
-				errString := fmt.Sprintf("Unable to create RBD Image %s/%s: %s", pool, name, err)
-				logrus.Errorf(errString)
-				return errors.New(errString)
-			} else {
-				logrus.Infof("New RBD Image %s/%s created successfully", pool, name)
+			// encrypted images have their own key, so they can't be taken from the warm pool
+			claimed := false
+			if !encrypted {
+				// warm images are already provisioned, but still count against the volume limits
+				err = d.checkCapacity(pool, dataPool, size, true)
+				if err != nil {
+					errString := fmt.Sprintf("Unable to create RBD Image %s/%s: %s", pool, name, err)
+					logrus.Errorf(errString)
+					return errors.New(errString)
+				}
+				claimed, err = d.claimWarmImage(pool, name, size, fstype, imageFeatures, dataPool)
+				if err != nil {
+					logrus.Warnf("Unable to claim warm image for %s/%s. Creating it: %s", pool, name, err)
+				}
 			}
+			if !claimed {
+				err = d.checkCapacity(pool, dataPool, size, false)
+				if err != nil {
+					errString := fmt.Sprintf("Unable to create RBD Image %s/%s: %s", pool, name, err)
+					logrus.Errorf(errString)
+					return errors.New(errString)
+				}
+				logrus.Debugf("create image on RBD Cluster")
+				err = d.createRBDImage(pool, name, size, fstype, imageFeatures, dataPool, encrypted, lazyFormat)
+				if err != nil {
+					errString := fmt.Sprintf("Unable to create RBD Image %s/%s: %s", pool, name, err)
+					logrus.Errorf(errString)
+					return errors.New(errString)
+				} else {
+					logrus.Infof("New RBD Image %s/%s created successfully", pool, name)
+				}
+			}
+			created = true
+			d.imageListCache.invalidate()
 		} else {
 			errString := fmt.Sprintf("RBD Image %s/%s not found and the plugin is not enabled for automatic image creation", pool, name)
 			logrus.Warnf(errString)
@@ -283,8 +589,72 @@ func (d *cephRBDVolumeDriver) CreateInternal(r *volume.CreateRequest) error {
 		}
 	} else {
 		logrus.Infof("Image %s/%s already exists in RBD cluster. Reusing it.", pool, name)
+		if r.Options["data-pool"] != "" {
+			logrus.Warnf("The data pool of existing images can't be changed. Ignoring data-pool option for %s/%s", pool, name)
+		}
+		if encrypted {
+			encryption, err := d.getImageMeta(pool, name, encryptionImageMetaKey)
+			if err != nil {
+				err := fmt.Sprintf("error checking encryption of RBD Image %s/%s: %s", pool, name, err)
+				logrus.Error(err)
+				return errors.New(err)
+			}
+			if encryption == "" {
+				err := fmt.Sprintf("RBD Image %s/%s already exists and is not encrypted. Existing images can't be encrypted", pool, name)
+				logrus.Error(err)
+				return errors.New(err)
+			}
+		}
 	}
 
+	// QoS limits are applied on new and existing images, so that they can be changed by creating the volume again
+	if err := d.applyQoS(pool, name, qosLimits); err != nil {
+		logrus.Error(err)
+		return err
+	}
+
+	// keep the effective options with the image for mounts on other hosts. Options that
+	// only apply to new images are not changed for existing ones
+	meta := volumeMetadata{Options: make(map[string]string), Labels: labels}
+	for k, v := range createOptions {
+		if !exists || isUpdatableOption(k) {
+			meta.Options[k] = v
+		}
+	}
+	delete(meta.Options, "pool")
+	delete(meta.Options, "name")
+	if !exists {
+		meta.Options["size"] = strconv.Itoa(size)
+		if fstype != "" {
+			meta.Options["fstype"] = fstype
+		}
+		meta.Options["features"] = imageFeatures
+		if dataPool != "" {
+			meta.Options["data-pool"] = dataPool
+		}
+	}
+	if err := d.storeVolumeMetadata(pool, name, meta); err != nil {
+		logrus.Error(err)
+		return err
+	}
+
+	if lockWait != "" {
+		logrus.Debugf("Setting mount lock wait for %s/%s to %s", pool, name, lockWait)
+		if err := d.setImageMeta(pool, name, lockWaitImageMetaKey, lockWait); err != nil {
+			err := fmt.Sprintf("error storing lock-wait option on RBD Image %s/%s: %s", pool, name, err)
+			logrus.Error(err)
+			return errors.New(err)
+		}
+	}
+
+	if created {
+		if err := d.finishCreate(pool, name); err != nil {
+			logrus.Error(err)
+			return err
+		}
+	}
+	completed = true
+
 	// _, err1 := d.MountInternal(&volume.MountRequest{Name: fmt.Sprintf("%s/%s", pool, name)})
 	// if err1 != nil {
 	// 	errString := fmt.Sprintf("Error mounting image %s/%s: %s", pool, name, err1)
@@ -306,11 +676,19 @@ func (d *cephRBDVolumeDriver) CreateInternal(r *volume.CreateRequest) error {
 //    Respond with a string error if an error occurred.
 //
 func (d *cephRBDVolumeDriver) Remove(r *volume.RemoveRequest) error {
+	if err := d.startRequest("remove"); err != nil {
+		return err
+	}
+	defer d.operations.done()
 	d.m.Lock()
 	defer d.m.Unlock()
 	logrus.Infof("")
 	logrus.Infof(">>> DOCKER API REMOVE(%q)", r)
-	return d.RemoveInternal(r)
+	if err := d.RemoveInternal(r); err != nil {
+		return err
+	}
+	d.inventory.removeVolume(r.Name)
+	return nil
 }
 
 func (d *cephRBDVolumeDriver) RemoveInternal(r *volume.RemoveRequest) error {
@@ -324,6 +702,12 @@ func (d *cephRBDVolumeDriver) RemoveInternal(r *volume.RemoveRequest) error {
 		return errors.New(err)
 	}
 
+	// removals are allowed on unhealthy or full clusters, as they may free space
+	if err := d.health.checkAvailable(fmt.Sprintf("remove of %s/%s", pool, name)); err != nil {
+		logrus.Error(err)
+		return err
+	}
+
 	logrus.Debugf("verify if RBD Image exists in cluster")
 	exists, err := d.rbdImageExists(pool, name)
 	if err != nil {
@@ -348,8 +732,16 @@ func (d *cephRBDVolumeDriver) RemoveInternal(r *volume.RemoveRequest) error {
 	// }
 
 	// remove action can be: ignore, delete or rename
+	defer d.imageListCache.invalidate()
 	if d.defaultRemoveAction == "delete" {
 		logrus.Debugf("Deleting RBD Image %s/%s from Ceph Cluster", pool, name)
+		// the key ID is kept in the image metadata. Read it before the image is gone
+		keyID, err := d.getImageMeta(pool, name, cryptKeyIDImageMetaKey)
+		if err != nil {
+			errString := fmt.Sprintf("Unable to get key ID of RBD Image %s/%s: %s", pool, name, err)
+			logrus.Errorf(errString)
+			return errors.New(errString)
+		}
 		err = d.removeRBDImage(pool, name)
 		if err != nil {
 			errString := fmt.Sprintf("Unable to remove RBD Image %s/%s: %s", pool, name, err)
@@ -357,6 +749,11 @@ func (d *cephRBDVolumeDriver) RemoveInternal(r *volume.RemoveRequest) error {
 			// defer d.unlockImage(pool, name, locker)
 			return errors.New(errString)
 		}
+		if keyID != "" && d.keys != nil {
+			if err := d.keys.DeleteKey(keyID); err != nil {
+				logrus.Warnf("RBD Image %s/%s was deleted but its encryption key %s couldn't be deleted: %s", pool, name, keyID, err)
+			}
+		}
 
 		// defer d.unlockImage(pool, name, locker)
 	} else if d.defaultRemoveAction == "rename" {
@@ -415,8 +812,10 @@ func (d *cephRBDVolumeDriver) RemoveInternal(r *volume.RemoveRequest) error {
 //
 // TODO: utilize the new MountRequest.ID field to track volumes
 func (d *cephRBDVolumeDriver) Mount(r *volume.MountRequest) (*volume.MountResponse, error) {
-	d.m.Lock()
-	defer d.m.Unlock()
+	if err := d.startRequest("mount"); err != nil {
+		return nil, err
+	}
+	defer d.operations.done()
 	logrus.Infof("")
 	logrus.Infof(">>> DOCKER API MOUNT(%q)", r)
 	return d.MountInternal(r)
@@ -433,13 +832,31 @@ func (d *cephRBDVolumeDriver) MountInternal(r *volume.MountRequest) (mr *volume.
 		return nil, errors.New(err)
 	}
 
-	// try to get lock for the volume
-	if err := d.lockMountVolume(pool, name, readonly, r.ID); err != nil {
+	if err := d.health.checkAvailable(fmt.Sprintf("mount of %s/%s", pool, name)); err != nil {
+		logrus.Error(err)
+		return nil, err
+	}
+
+	// try to get lock for the volume. The driver mutex is not held while waiting for
+	// it, so that other requests (like the unmount that will release it) can be served
+	mutex, err := d.lockMountVolume(pool, name, readonly, r.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	d.m.Lock()
+	defer d.m.Unlock()
+	if err := d.registerMountLock(pool, name, r.ID, mutex); err != nil {
+		if uerr := mutex.Unlock(); uerr != nil {
+			logrus.Errorf("error unlocking volume %s/%s caller ID %s: %s", pool, name, r.ID, uerr)
+		}
 		return nil, err
 	}
 	defer func() { //Use named return values to perform unlock if error occurred
 		if err != nil {
-			err = d.unlockMountVolume(pool, name, r.ID)
+			if uerr := d.unlockMountVolume(pool, name, r.ID); uerr != nil {
+				logrus.Errorf("error unlocking volume %s/%s caller ID %s after mount failure: %s", pool, name, r.ID, uerr)
+			}
 		}
 	}()
 
@@ -457,9 +874,31 @@ func (d *cephRBDVolumeDriver) MountInternal(r *volume.MountRequest) (mr *volume.
 	} else { //volume not mounted yet. mount!
 		logrus.Infof("Mountpoint %s doesn't exist yet. Creating it. pool=%s image=%s", mountpath, pool, name)
 
+		key, err := d.volumeKey(pool, name)
+		if err != nil {
+			logrus.Errorf("error getting key of RBD Image %s/%s: %s", pool, name, err)
+			return nil, fmt.Errorf("Unable to get volume encryption key. err=%s", err)
+		}
+
+		// options from the volume creation, which may have happened on another host
+		meta, err := d.loadVolumeMetadata(pool, name)
+		if err != nil {
+			logrus.Warnf("unable to load stored options of RBD Image %s/%s. Using defaults: %s", pool, name, err)
+		}
+		if initializing, _ := parseInitializingState(meta.State); initializing {
+			err := fmt.Sprintf("RBD Image %s/%s is still being created or its creation was interrupted. Create the volume again", pool, name)
+			logrus.Error(err)
+			return nil, errors.New(err)
+		}
+
+		if err := d.releaseStaleMappings(pool, name, volumes); err != nil {
+			logrus.Error(err)
+			return nil, err
+		}
+
 		// map
 		logrus.Debugf("mapping kernel device to RBD Image name=%v, readonly=%v", r.Name, readonly)
-		device, err := d.mapImageToDevice(pool, name, readonly)
+		rbdDevice, err := d.mapImageToDevice(pool, name, readonly)
 		if err != nil {
 			logrus.Errorf("error mapping RBD Image %s/%s to kernel device: %s", pool, name, err)
 			// failsafe: need to release lock
@@ -467,13 +906,52 @@ func (d *cephRBDVolumeDriver) MountInternal(r *volume.MountRequest) (mr *volume.
 			return nil, errors.New(fmt.Sprintf("Unable to map kernel device. err=%s", err))
 		}
 
+		// images created with format=on-first-mount get their filesystem now
+		if meta.FormatPending != "" {
+			if err := d.formatOnFirstMount(pool, name, rbdDevice, key, readonly); err != nil {
+				logrus.Error(err)
+				defer d.unmapImageDevice(rbdDevice)
+				return nil, err
+			}
+		}
+
+		// unlock encrypted images. The filesystem is on the dm-crypt device
+		device := rbdDevice
+		cryptName := ""
+		if key != nil {
+			cryptName = cryptMappingName(pool, name, readonly)
+			logrus.Debugf("opening LUKS device %s as %s", rbdDevice, cryptName)
+			device, err = luksOpen(rbdDevice, cryptName, key, readonly)
+			if err != nil {
+				logrus.Errorf("error opening LUKS device %s of RBD Image %s/%s: %s", rbdDevice, pool, name, err)
+				defer d.unmapImageDevice(rbdDevice)
+				return nil, fmt.Errorf("Unable to open encrypted device. err=%s", err)
+			}
+		}
+
+		// block mode volumes expose the device instead of mounting a filesystem
+		if meta.Options["mode"] == modeBlock {
+			node, err := exposeBlockDevice(device, mountpath, readonly)
+			if err != nil {
+				logrus.Errorf("error exposing device %s of RBD Image %s/%s: %s", device, pool, name, err)
+				defer d.releaseVolumeDevice(rbdDevice, cryptName)
+				return nil, fmt.Errorf("Unable to expose block device. err=%s", err)
+			}
+			logrus.Infof("Block device %s of RBD Image %s/%s exposed at %s", device, pool, name, node)
+			d.inventory.setMount(mountpath, &Volume{Pool: pool, Name: name, Device: rbdDevice, Mountpath: mountpath, CryptName: cryptName, Block: true})
+			return &volume.MountResponse{Mountpoint: mountpath}, nil
+		}
+
 		// determine device FS type
 		fstype, err := d.deviceType(device)
 		if err != nil {
 			// logrus.Warnf("unable to detect RBD Image %s/%s fstype: %s", name, err)
 			logrus.Warnf("unable to detect RBD Image %s fstype: %s", name, err)
-			// NOTE: don't fail - FOR NOW we will assume default plugin fstype
-			fstype = d.defaultImageFSType
+			// NOTE: don't fail - FOR NOW we will assume the fstype used on creation or the default plugin fstype
+			fstype = meta.Options["fstype"]
+			if fstype == "" {
+				fstype = d.defaultImageFSType
+			}
 		}
 
 		// double check image filesystem if possible
@@ -482,7 +960,7 @@ func (d *cephRBDVolumeDriver) MountInternal(r *volume.MountRequest) (mr *volume.
 			logrus.Errorf("Filesystem at RBD Image %s/%s may need repairs: %s", pool, name, err)
 			// failsafe: need to release lock and unmap kernel device
 			logrus.Debugf("unmapping device")
-			defer d.unmapImageDevice(device)
+			defer d.releaseVolumeDevice(rbdDevice, cryptName)
 			// defer d.unlockImage(pool, name, locker)
 			return nil, errors.New(fmt.Sprintf("Image filesystem has errors. Mount it in a separate machine and perform manual repairs. err=%s", err))
 		}
@@ -493,22 +971,23 @@ func (d *cephRBDVolumeDriver) MountInternal(r *volume.MountRequest) (mr *volume.
 			logrus.Errorf("error creating mount directory %s: %s", mountpath, err)
 			// failsafe: need to release lock and unmap kernel device
 			logrus.Debugf("unmapping device")
-			defer d.unmapImageDevice(device)
+			defer d.releaseVolumeDevice(rbdDevice, cryptName)
 			// defer d.unlockImage(pool, name, locker)
 			return nil, errors.New(fmt.Sprintf("Unable to create mountdir %s", mountpath))
 		}
 
 		// mount
 		logrus.Debugf("Mounting RBD Image %s/%s, mapped to device %s, to mountdir %s", pool, name, device, mountpath)
-		err = d.mountDeviceToPath(fstype, device, mountpath, readonly)
+		err = d.mountDeviceToPath(fstype, device, mountpath, readonly, meta.Options["mount-options"])
 		if err != nil {
 			logrus.Errorf("error mounting device %s to directory %s: %s", device, mountpath, err)
 			logrus.Debugf("unmapping device")
-			defer d.unmapImageDevice(device)
+			defer d.releaseVolumeDevice(rbdDevice, cryptName)
 			// defer d.unlockImage(pool, name, locker)
 			return nil, errors.New(fmt.Sprintf("Unable to mount device. err=%s", err))
 		} else {
 			logrus.Infof("Mount to %s successful", mountpath)
+			d.inventory.setMount(mountpath, &Volume{Pool: pool, Name: name, Device: rbdDevice, Mountpath: mountpath, CryptName: cryptName})
 		}
 
 	}
@@ -525,14 +1004,17 @@ func (d *cephRBDVolumeDriver) MountInternal(r *volume.MountRequest) (mr *volume.
 	return &volume.MountResponse{Mountpoint: mountpath}, nil
 }
 
-func (d *cephRBDVolumeDriver) lockCreateVolume(pool, name string) (*etcdlock.RWMutex, error) {
-	if d.etcdLockSession != nil {
+func (d *cephRBDVolumeDriver) lockCreateVolume(pool, name string) (volumeLock, error) {
+	if d.locks != nil {
 		volumeName := fmt.Sprintf("%s/%s", pool, name)
-		mutex := etcdlock.NewRWMutex(d.etcdLockSession, fmt.Sprintf("/cepher-create/%s", volumeName))
-		ctx, _ := context.WithTimeout(context.Background(), time.Duration(d.lockTimeoutMillis)*time.Millisecond)
+		key := lockKindPrefixes["create"] + volumeName
+		mutex := d.locks.NewLock(key, d.newLockHolder("", false))
+		wait, _ := parseLockWait(d.lockWait)
+		ctx, cancel := lockWaitContext(wait)
+		defer cancel()
 		if err := mutex.RWLock(ctx); err != nil { // using RWLock to allow only one lock at a time
-			logrus.Debugf("error getting write lock for create volume %s lease ID %x: %s", volumeName, d.etcdLockSession.Lease(), err.Error())
-			return nil, err
+			logrus.Debugf("error getting write lock for create volume %s lock owner %s: %s", volumeName, d.locks.ID(), err.Error())
+			return nil, fmt.Errorf("error getting create lock for volume %s: %s; %s", volumeName, err, d.describeLockHolders(key))
 		}
 		logrus.Debugf("got RWLock for create volume %s", name)
 		return mutex, nil
@@ -540,10 +1022,10 @@ func (d *cephRBDVolumeDriver) lockCreateVolume(pool, name string) (*etcdlock.RWM
 	return nil, nil
 }
 
-func (d *cephRBDVolumeDriver) unlockCreateVolume(mutex *etcdlock.RWMutex) error {
-	if d.etcdLockSession != nil {
+func (d *cephRBDVolumeDriver) unlockCreateVolume(mutex volumeLock) error {
+	if d.locks != nil {
 		if err := mutex.Unlock(); err != nil {
-			logrus.Errorf("error unlocking create volume with etcd lease ID %x: %s", d.etcdLockSession.Lease(), err.Error())
+			logrus.Errorf("error unlocking create volume with lock owner %s: %s", d.locks.ID(), err.Error())
 			return err
 		}
 		logrus.Debugf("released RWLock for create volume")
@@ -551,36 +1033,72 @@ func (d *cephRBDVolumeDriver) unlockCreateVolume(mutex *etcdlock.RWMutex) error
 	return nil
 }
 
-func (d *cephRBDVolumeDriver) lockMountVolume(pool, name string, readonly bool, callerID string) error {
-	if d.etcdLockSession != nil {
-		if callerID == "" {
-			return errors.New(fmt.Sprintf("error getting mount lock for volume %s/%s. callerID cannot be an empty string.", pool, name))
-		}
+// lockMountVolume acquires the mount lock for the volume, waiting according to the volume lock-wait setting.
+// If it has to wait and lock handoff is enabled, a release request is posted to the current holders while waiting
+func (d *cephRBDVolumeDriver) lockMountVolume(pool, name string, readonly bool, callerID string) (volumeLock, error) {
+	if d.locks == nil {
+		return nil, nil
+	}
+	if callerID == "" {
+		return nil, errors.New(fmt.Sprintf("error getting mount lock for volume %s/%s. callerID cannot be an empty string.", pool, name))
+	}
 
-		volumeName := fmt.Sprintf("%s/%s", pool, name)
-		mutex := etcdlock.NewRWMutex(d.etcdLockSession, fmt.Sprintf("/cepher-mount/%s", volumeName))
-		ctx, _ := context.WithTimeout(context.Background(), time.Duration(d.lockTimeoutMillis)*time.Millisecond)
-		if readonly {
-			if err := mutex.RLock(ctx); err != nil {
-				logrus.Debugf("error getting mount read lock for volume %s caller ID %s lease ID %x: %s", volumeName, callerID, d.etcdLockSession.Lease(), err.Error())
-				return err
-			}
-			logrus.Debugf("got RLock for mount %s", name)
-		} else {
-			if err := mutex.RWLock(ctx); err != nil {
-				logrus.Debugf("error getting mount write lock for volume %s caller ID %s lease ID %x: %s", volumeName, callerID, d.etcdLockSession.Lease(), err.Error())
-				return err
+	volumeName := fmt.Sprintf("%s/%s", pool, name)
+	key := d.mountLockKey(pool, name)
+	holder := d.newLockHolder(callerID, readonly)
+	mutex := d.locks.NewLock(key, holder)
+	lockMode := "write"
+	acquire := mutex.RWLock
+	if readonly {
+		lockMode = "read"
+		acquire = mutex.RLock
+	}
+	wait := d.volumeLockWait(pool, name)
+
+	// first attempt is always fail fast, so that we know when we are waiting for another holder
+	firstWait := failFastLockWait
+	if wait > 0 && wait < firstWait {
+		firstWait = wait
+	}
+	ctx, cancel := lockWaitContext(firstWait)
+	err := acquire(ctx)
+	cancel()
+	if err != nil && wait != firstWait {
+		if d.lockHandoff {
+			withdraw, rerr := d.locks.RequestRelease(key, holder)
+			if rerr != nil {
+				logrus.Warnf("error requesting release of mount lock for volume %s: %s", volumeName, rerr)
+			} else {
+				defer withdraw()
 			}
-			logrus.Debugf("got RWLock for mount %s", name)
 		}
-		//keep reference with callerID to unlock on unmount volume
+		logrus.Infof("Waiting for mount %s lock for volume %s (lock-wait=%v); %s", lockMode, volumeName, wait, d.describeLockHolders(key))
+		if wait > 0 {
+			wait = wait - firstWait
+		}
+		ctx, cancel := lockWaitContext(wait)
+		defer cancel()
+		err = acquire(ctx)
+	}
+	if err != nil {
+		logrus.Debugf("error getting mount %s lock for volume %s caller ID %s lock owner %s: %s", lockMode, volumeName, callerID, d.locks.ID(), err.Error())
+		return nil, fmt.Errorf("error getting mount %s lock for volume %s: %s; %s", lockMode, volumeName, err, d.describeLockHolders(key))
+	}
+	logrus.Debugf("got mount %s lock for %s", lockMode, volumeName)
+	return mutex, nil
+}
+
+// registerMountLock keeps reference of the acquired mount lock with callerID to unlock on unmount volume
+func (d *cephRBDVolumeDriver) registerMountLock(pool, name string, callerID string, mutex volumeLock) error {
+	if d.locks != nil {
+		volumeName := fmt.Sprintf("%s/%s", pool, name)
 		if mutexes, found := d.volumeMountLocks[volumeName]; found {
 			if _, found := mutexes[callerID]; found {
 				return errors.New(fmt.Sprintf("Lock inconsistency: Just locked volume %s and caller ID %s but a previous lock reference to it was found. Aborting", volumeName, callerID))
 			}
 			mutexes[callerID] = mutex
 		} else {
-			mutexes := make(map[string]*etcdlock.RWMutex)
+			mutexes := make(map[string]volumeLock)
 			mutexes[callerID] = mutex
 			d.volumeMountLocks[volumeName] = mutexes
 		}
@@ -588,8 +1106,60 @@ func (d *cephRBDVolumeDriver) lockMountVolume(pool, name string, readonly bool,
 	return nil
 }
 
+// volumeLockWait returns the lock-wait setting stored in the image metadata or the plugin default
+func (d *cephRBDVolumeDriver) volumeLockWait(pool, name string) time.Duration {
+	lockWait := d.lockWait
+	value, err := d.getImageMeta(pool, name, lockWaitImageMetaKey)
+	if err != nil {
+		logrus.Warnf("error reading lock-wait of %s/%s. Using default %s: %s", pool, name, lockWait, err)
+	} else if value != "" {
+		lockWait = value
+	}
+	wait, err := parseLockWait(lockWait)
+	if err != nil {
+		logrus.Warnf("invalid lock-wait for %s/%s. Using default %s: %s", pool, name, d.lockWait, err)
+		wait, _ = parseLockWait(d.lockWait)
+	}
+	return wait
+}
+
+// watchReleaseRequests periodically looks for release requests posted by other hosts
+// waiting for the mount locks held by this host. Volumes with pending requests are
+// unmapped before their lock is released on the last unmount, so that the waiting host can map it right away
+func (d *cephRBDVolumeDriver) watchReleaseRequests() {
+	for d.sleepOrStop(5 * time.Second) {
+		d.m.Lock()
+		volumeNames := make([]string, 0)
+		for volumeName := range d.volumeMountLocks {
+			volumeNames = append(volumeNames, volumeName)
+		}
+		d.m.Unlock()
+
+		requests := make(map[string][]lockHolder)
+		for _, volumeName := range volumeNames {
+			reqs, err := d.locks.ReleaseRequests(volumeMountLockKey(volumeName))
+			if err != nil {
+				logrus.Warnf("error getting release requests for volume %s: %s", volumeName, err)
+				continue
+			}
+			if len(reqs) > 0 {
+				requests[volumeName] = reqs
+			}
+		}
+
+		d.m.Lock()
+		for volumeName, reqs := range requests {
+			if _, found := d.releaseRequests[volumeName]; !found {
+				logrus.Infof("Release of volume %s was requested by %v. It will be handed over when its containers exit", volumeName, reqs)
+			}
+		}
+		d.releaseRequests = requests
+		d.m.Unlock()
+	}
+}
+
 func (d *cephRBDVolumeDriver) unlockMountVolume(pool, name string, callerID string) error {
-	if d.etcdLockSession != nil {
+	if d.locks != nil {
 		if callerID == "" {
 			return errors.New(fmt.Sprintf("error releasing mount lock for volume %s/%s. callerID cannot be an empty string.", pool, name))
 		}
@@ -603,7 +1173,7 @@ func (d *cephRBDVolumeDriver) unlockMountVolume(pool, name string, callerID stri
 		if mutex, found := mutexes[callerID]; found {
 			logrus.Debugf("unlocking volume %s for caller ID %s", volumeName, callerID)
 			if err := mutex.Unlock(); err != nil {
-				logrus.Errorf("error unlocking volume %s caller ID %s lease ID %x: %s", volumeName, callerID, d.etcdLockSession.Lease(), err.Error())
+				logrus.Errorf("error unlocking volume %s caller ID %s lock owner %s: %s", volumeName, callerID, d.locks.ID(), err.Error())
 				return err
 			}
 			delete(mutexes, callerID)
@@ -618,8 +1188,25 @@ func (d *cephRBDVolumeDriver) unlockMountVolume(pool, name string, callerID stri
 	return nil
 }
 
+func (d *cephRBDVolumeDriver) mountLockKey(pool, name string) string {
+	return volumeMountLockKey(fmt.Sprintf("%s/%s", pool, name))
+}
+
+// volumeMountLockKey returns the mount lock key of a 'pool/name' volume
+func volumeMountLockKey(volumeName string) string {
+	return lockKindPrefixes["mount"] + volumeName
+}
+
+// mountLockHolders returns the current mount lock holders for the volume across the cluster
+func (d *cephRBDVolumeDriver) mountLockHolders(pool, name string) ([]lockHolder, error) {
+	if d.locks == nil {
+		return nil, nil
+	}
+	return d.locks.Holders(d.mountLockKey(pool, name))
+}
+
 func (d *cephRBDVolumeDriver) mountLocksCount(pool, name string) int {
-	if d.etcdLockSession != nil {
+	if d.locks != nil {
 		volumeName := fmt.Sprintf("%s/%s", pool, name)
 		if mutexes, found := d.volumeMountLocks[volumeName]; found {
 			return len(mutexes)
@@ -643,9 +1230,27 @@ func (d *cephRBDVolumeDriver) mountLocksCount(pool, name string) int {
 //    made available).
 //
 func (d *cephRBDVolumeDriver) List() (*volume.ListResponse, error) {
+	if err := d.startRequest("list"); err != nil {
+		return nil, err
+	}
+	defer d.operations.done()
 	logrus.Infof("")
 	logrus.Infof(">>> DOCKER API LIST")
-	return d.ListInternal()
+	resp, err := d.withCephReadTimeout(func() (interface{}, error) {
+		return d.ListInternal()
+	})
+	if err == errCephReadTimeout {
+		if vols, ok := d.inventory.staleVolumes(); ok {
+			logrus.Warnf("Ceph cluster didn't respond in %s. Listing volumes from the local inventory", d.cephReadTimeout)
+			return &volume.ListResponse{Volumes: vols}, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	list := resp.(*volume.ListResponse)
+	d.inventory.setVolumes(list.Volumes)
+	return list, nil
 }
 
 func (d *cephRBDVolumeDriver) ListInternal() (*volume.ListResponse, error) {
@@ -667,9 +1272,17 @@ func (d *cephRBDVolumeDriver) ListInternal() (*volume.ListResponse, error) {
 
 	var vols []*volume.Volume
 	var vnames = make(map[string]int)
+	var listed = make(map[string]bool)
+	for _, v := range defaultImages {
+		listed[v] = true
+	}
 
 	for k, v := range volumes {
 		var vname = fmt.Sprintf("%s/%s", v.Pool, v.Name)
+		// the listed images are already filtered by labels. Mounted volumes missing from them are checked one by one
+		if !listed[vname] && !d.matchListLabels(v.Pool, v.Name) {
+			continue
+		}
 		vnames[vname] = 1
 		apiVol := &volume.Volume{Name: vname, Mountpoint: k}
 		vols = append(vols, apiVol)
@@ -698,14 +1311,55 @@ func (d *cephRBDVolumeDriver) ListInternal() (*volume.ListResponse, error) {
 //    { "Volume": { "Name": "volume_name", "Mountpoint": "/path/to/directory/on/host" }}
 //
 func (d *cephRBDVolumeDriver) Get(r *volume.GetRequest) (*volume.GetResponse, error) {
-	d.m.Lock()
-	defer d.m.Unlock()
+	if err := d.startRequest("get"); err != nil {
+		return nil, err
+	}
+	defer d.operations.done()
 	logrus.Infof("")
 	logrus.Infof(">>> DOCKER API GET(%s)", r)
-	return d.GetInternal(r)
+	// d.m is only needed for the in-memory state of the volume. It is taken before the timed
+	// section, so that waiting for operations in progress, like a slow mkfs, is not a Ceph timeout
+	var local volumeLocalState
+	if pool, name, _, _, err := d.parseImagePoolName(r.Name); err == nil {
+		d.m.Lock()
+		local = d.localVolumeState(pool, name)
+		d.m.Unlock()
+	}
+	resp, err := d.withCephReadTimeout(func() (interface{}, error) {
+		return d.GetInternal(r, local)
+	})
+	if err == errCephReadTimeout {
+		if v, ok := d.inventory.staleVolume(r.Name); ok {
+			logrus.Warnf("Ceph cluster didn't respond in %s. Getting volume %s from the local inventory", d.cephReadTimeout, r.Name)
+			return &volume.GetResponse{Volume: v}, nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	get := resp.(*volume.GetResponse)
+	d.inventory.setVolume(get.Volume)
+	return get, nil
+}
+
+// volumeLocalState is the in-memory state of a volume in this plugin instance
+type volumeLocalState struct {
+	mountLocks      int
+	releaseRequests []lockHolder
+}
+
+// localVolumeState returns a copy of the in-memory state of a volume. Must be called with d.m held
+func (d *cephRBDVolumeDriver) localVolumeState(pool, name string) volumeLocalState {
+	local := volumeLocalState{mountLocks: d.mountLocksCount(pool, name)}
+	if requests, found := d.releaseRequests[fmt.Sprintf("%s/%s", pool, name)]; found {
+		local.releaseRequests = append([]lockHolder{}, requests...)
+	}
+	return local
 }
 
-func (d *cephRBDVolumeDriver) GetInternal(r *volume.GetRequest) (*volume.GetResponse, error) {
+// GetInternal returns the volume details. It doesn't need d.m, as the in-memory state of the
+// volume is given in local
+func (d *cephRBDVolumeDriver) GetInternal(r *volume.GetRequest, local volumeLocalState) (*volume.GetResponse, error) {
 	logrus.Debugf("API GetInternal(%s)", r)
 
 	// parse full image name for optional/default pieces
@@ -733,11 +1387,51 @@ func (d *cephRBDVolumeDriver) GetInternal(r *volume.GetRequest) (*volume.GetResp
 
 	// only provide mountPoint for volumes that are actually mounted
 	var mountPoint string
-	if d.mountLocksCount(pool, name) > 0 {
+	if local.mountLocks > 0 {
 		mountPoint = d.mountpoint(pool, name, readonly)
 	}
 
-	return &volume.GetResponse{Volume: &volume.Volume{Name: r.Name, Mountpoint: mountPoint, CreatedAt: createdAt}}, nil
+	status := make(map[string]interface{})
+	if info.DataPool != "" {
+		status["dataPool"] = info.DataPool
+	}
+	holders, err := d.mountLockHolders(pool, name)
+	if err != nil {
+		logrus.Warnf("couldn't get mount lock holders for %s/%s: %s", pool, name, err)
+		status["mountLockHoldersError"] = err.Error()
+	} else if holders != nil {
+		status["mountLockHolders"] = holders
+	}
+	if local.releaseRequests != nil {
+		status["releaseRequestedBy"] = local.releaseRequests
+	}
+	meta, err := d.loadVolumeMetadata(pool, name)
+	if err != nil {
+		logrus.Warnf("couldn't get stored options of %s/%s: %s", pool, name, err)
+	} else {
+		status["options"] = meta.Options
+		status["labels"] = meta.Labels
+		if meta.State != "" {
+			status["state"] = meta.State
+		}
+		if meta.FormatPending != "" {
+			status["formatPending"] = true
+		}
+	}
+	d.addImageStatus(status, pool, name, mountPoint, info)
+	if states := d.deviceHealth.volumeStates(pool, name); len(states) > 0 {
+		status["deviceHealth"] = states
+		for _, s := range states {
+			if !s.Healthy {
+				status["unhealthy"] = true
+			}
+		}
+	}
+	if health := d.health.summary(); health != nil {
+		status["clusterHealth"] = health
+	}
+
+	return &volume.GetResponse{Volume: &volume.Volume{Name: r.Name, Mountpoint: mountPoint, CreatedAt: createdAt, Status: status}}, nil
 }
 
 // Path returns the path to host directory mountpoint for volume.
@@ -757,9 +1451,28 @@ func (d *cephRBDVolumeDriver) GetInternal(r *volume.GetRequest) (*volume.GetResp
 // FIXME: does volume API require error if Volume requested does not exist/is not mounted? Similar to List/Get leaving mountpoint empty?
 //
 func (d *cephRBDVolumeDriver) Path(r *volume.PathRequest) (*volume.PathResponse, error) {
+	if err := d.startRequest("path"); err != nil {
+		return nil, err
+	}
+	defer d.operations.done()
 	logrus.Infof("")
 	logrus.Infof(">>> DOCKER API PATH(%s)", r)
-	return d.PathInternal(r)
+	resp, err := d.withCephReadTimeout(func() (interface{}, error) {
+		return d.PathInternal(r)
+	})
+	if err == errCephReadTimeout {
+		if pool, name, _, readonly, perr := d.parseImagePoolName(r.Name); perr == nil {
+			mountpath := d.mountpoint(pool, name, readonly)
+			if d.inventory.hasMount(mountpath) {
+				logrus.Warnf("Mapped devices couldn't be listed in %s. Using mountpath %s from the local inventory", d.cephReadTimeout, mountpath)
+				return &volume.PathResponse{Mountpoint: mountpath}, nil
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*volume.PathResponse), nil
 }
 
 func (d *cephRBDVolumeDriver) PathInternal(r *volume.PathRequest) (*volume.PathResponse, error) {
@@ -803,6 +1516,10 @@ func (d *cephRBDVolumeDriver) PathInternal(r *volume.PathRequest) (*volume.PathR
 //    Respond with error or nil
 //
 func (d *cephRBDVolumeDriver) Unmount(r *volume.UnmountRequest) error {
+	if err := d.startRequest("unmount"); err != nil {
+		return err
+	}
+	defer d.operations.done()
 	d.m.Lock()
 	defer d.m.Unlock()
 	logrus.Infof("")
@@ -821,14 +1538,27 @@ func (d *cephRBDVolumeDriver) UnmountInternal(r *volume.UnmountRequest) error {
 		return errors.New(err)
 	}
 
-	// release lock
-	if err := d.unlockMountVolume(pool, name, r.ID); err != nil {
-		return err
-	}
-	// continue to unmount only when there are no other locks for this mount
-	if locksCount := d.mountLocksCount(pool, name); locksCount != 0 {
-		logrus.Infof("skipping unmount... there are still %d locks for this mount", locksCount)
-		return nil
+	// when another host is waiting for this volume, release the lock of the last
+	// caller only after the device is unmapped, so that the other host can map it right away
+	volumeName := fmt.Sprintf("%s/%s", pool, name)
+	if _, handoff := d.releaseRequests[volumeName]; handoff && d.mountLocksCount(pool, name) == 1 {
+		logrus.Infof("Handing over volume %s. Lock will be released after unmap", volumeName)
+		defer func() {
+			if err := d.unlockMountVolume(pool, name, r.ID); err != nil {
+				logrus.Errorf("error releasing mount lock of volume %s for handoff: %s", volumeName, err)
+			}
+			delete(d.releaseRequests, volumeName)
+		}()
+	} else {
+		// release lock
+		if err := d.unlockMountVolume(pool, name, r.ID); err != nil {
+			return err
+		}
+		// continue to unmount only when there are no other locks for this mount
+		if locksCount := d.mountLocksCount(pool, name); locksCount != 0 {
+			logrus.Infof("skipping unmount... there are still %d locks for this mount", locksCount)
+			return nil
+		}
 	}
 
 	mountpath := d.mountpoint(pool, name, readonly)
@@ -853,7 +1583,11 @@ func (d *cephRBDVolumeDriver) UnmountInternal(r *volume.UnmountRequest) error {
 	// unmount
 	// NOTE: this might succeed even if device is still in use inside container. device will disappear from host side but still be usable inside container :(
 	logrus.Debugf("unmounting %s from device %s", mountpath, vol.Device)
-	err = d.unmountPath(mountpath)
+	if vol.Block {
+		err = removeBlockDevice(mountpath)
+	} else {
+		err = d.unmountPath(mountpath)
+	}
 	if err != nil {
 		err := fmt.Sprintf("Error unmounting device %s: %s", vol.Device, err)
 		logrus.Errorf("%s", err)
@@ -864,6 +1598,15 @@ func (d *cephRBDVolumeDriver) UnmountInternal(r *volume.UnmountRequest) error {
 		logrus.Debugf("Volume %s/%s unmounted from %s device %s successfully. ", pool, name, mountpath, vol.Device)
 	}
 
+	if vol.CryptName != "" {
+		logrus.Debugf("closing LUKS device %s", vol.CryptName)
+		if err := luksClose(vol.CryptName); err != nil {
+			err := fmt.Sprintf("Error closing LUKS device %s: %s", vol.CryptName, err)
+			logrus.Errorf("%s", err)
+			return errors.New(err)
+		}
+	}
+
 	// unmap
 	logrus.Infof("Unmapping device %s from kernel for RBD Image %s/%s", vol.Device, pool, name)
 	if err := d.unmapImageDevice(vol.Device); err != nil {
@@ -893,6 +1636,8 @@ func (d *cephRBDVolumeDriver) UnmountInternal(r *volume.UnmountRequest) error {
 	// 	err_msgs = append(err_msgs, "Error unlocking image")
 	// }
 
+	d.inventory.setMount(mountpath, nil)
+
 	// logrus.Debugf("removing mount info from instance map")
 	// delete(d.volumes, mountpath)
 	return nil
@@ -926,7 +1671,7 @@ func (d *cephRBDVolumeDriver) rbdDefaultPoolImageList() ([]string, error) {
 
 // rbdPoolImageList performs an `rbd ls` on the pool
 func (d *cephRBDVolumeDriver) rbdPoolImageList(pool string) ([]string, error) {
-	result, err := d.rbdsh(pool, "ls")
+	result, err := d.rbdshTimeout(listShellTimeout, pool, "ls")
 	if err != nil {
 		return nil, err
 	}
@@ -937,43 +1682,37 @@ func (d *cephRBDVolumeDriver) rbdPoolImageList(pool string) ([]string, error) {
 	return strings.Split(result, "\n"), nil
 }
 
-// listImagesFromAllPools list pools and its images
-// returns array with 'poolName/imageName' items
-func (d *cephRBDVolumeDriver) listImagesFromAllPools() ([]string, error) {
-	poolList, err := poolList()
-	if err != nil {
-		return nil, err
-	}
-	var allImages []string
-	for _, pool := range poolList {
-		images, err := d.rbdPoolImageList(pool)
-		if err != nil {
-			return nil, err
-		}
-		for _, image := range images {
-			allImages = append(allImages, fmt.Sprintf("%s/%s", pool, image))
-		}
-	}
-	return allImages, nil
-}
-
 // create ceph osd pool
 // initialize created pool
-func (d *cephRBDVolumeDriver) createPool(pool string) error {
+func (d *cephRBDVolumeDriver) createPool(pool string, options poolOptions) error {
 	if !d.canCreatePools {
 		err := fmt.Sprintf("the pool '%s' does not exists and the cepher is not allowed to auto create it", pool)
 		logrus.Error(err)
 		return errors.New(err)
 	}
+	return d.createAndInitPool(pool, options)
+}
+
+// createAndInitPool creates the pool with the given settings and initializes it for RBD
+func (d *cephRBDVolumeDriver) createAndInitPool(pool string, options poolOptions) error {
 	logrus.Infof("creating pool '%s'", pool)
-	_, err := shWithDefaultTimeout("ceph", "osd", "pool", "create", pool, d.defaultPoolPgNum)
+	_, err := shWithDefaultTimeout("ceph", options.createPoolArgs(pool)...)
 	if err != nil {
 		err := fmt.Sprintf("error while creating pool '%s': %s", pool, err)
 		logrus.Error(err)
 		return errors.New(err)
 	}
+	if err := applyPoolOptions(pool, options); err != nil {
+		logrus.Error(err)
+		return err
+	}
 	logrus.Infof("initializing pool '%s'", pool)
-	_, err = d.rbdsh(pool, "pool", "init", pool)
+	if options.erasureProfile != "" {
+		// erasure coded pools only hold RBD data. 'rbd pool init' is for metadata pools
+		_, err = shWithDefaultTimeout("ceph", "osd", "pool", "application", "enable", pool, "rbd")
+	} else {
+		_, err = d.rbdsh(pool, "pool", "init", pool)
+	}
 	if err != nil {
 		err := fmt.Sprintf("error while initializing pool '%s': %s", pool, err)
 		logrus.Error(err)
@@ -983,14 +1722,71 @@ func (d *cephRBDVolumeDriver) createPool(pool string) error {
 	return nil
 }
 
-// poolList performs an `rbd ls` on the pool
-func poolList() ([]string, error) {
-	result, err := shWithDefaultTimeout("ceph", "osd", "pool", "ls")
+// prepareDefaultPool verifies that the default pool exists, creating it if allowed. Ceph commands
+// are retried until poolPrepareTimeout, because monitors may still be unreachable during boot
+func (d *cephRBDVolumeDriver) prepareDefaultPool() error {
+	pool := d.defaultCephPool
+	logrus.Infof("Preparing default Ceph pool %s", pool)
+	deadline := time.Now().Add(d.poolPrepareTimeout)
+	wait := 2 * time.Second
+	for {
+		err := d.prepareDefaultPoolOnce(pool)
+		if err == nil {
+			return nil
+		}
+		if time.Now().Add(wait).After(deadline) {
+			return fmt.Errorf("error preparing default pool '%s': %s", pool, err)
+		}
+		logrus.Warnf("error preparing default pool '%s'. Retrying in %v: %s", pool, wait, err)
+		time.Sleep(wait)
+		if wait < 30*time.Second {
+			wait = wait * 2
+		}
+	}
+}
+
+func (d *cephRBDVolumeDriver) prepareDefaultPoolOnce(pool string) error {
+	exists, err := poolExists(pool)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	// split into lines - should be one pool name per line
-	return strings.Split(result, "\n"), nil
+	if exists {
+		logrus.Infof("Pool %s was found in Ceph cluster", pool)
+		return nil
+	}
+	if !d.createDefaultPool {
+		logrus.Warnf("Pool %s was not found in Ceph cluster and pool-create is disabled", pool)
+		return nil
+	}
+	options := d.poolDefaults
+	if d.defaultPoolQuota != "" {
+		options.quotaMaxBytes = d.defaultPoolQuota
+	}
+	return d.createAndInitPool(pool, options)
+}
+
+// prepareDataPool creates the erasure coded data pool for new images if it doesn't exist
+func (d *cephRBDVolumeDriver) prepareDataPool(dataPool string, options map[string]string) error {
+	exists, err := poolExists(dataPool)
+	if err != nil {
+		err := fmt.Sprintf("error while checking if data pool '%s' exists: %s", dataPool, err)
+		logrus.Error(err)
+		return errors.New(err)
+	}
+	if exists {
+		return nil
+	}
+	dataPoolOpts := d.poolDefaults
+	dataPoolOpts.size = ""
+	dataPoolOpts.minSize = ""
+	dataPoolOpts.erasureProfile = d.defaultDataPoolEC
+	if options["data-pool-erasure-profile"] != "" {
+		dataPoolOpts.erasureProfile = options["data-pool-erasure-profile"]
+	}
+	if err := dataPoolOpts.validate(); err != nil {
+		return err
+	}
+	return d.createPool(dataPool, dataPoolOpts)
 }
 
 func poolExists(pool string) (bool, error) {
@@ -1098,15 +1894,44 @@ func (d *cephRBDVolumeDriver) rbdImageInfo(pool, findName string) (*imageInfo, e
 	return &imageInfo, nil
 }
 
-// createRBDImage will create a new Ceph block device and make a filesystem on it
-func (d *cephRBDVolumeDriver) createRBDImage(pool string, name string, size int, fstype string, features string) error {
-	logrus.Infof("Creating new RBD Image pool=%v; name=%v; size=%v; fs=%v; features=%v)", pool, name, size, fstype, features)
+// setImageMeta stores a key/value pair in the RBD Image metadata
+func (d *cephRBDVolumeDriver) setImageMeta(pool, name, key, value string) error {
+	_, err := d.rbdsh(pool, "image-meta", "set", name, key, shellQuote(value))
+	return err
+}
 
-	// check that fs is valid type (needs mkfs.fstype in PATH)
-	mkfs, err := exec.LookPath("mkfs." + fstype)
+// getImageMeta returns a value from the RBD Image metadata or an empty string if the key is not set
+func (d *cephRBDVolumeDriver) getImageMeta(pool, name, key string) (string, error) {
+	value, err := d.rbdsh(pool, "image-meta", "get", name, key)
 	if err != nil {
-		msg := fmt.Sprintf("Unable to find mkfs for %s in PATH: %s", fstype, err)
-		return errors.New(msg)
+		if strings.Contains(err.Error(), "No such file or directory") {
+			return "", nil
+		}
+		return "", err
+	}
+	return value, nil
+}
+
+// removeImageMeta removes a key from the RBD Image metadata. Missing keys are ignored
+func (d *cephRBDVolumeDriver) removeImageMeta(pool, name, key string) error {
+	_, err := d.rbdsh(pool, "image-meta", "remove", name, key)
+	if err != nil && strings.Contains(err.Error(), "No such file or directory") {
+		return nil
+	}
+	return err
+}
+
+// createRBDImage will create a new Ceph block device and make a filesystem on it
+func (d *cephRBDVolumeDriver) createRBDImage(pool string, name string, size int, fstype string, features string, dataPool string, encrypted bool, lazyFormat bool) error {
+	logrus.Infof("Creating new RBD Image pool=%v; name=%v; size=%v; fs=%v; features=%v; dataPool=%v; encrypted=%v; lazyFormat=%v)", pool, name, size, fstype, features, dataPool, encrypted, lazyFormat)
+
+	// check that fs is valid type (needs mkfs.fstype in PATH). Block mode images have no filesystem
+	if fstype != "" {
+		_, err := exec.LookPath("mkfs." + fstype)
+		if err != nil {
+			msg := fmt.Sprintf("Unable to find mkfs for %s in PATH: %s", fstype, err)
+			return errors.New(msg)
+		}
 	}
 
 	//prepare call
@@ -1117,11 +1942,15 @@ func (d *cephRBDVolumeDriver) createRBDImage(pool string, name string, size int,
 	for _, v := range ics {
 		cargs = append(cargs, []string{"--image-feature", v}...)
 	}
+	if dataPool != "" {
+		// image data goes to the (erasure coded) data pool. metadata stays in pool
+		cargs = append(cargs, []string{"--data-pool", dataPool}...)
+	}
 
 	// _, err = shWithDefaultTimeout("rbd", cargs...)
 
 	//perform call
-	_, err = d.rbdsh(pool, "create", cargs...)
+	_, err := d.rbdsh(pool, "create", cargs...)
 	// "--image-format", strconv.Itoa(2),
 	// "--size", strconv.Itoa(size),
 	// "--image-feature", "layering",
@@ -1129,11 +1958,54 @@ func (d *cephRBDVolumeDriver) createRBDImage(pool string, name string, size int,
 	// "--image-feature", "exclusive-lock",
 	// name)
 	if err != nil {
+		if _, ok := err.(ShTimeoutError); ok {
+			// the image may have been created after all
+			if rerr := d.rollbackCreate(pool, name); rerr != nil {
+				logrus.Errorf("%s", rerr)
+			}
+		}
 		err := fmt.Sprintf("error creating RBD Image %s/%s: %s", pool, name, err)
 		logrus.Errorf("%s", err)
 		return errors.New(err)
 	}
 
+	// from here on the image is removed if any step fails, so that no unformatted image is left behind
+	completed := false
+	defer func() {
+		if !completed {
+			if err := d.rollbackCreate(pool, name); err != nil {
+				logrus.Errorf("%s", err)
+			}
+		}
+	}()
+	if err := d.beginCreate(pool, name); err != nil {
+		logrus.Errorf("%s", err)
+		return err
+	}
+
+	if lazyFormat {
+		// the filesystem is created by the first mount, on the host that will use it
+		if encrypted {
+			if _, err := d.newVolumeKey(pool, name); err != nil {
+				logrus.Errorf("%s", err)
+				return err
+			}
+		}
+		if err := d.setImageMeta(pool, name, formatPendingImageMetaKey, fstype); err != nil {
+			err := fmt.Sprintf("error marking RBD Image %s/%s for format on first mount: %s", pool, name, err)
+			logrus.Errorf("%s", err)
+			return errors.New(err)
+		}
+		logrus.Infof("RBD Image creation completed. Filesystem will be created on first mount")
+		completed = true
+		return nil
+	}
+	if fstype == "" && !encrypted {
+		logrus.Infof("RBD Image creation completed for block mode")
+		completed = true
+		return nil
+	}
+
 	//TODO REVIEW LATER
 	// // lock it temporarily for fs creation
 	// lockname, err := d.lockImage(pool, name)
@@ -1152,16 +2024,19 @@ func (d *cephRBDVolumeDriver) createRBDImage(pool string, name string, size int,
 		logrus.Debugf("Done")
 	}
 
-	logrus.Debugf("Formatting filesystem %s on device %s", fstype, device)
-	// _, err = (5*time.Minute, mkfs, device)
-	_, err = ExecShellTimeout(5*time.Minute, mkfs, device)
-	if err != nil {
+	var key []byte
+	if encrypted {
+		key, err = d.newVolumeKey(pool, name)
+		if err != nil {
+			defer d.unmapImageDevice(device)
+			logrus.Errorf("%s", err)
+			return err
+		}
+	}
+	if err := d.formatDevice(pool, name, device, fstype, key, false); err != nil {
 		defer d.unmapImageDevice(device)
-		err := fmt.Sprintf("error formatting filesystem %s on device %s: %s", fstype, device, err)
 		logrus.Errorf("%s", err)
-		return errors.New(err)
-	} else {
-		logrus.Debugf("Done")
+		return err
 	}
 
 	// TODO: should we chown/chmod the directory? e.g. non-root container users
@@ -1187,6 +2062,7 @@ func (d *cephRBDVolumeDriver) createRBDImage(pool string, name string, size int,
 	// }
 	logrus.Infof("RBD Image creation completed and filesystem prepared")
 
+	completed = true
 	return nil
 }
 
@@ -1295,10 +2171,19 @@ func (d *cephRBDVolumeDriver) renameRBDImage(pool, name, newname string) error {
 }
 
 func (d *cephRBDVolumeDriver) mapImageToDevice(pool string, imagename string, readonly bool) (string, error) {
+	device, err := d.mapImage(pool, imagename, readonly)
+	if err == nil {
+		// devices mapped by the plugin are tracked so that the reconciler may unmap them if they are left behind
+		d.inventory.setMapped(device, pool, imagename)
+	}
+	return device, err
+}
+
+func (d *cephRBDVolumeDriver) mapImage(pool string, imagename string, readonly bool) (string, error) {
 	//map image to kernel device
 	if d.useRBDKernelModule {
 		logrus.Debugf("Mapping RBD image %s/%s using RBD Kernel module", pool, imagename)
-		return d.rbdsh(pool, "map", imagename)
+		return d.rbdshTimeout(mapShellTimeout, pool, "map", imagename)
 	} else {
 		logrus.Debugf("Mapping RBD image %s/%s using nbd-rbd client. readonly=%v", pool, imagename, readonly)
 		if !readonly {
@@ -1306,16 +2191,16 @@ func (d *cephRBDVolumeDriver) mapImageToDevice(pool string, imagename string, re
 			//if the host is rebooted, the lock is released too. Right after unmap, the image is available for lock by another host immediatelly.
 			//works very well for --exclusive x --exclusive competitions
 			// return shWithDefaultTimeout("rbd-nbd", "--exclusive", "--timeout", "60", "map", pool+"/"+imagename)
-			return shWithDefaultTimeout("rbd-nbd", "--exclusive", "map", pool+"/"+imagename)
+			return ExecShellTimeout(mapShellTimeout, "rbd-nbd", "--exclusive", "map", pool+"/"+imagename)
 		} else {
 			//during tests, simultaneous mapping with --read-only is permitted, but
 			//it allows --read-only to be placed while there is another --exclusive mapping, which is bad.
 			//--exclusive while --read-only is in place works too (shouldn't!)
-			if d.etcdLockSession != nil {
+			if d.locks != nil {
 				// return shWithDefaultTimeout("rbd-nbd", "--read-only", "--timeout", "60", "map", pool+"/"+imagename)
-				return shWithDefaultTimeout("rbd-nbd", "--read-only", "map", pool+"/"+imagename)
+				return ExecShellTimeout(mapShellTimeout, "rbd-nbd", "--read-only", "map", pool+"/"+imagename)
 			} else {
-				return "", errors.New("Only exclusive write access (single mapping of a volume) is supported at a time. For shared locks, specify a ETCD server for distributed RW Lock management (--lock-etcd)")
+				return "", errors.New("Only exclusive write access (single mapping of a volume) is supported at a time. For shared locks, specify a lock backend for distributed RW Lock management (--lock-etcd or --lock-consul)")
 			}
 		}
 	}
@@ -1323,19 +2208,38 @@ func (d *cephRBDVolumeDriver) mapImageToDevice(pool string, imagename string, re
 
 // unmapImageDevice will release the mapped kernel device
 func (d *cephRBDVolumeDriver) unmapImageDevice(device string) error {
+	err := d.unmapDevice(device)
+	if err == nil {
+		d.inventory.removeMapped(device)
+	}
+	return err
+}
+
+func (d *cephRBDVolumeDriver) unmapDevice(device string) error {
 	//unmap device from kernel
 	if d.useRBDKernelModule {
 		logrus.Debugf("Unmapping device %s using RBD Kernel module", device)
-		_, err := d.rbdsh("", "unmap", device)
+		_, err := d.rbdshTimeout(mapShellTimeout, "", "unmap", device)
 		return err
 	} else {
 		logrus.Debugf("Unmapping device %s using rbd-rbd client", device)
-		_, err := shWithDefaultTimeout("rbd-nbd", "--timeout", "60", "unmap", device)
+		_, err := ExecShellTimeout(mapShellTimeout, "rbd-nbd", "--timeout", "60", "unmap", device)
 		// _, err := shWithDefaultTimeout("rbd-nbd", "unmap", device)
 		return err
 	}
 }
 
+// releaseVolumeDevice closes the dm-crypt mapping of encrypted volumes, if any, and unmaps the device
+func (d *cephRBDVolumeDriver) releaseVolumeDevice(device string, cryptName string) error {
+	if cryptName != "" {
+		logrus.Debugf("Closing LUKS device %s", cryptName)
+		if err := luksClose(cryptName); err != nil {
+			return err
+		}
+	}
+	return d.unmapImageDevice(device)
+}
+
 // list mapped kernel devices
 func (d *cephRBDVolumeDriver) listMappedDevices() ([]*Volume, error) {
 	var devices string = ""
@@ -1486,7 +2390,7 @@ func (d *cephRBDVolumeDriver) xfsRepairDryRun(device string) error {
 	// "xfs_repair  -n  (no  modify node) will return a status of 1 if filesystem
 	// corruption was detected and 0 if no filesystem corruption was detected." xfs_repair(8)
 	// TODO: can we check cmd output and ensure the mount/unmount is suggested by stale disk log?
-	_, err := shWithDefaultTimeout("xfs_repair", "-n", device)
+	_, err := ExecShellTimeout(fsckShellTimeout, "xfs_repair", "-n", device)
 	return err
 }
 
@@ -1495,7 +2399,7 @@ func (d *cephRBDVolumeDriver) attemptLimitedXFSRepair(fstype, device, mountpath
 	logrus.Warnf("attempting limited XFS repair (mount/unmount) of %s %s", device, mountpath)
 
 	// mount
-	err = d.mountDeviceToPath(fstype, device, mountpath, false)
+	err = d.mountDeviceToPath(fstype, device, mountpath, false, "")
 	if err != nil {
 		return err
 	}
@@ -1511,7 +2415,7 @@ func (d *cephRBDVolumeDriver) attemptLimitedXFSRepair(fstype, device, mountpath
 }
 
 // mountDevice will call mount on kernel device with a docker volume subdirectory
-func (d *cephRBDVolumeDriver) mountDeviceToPath(fstype string, device string, path string, readonly bool) error {
+func (d *cephRBDVolumeDriver) mountDeviceToPath(fstype string, device string, path string, readonly bool, options string) error {
 	// if readonly {
 	// 	// logrus.Infof("Path %s was mounted to %s in readonly mode. Make sure the mount options in Docker volume is :ro because the mount driver can't ensure the container won't write on a 'ro' mount (unfortunatelly!)", device, path)
 	// 	path1 := path + ":rw"
@@ -1530,6 +2434,10 @@ func (d *cephRBDVolumeDriver) mountDeviceToPath(fstype string, device string, pa
 	// 		return err
 	// 	}
 	// } else {
+	if options != "" {
+		_, err := shWithDefaultTimeout("mount", "-t", fstype, "-o", shellQuote(options), device, path)
+		return err
+	}
 	_, err := shWithDefaultTimeout("mount", "-t", fstype, device, path)
 	return err
 	// }
@@ -1546,17 +2454,26 @@ func (d *cephRBDVolumeDriver) unmountPath(path string) error {
 
 // rbdsh will call rbd with the given command arguments, also adding config, user and pool flags
 func (d *cephRBDVolumeDriver) rbdsh(pool, command string, args ...string) (string, error) {
+	return d.rbdshTimeout(defaultShellTimeout, pool, command, args...)
+}
+
+// rbdshTimeout is rbdsh with the timeout of the operation class. Results are tracked by the circuit breaker
+func (d *cephRBDVolumeDriver) rbdshTimeout(timeout time.Duration, pool, command string, args ...string) (string, error) {
 	args = append([]string{"--conf", d.cephConfigFile, "--id", d.cephUser, command}, args...)
 	if pool != "" {
 		args = append([]string{"--pool", pool}, args...)
 	}
-	return shWithDefaultTimeout("rbd", args...)
+	out, err := ExecShellTimeout(timeout, "rbd", args...)
+	d.health.recordResult(err)
+	return out, err
 }
 
 func (d *cephRBDVolumeDriver) isVolumeReadonly(volumeName string) (isRO bool, err error) {
 	return regexp.MatchString("#ro", volumeName)
 }
 
+// currentVolumes returns the volumes mounted, or exposed as block devices, in this host by mountpath.
+// Mapped devices that are not in use are left alone
 func (d *cephRBDVolumeDriver) currentVolumes() (map[string]*Volume, error) {
 	mapped, err := d.listMappedDevices()
 	if err != nil {
@@ -1574,6 +2491,13 @@ func (d *cephRBDVolumeDriver) currentVolumes() (map[string]*Volume, error) {
 	}
 	logrus.Debugf("system mounts: %v", mounts)
 
+	cryptMappings, err := listCryptMappings()
+	if err != nil {
+		err := fmt.Sprintf("error getting dm-crypt mappings: %s", err)
+		logrus.Errorf("%s", err)
+		return nil, errors.New(err)
+	}
+
 	//transform array to map
 	deviceToMountPathMap := make(map[string]string)
 	volumes := make(map[string]*Volume)
@@ -1583,29 +2507,41 @@ func (d *cephRBDVolumeDriver) currentVolumes() (map[string]*Volume, error) {
 	}
 
 	for _, v := range mapped {
-		mountpath, found := deviceToMountPathMap[v.Device]
+		// encrypted volumes are mounted from their dm-crypt device
+		cryptName := cryptMappings[v.Device]
+		mountDevice := v.Device
+		if cryptName != "" {
+			mountDevice = "/dev/mapper/" + cryptName
+		}
+		mountpath, found := deviceToMountPathMap[mountDevice]
 		if found {
 			//add detected mount point as initial mount state
-			logrus.Debugf("RBD Image %s/%s found mounted at %s with device %s", v.Pool, v.Name, mountpath, v.Device)
+			logrus.Debugf("RBD Image %s/%s found mounted at %s with device %s", v.Pool, v.Name, mountpath, mountDevice)
 			volumes[mountpath] = &Volume{
 				Pool:      v.Pool,
 				Name:      v.Name,
 				Device:    v.Device,
 				Mountpath: mountpath,
+				CryptName: cryptName,
 			}
-		} else {
-			logrus.Debugf("RBD Image %s/%s found mapped to device %s, but it is not mounted yet.", v.Pool, v.Name, v.Device)
-			logrus.Debugf("unmapping device")
-			err = d.unmapImageDevice(v.Device)
-			if err != nil {
-				logrus.Errorf("error on unmap of %s: %s", v.Device, err)
-				return nil, errors.New(fmt.Sprintf("error on unmapping of unmounted kernel rbd device %s. RBD Image %s/%s: %s", v.Device, v.Pool, v.Name, err))
-			} else {
-				logrus.Debugf("unmap successful")
+		} else if blockMountpath, found := d.findBlockMount(v.Pool, v.Name, mountDevice); found {
+			logrus.Debugf("RBD Image %s/%s found exposed as block device at %s with device %s", v.Pool, v.Name, blockMountpath, mountDevice)
+			volumes[blockMountpath] = &Volume{
+				Pool:      v.Pool,
+				Name:      v.Name,
+				Device:    v.Device,
+				Mountpath: blockMountpath,
+				CryptName: cryptName,
+				Block:     true,
 			}
+		} else {
+			// may be in use by a create or mount in progress, another tool or an admin. Devices left
+			// behind by the plugin are unmapped by the orphan device reconciler
+			logrus.Debugf("RBD Image %s/%s found mapped to device %s, but it is not mounted", v.Pool, v.Name, v.Device)
 		}
 	}
 
+	d.inventory.setMounts(volumes)
 	return volumes, nil
 }
 
@@ -66,7 +66,7 @@ func TestListCommand(t *testing.T) {
 
 	logrus.Debugf("Initializing driver instance")
 	err := driver.init()
-	logrus.Debugf("etcdLockSession=%v", driver.etcdLockSession)
+	logrus.Debugf("locks=%v", driver.locks)
 	logrus.Debugf("deviceLocks=%v", driver.volumeMountLocks)
 	if err != nil {
 		logrus.Errorf("error during driver initialization: %s", err)
@@ -162,7 +162,7 @@ func DoCompleteRWVolumeTask(volumeName string, driver cephRBDVolumeDriver) {
 	logrus.Debugf("------- LIST MAPPED DEVICES ---------")
 	volumes, err := driver.listMappedDevices()
 	for _, item := range volumes {
-		logrus.Debugf("--> Volume %q", item)
+		logrus.Debugf("--> Volume %+v", item)
 	}
 
 	time.Sleep(10 * time.Second)
@@ -236,7 +236,7 @@ func DoCompleteRVolumeTask(volumeName string, driver cephRBDVolumeDriver) {
 	logrus.Debugf("------- LIST MAPPED DEVICES ---------")
 	volumes, err := driver.listMappedDevices()
 	for _, item := range volumes {
-		logrus.Debugf("--> Volume %q", item)
+		logrus.Debugf("--> Volume %+v", item)
 	}
 
 	time.Sleep(10 * time.Second)
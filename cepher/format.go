@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+
+	"github.com/sirupsen/logrus"
+)
+
+// formatPendingImageMetaKey holds the filesystem type of images created with format=on-first-mount
+// until their filesystem is created
+const formatPendingImageMetaKey = "cepher.format-pending"
+
+// values of the 'format' volume option
+const (
+	formatOnCreate     = "on-create"
+	formatOnFirstMount = "on-first-mount"
+)
+
+// parseFormatOption returns true if the filesystem should be created on the first mount
+func parseFormatOption(value string) (bool, error) {
+	switch value {
+	case "", formatOnCreate:
+		return false, nil
+	case formatOnFirstMount:
+		return true, nil
+	}
+	return false, fmt.Errorf("invalid format option '%s'. Must be '%s' or '%s'", value, formatOnCreate, formatOnFirstMount)
+}
+
+// mkfsArgs returns the mkfs arguments for device. With nodiscard, mkfs doesn't discard the device
+// blocks first, which is slow on large images and useless on new ones, as they are thin provisioned
+func mkfsArgs(fstype string, device string, nodiscard bool) []string {
+	args := make([]string, 0)
+	if nodiscard {
+		switch fstype {
+		case "ext2", "ext3", "ext4":
+			args = append(args, "-E", "nodiscard")
+		case "xfs", "btrfs":
+			args = append(args, "-K")
+		}
+	}
+	return append(args, device)
+}
+
+// formatDevice creates the filesystem on the mapped device of an image. For encrypted images (key
+// is not nil) the LUKS container is created first and the filesystem is created inside it.
+// No filesystem is created if fstype is empty
+func (d *cephRBDVolumeDriver) formatDevice(pool, name, device, fstype string, key []byte, nodiscard bool) error {
+	var err error
+	mkfs := ""
+	if fstype != "" {
+		mkfs, err = exec.LookPath("mkfs." + fstype)
+		if err != nil {
+			return fmt.Errorf("Unable to find mkfs for %s in PATH: %s", fstype, err)
+		}
+	}
+
+	fsDevice := device
+	cryptName := ""
+	if key != nil {
+		logrus.Debugf("Formatting LUKS on device %s", device)
+		if err := luksFormat(device, key); err != nil {
+			return fmt.Errorf("error formatting LUKS on device %s: %s", device, err)
+		}
+		cryptName = cryptMappingName(pool, name, false)
+		fsDevice, err = luksOpen(device, cryptName, key, false)
+		if err != nil {
+			return fmt.Errorf("error opening LUKS device %s: %s", device, err)
+		}
+	}
+
+	// block mode images only get the LUKS container
+	if mkfs != "" {
+		logrus.Debugf("Formatting filesystem %s on device %s", fstype, fsDevice)
+		_, err = ExecShellTimeout(mkfsShellTimeout, mkfs, mkfsArgs(fstype, fsDevice, nodiscard)...)
+	}
+	if cryptName != "" {
+		if cerr := luksClose(cryptName); cerr != nil {
+			logrus.Errorf("error closing LUKS device %s: %s", cryptName, cerr)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error formatting filesystem %s on device %s: %s", fstype, fsDevice, err)
+	}
+	logrus.Debugf("Done")
+	return nil
+}
+
+// formatOnFirstMount creates the filesystem of an image created with format=on-first-mount on its
+// mapped device. The create lock is held, so that the image is formatted only once
+func (d *cephRBDVolumeDriver) formatOnFirstMount(pool, name, device string, key []byte, readonly bool) error {
+	if readonly {
+		return fmt.Errorf("RBD Image %s/%s has no filesystem yet. It is created by the first read-write mount", pool, name)
+	}
+	mutex, err := d.lockCreateVolume(pool, name)
+	if err != nil {
+		return err
+	}
+	defer d.unlockCreateVolume(mutex)
+
+	fstype, err := d.getImageMeta(pool, name, formatPendingImageMetaKey)
+	if err != nil {
+		return fmt.Errorf("error checking format state of RBD Image %s/%s: %s", pool, name, err)
+	}
+	if fstype == "" {
+		logrus.Debugf("RBD Image %s/%s was formatted in the meantime", pool, name)
+		return nil
+	}
+	logrus.Infof("Formatting RBD Image %s/%s with %s on first mount", pool, name, fstype)
+	if err := d.formatDevice(pool, name, device, fstype, key, true); err != nil {
+		return err
+	}
+	if err := d.removeImageMeta(pool, name, formatPendingImageMetaKey); err != nil {
+		return fmt.Errorf("error marking RBD Image %s/%s as formatted: %s", pool, name, err)
+	}
+	logrus.Infof("RBD Image %s/%s formatted", pool, name)
+	return nil
+}
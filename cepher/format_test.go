@@ -0,0 +1,40 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFormatOption(t *testing.T) {
+	for value, expected := range map[string]bool{"": false, "on-create": false, "on-first-mount": true} {
+		lazy, err := parseFormatOption(value)
+		if err != nil || lazy != expected {
+			t.Errorf("expected %v for format '%s' but got %v %v", expected, value, lazy, err)
+		}
+	}
+	if _, err := parseFormatOption("later"); err == nil {
+		t.Fatal("expected error for invalid format option")
+	}
+}
+
+func TestMkfsArgs(t *testing.T) {
+	if args := mkfsArgs("ext4", "/dev/rbd0", true); !reflect.DeepEqual(args, []string{"-E", "nodiscard", "/dev/rbd0"}) {
+		t.Fatalf("unexpected ext4 args %v", args)
+	}
+	if args := mkfsArgs("xfs", "/dev/rbd0", true); !reflect.DeepEqual(args, []string{"-K", "/dev/rbd0"}) {
+		t.Fatalf("unexpected xfs args %v", args)
+	}
+	if args := mkfsArgs("xfs", "/dev/rbd0", false); !reflect.DeepEqual(args, []string{"/dev/rbd0"}) {
+		t.Fatalf("unexpected args %v", args)
+	}
+}
+
+func TestParseVolumeMetadataFormatPending(t *testing.T) {
+	meta := volumeMetadata{Options: make(map[string]string), Labels: make(map[string]string)}
+	if err := parseVolumeMetadata(`{"cepher.format-pending":"xfs","cepher.opt.format":"on-first-mount"}`, &meta); err != nil {
+		t.Fatal(err)
+	}
+	if meta.FormatPending != "xfs" || meta.Options["format"] != formatOnFirstMount {
+		t.Fatalf("unexpected metadata %+v", meta)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// healthCheckTimeout is the timeout of the periodic 'ceph health' command
+var healthCheckTimeout = 10 * time.Second
+
+// unreachableErrorRegexp matches the errors of Ceph commands that couldn't talk to the cluster
+var unreachableErrorRegexp = regexp.MustCompile(`(?i)(timed out|connection refused|error connecting to the cluster|no route to host|monclient.*authenticate)`)
+
+// clusterHealth tracks the Ceph cluster health and recent command failures. After breakerThreshold
+// consecutive failures to reach the cluster the circuit breaker opens and mutating requests fail
+// fast for breakerCooldown. Then one request is let through to probe the cluster again.
+// A nil clusterHealth allows everything
+type clusterHealth struct {
+	m                sync.Mutex
+	status           string            // HEALTH_OK, HEALTH_WARN or HEALTH_ERR
+	checks           map[string]string // failing health check name -> summary
+	checkedAt        time.Time
+	failures         int
+	lastFailure      string
+	openUntil        time.Time
+	breakerThreshold int
+	breakerCooldown  time.Duration
+}
+
+func newClusterHealth(threshold int, cooldown time.Duration) *clusterHealth {
+	if threshold <= 0 {
+		threshold = 1
+	}
+	return &clusterHealth{checks: make(map[string]string), breakerThreshold: threshold, breakerCooldown: cooldown}
+}
+
+// recordResult tracks the result of a command sent to the cluster. Errors that are not related
+// to reaching the cluster (like a missing image) don't count as failures
+func (h *clusterHealth) recordResult(err error) {
+	if h == nil {
+		return
+	}
+	h.m.Lock()
+	defer h.m.Unlock()
+	if err == nil {
+		if h.failures >= h.breakerThreshold {
+			logrus.Infof("Ceph cluster is reachable again. Closing circuit breaker")
+		}
+		h.failures = 0
+		h.openUntil = time.Time{}
+		return
+	}
+	if !isUnreachableError(err) {
+		return
+	}
+	h.failures++
+	h.lastFailure = err.Error()
+	if h.failures >= h.breakerThreshold {
+		if h.failures == h.breakerThreshold {
+			logrus.Warnf("Ceph cluster unreachable after %d consecutive failures. Opening circuit breaker for %s", h.failures, h.breakerCooldown)
+		}
+		h.openUntil = time.Now().Add(h.breakerCooldown)
+	}
+}
+
+func isUnreachableError(err error) bool {
+	if _, ok := err.(ShTimeoutError); ok {
+		return true
+	}
+	return err == errCephReadTimeout || unreachableErrorRegexp.MatchString(err.Error())
+}
+
+// update stores the result of a 'ceph health' check
+func (h *clusterHealth) update(status string, checks map[string]string) {
+	if h == nil {
+		return
+	}
+	h.m.Lock()
+	defer h.m.Unlock()
+	if status != h.status {
+		logrus.Infof("Ceph cluster health changed from '%s' to '%s' %v", h.status, status, checks)
+	}
+	h.status = status
+	h.checks = checks
+	h.checkedAt = time.Now()
+}
+
+// checkAvailable returns an error while the circuit breaker is open
+func (h *clusterHealth) checkAvailable(op string) error {
+	if h == nil {
+		return nil
+	}
+	h.m.Lock()
+	defer h.m.Unlock()
+	if !h.openUntil.IsZero() && time.Now().Before(h.openUntil) {
+		return fmt.Errorf("%s rejected: Ceph cluster unreachable (%d consecutive failures, last: %s). Retry after %s", op, h.failures, h.lastFailure, h.openUntil.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// checkWritable returns an error while the circuit breaker is open, the cluster is in HEALTH_ERR
+// or OSDs/pools are (near) full, when new data shouldn't be added
+func (h *clusterHealth) checkWritable(op string) error {
+	if err := h.checkAvailable(op); err != nil {
+		return err
+	}
+	if h == nil {
+		return nil
+	}
+	h.m.Lock()
+	defer h.m.Unlock()
+	if h.status == "HEALTH_ERR" {
+		return fmt.Errorf("%s rejected: Ceph cluster is in HEALTH_ERR: %s", op, h.describeChecks(""))
+	}
+	if full := h.describeChecks("FULL"); full != "" {
+		return fmt.Errorf("%s rejected: Ceph cluster is near full: %s", op, full)
+	}
+	return nil
+}
+
+// describeChecks returns the summaries of the failing health checks with names containing filter
+func (h *clusterHealth) describeChecks(filter string) string {
+	names := make([]string, 0)
+	for name := range h.checks {
+		if strings.Contains(name, filter) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	descriptions := make([]string, 0)
+	for _, name := range names {
+		descriptions = append(descriptions, fmt.Sprintf("%s (%s)", name, h.checks[name]))
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+// summary returns the health information shown in the volume status
+func (h *clusterHealth) summary() map[string]interface{} {
+	if h == nil {
+		return nil
+	}
+	h.m.Lock()
+	defer h.m.Unlock()
+	summary := map[string]interface{}{"status": h.status, "checks": h.checks}
+	if !h.checkedAt.IsZero() {
+		summary["checkedAt"] = h.checkedAt.Format(time.RFC3339)
+	}
+	if !h.openUntil.IsZero() && time.Now().Before(h.openUntil) {
+		summary["breakerOpenUntil"] = h.openUntil.Format(time.RFC3339)
+	}
+	return summary
+}
+
+// watchClusterHealth checks the cluster health periodically
+func (d *cephRBDVolumeDriver) watchClusterHealth(interval time.Duration) {
+	for {
+		d.checkClusterHealth()
+		if !d.sleepOrStop(interval) {
+			return
+		}
+	}
+}
+
+func (d *cephRBDVolumeDriver) checkClusterHealth() {
+	out, err := ExecShellTimeout(healthCheckTimeout, "ceph", "--conf", d.cephConfigFile, "--id", d.cephUser, "health", "--format", "json")
+	d.health.recordResult(err)
+	if err != nil {
+		logrus.Warnf("Ceph health check failed: %s", err)
+		return
+	}
+	status, checks, err := parseCephHealth(out)
+	if err != nil {
+		logrus.Warnf("%s", err)
+		return
+	}
+	d.health.update(status, checks)
+}
+
+// parseCephHealth parses the output of 'ceph health --format json'
+func parseCephHealth(out string) (string, map[string]string, error) {
+	var health struct {
+		Status string `json:"status"`
+		Checks map[string]struct {
+			Severity string `json:"severity"`
+			Summary  struct {
+				Message string `json:"message"`
+			} `json:"summary"`
+		} `json:"checks"`
+	}
+	if err := json.Unmarshal([]byte(out), &health); err != nil {
+		return "", nil, fmt.Errorf("error parsing ceph health output: %s", err)
+	}
+	checks := make(map[string]string)
+	for name, check := range health.Checks {
+		checks[name] = check.Summary.Message
+	}
+	return health.Status, checks, nil
+}
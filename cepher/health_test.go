@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	h := newClusterHealth(2, time.Minute)
+	h.recordResult(errors.New("rbd: error opening image myimage: (2) No such file or directory"))
+	h.recordResult(ShTimeoutError{timeout: time.Second})
+	if err := h.checkAvailable("mount"); err != nil {
+		t.Fatalf("expected breaker closed after a single unreachable failure but got %s", err)
+	}
+	h.recordResult(errors.New("Failed to run command: 'rbd ls'; exit=1; out=error connecting to the cluster"))
+	if err := h.checkAvailable("mount"); err == nil {
+		t.Fatal("expected breaker to be open")
+	}
+	h.recordResult(nil)
+	if err := h.checkAvailable("mount"); err != nil {
+		t.Fatalf("expected breaker closed after success but got %s", err)
+	}
+
+	// half open after the cooldown
+	h = newClusterHealth(1, time.Millisecond)
+	h.recordResult(ShTimeoutError{timeout: time.Second})
+	time.Sleep(5 * time.Millisecond)
+	if err := h.checkAvailable("mount"); err != nil {
+		t.Fatalf("expected a probe request after cooldown but got %s", err)
+	}
+
+	var nilHealth *clusterHealth
+	if err := nilHealth.checkWritable("create"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckWritable(t *testing.T) {
+	out := `{"checks":{"OSD_NEARFULL":{"severity":"HEALTH_WARN","summary":{"message":"1 nearfull osd(s)"}},"PG_DEGRADED":{"severity":"HEALTH_WARN","summary":{"message":"Degraded data redundancy"}}},"status":"HEALTH_WARN"}`
+	status, checks, err := parseCephHealth(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newClusterHealth(3, time.Minute)
+	h.update(status, checks)
+	err = h.checkWritable("create")
+	if err == nil || !strings.Contains(err.Error(), "1 nearfull osd(s)") || strings.Contains(err.Error(), "PG_DEGRADED") {
+		t.Fatalf("expected near full error but got %v", err)
+	}
+	if err := h.checkAvailable("remove"); err != nil {
+		t.Fatalf("expected remove to be allowed on near full cluster but got %s", err)
+	}
+
+	h.update("HEALTH_ERR", map[string]string{"MON_DOWN": "2/3 mons down"})
+	if err := h.checkWritable("create"); err == nil || !strings.Contains(err.Error(), "HEALTH_ERR") {
+		t.Fatalf("expected HEALTH_ERR error but got %v", err)
+	}
+	h.update("HEALTH_OK", map[string]string{})
+	if err := h.checkWritable("create"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExecShellTimeout(t *testing.T) {
+	_, err := ExecShellTimeout(time.Second, "sleep", "5")
+	if _, ok := err.(ShTimeoutError); !ok {
+		t.Fatalf("expected ShTimeoutError but got %v", err)
+	}
+}
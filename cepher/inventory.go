@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+	"github.com/sirupsen/logrus"
+)
+
+// errCephReadTimeout is returned when a read only request didn't complete within the ceph read timeout
+var errCephReadTimeout = errors.New("timeout waiting for the Ceph cluster")
+
+// inventory is a local copy of the known volumes and the local mounts, persisted to a file.
+// Read only requests (List, Get and Path) are served from it when the Ceph cluster doesn't respond,
+// so that Docker doesn't report errors for running containers during Ceph maintenance.
+// A nil inventory keeps nothing
+type inventory struct {
+	m         sync.Mutex
+	file      string
+	Volumes   map[string]*inventoryVolume `json:"volumes"`  // by volume name
+	Mounts    map[string]*Volume          `json:"mounts"`   // by mountpath
+	Creating  map[string]time.Time        `json:"creating"` // creates in progress, by volume name
+	Mapped    map[string]*mappedDevice    `json:"mapped"`   // devices mapped by the plugin, by device
+	UpdatedAt time.Time                   `json:"updatedAt"`
+}
+
+type inventoryVolume struct {
+	Volume    *volume.Volume `json:"volume"`
+	UpdatedAt time.Time      `json:"updatedAt"`
+}
+
+// loadInventory reads the inventory file. A new inventory is returned if the file doesn't exist
+func loadInventory(file string) (*inventory, error) {
+	inv := &inventory{file: file, Volumes: make(map[string]*inventoryVolume), Mounts: make(map[string]*Volume)}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return inv, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(data, inv); err != nil {
+		return nil, fmt.Errorf("error parsing inventory file %s: %s", file, err)
+	}
+	if inv.Volumes == nil {
+		inv.Volumes = make(map[string]*inventoryVolume)
+	}
+	if inv.Mounts == nil {
+		inv.Mounts = make(map[string]*Volume)
+	}
+	return inv, nil
+}
+
+// setVolumes replaces the known volumes with the result of a volume list. The details
+// previously stored by Get are kept for volumes without details in the list
+func (inv *inventory) setVolumes(vols []*volume.Volume) {
+	if inv == nil {
+		return
+	}
+	inv.m.Lock()
+	defer inv.m.Unlock()
+	now := time.Now()
+	volumes := make(map[string]*inventoryVolume)
+	for _, v := range vols {
+		if old, ok := inv.Volumes[v.Name]; ok && v.Status == nil && old.Volume.Status != nil {
+			c := *v
+			c.Status = old.Volume.Status
+			v = &c
+		}
+		volumes[v.Name] = &inventoryVolume{Volume: v, UpdatedAt: now}
+	}
+	inv.Volumes = volumes
+	inv.UpdatedAt = now
+	inv.save()
+}
+
+// setVolume stores the details of a volume returned by Get or created
+func (inv *inventory) setVolume(v *volume.Volume) {
+	if inv == nil {
+		return
+	}
+	inv.m.Lock()
+	defer inv.m.Unlock()
+	inv.Volumes[v.Name] = &inventoryVolume{Volume: v, UpdatedAt: time.Now()}
+	inv.UpdatedAt = time.Now()
+	inv.save()
+}
+
+func (inv *inventory) removeVolume(name string) {
+	if inv == nil {
+		return
+	}
+	inv.m.Lock()
+	defer inv.m.Unlock()
+	delete(inv.Volumes, name)
+	inv.UpdatedAt = time.Now()
+	inv.save()
+}
+
+// setMount records a local mount. A nil vol removes it
+func (inv *inventory) setMount(mountpath string, vol *Volume) {
+	if inv == nil {
+		return
+	}
+	inv.m.Lock()
+	defer inv.m.Unlock()
+	if vol == nil {
+		delete(inv.Mounts, mountpath)
+	} else {
+		inv.Mounts[mountpath] = vol
+	}
+	inv.UpdatedAt = time.Now()
+	inv.save()
+}
+
+// setMounts replaces the local mounts with the ones found in the host
+func (inv *inventory) setMounts(mounts map[string]*Volume) {
+	if inv == nil {
+		return
+	}
+	inv.m.Lock()
+	defer inv.m.Unlock()
+	inv.Mounts = make(map[string]*Volume)
+	for k, v := range mounts {
+		inv.Mounts[k] = v
+	}
+	inv.UpdatedAt = time.Now()
+	inv.save()
+}
+
+func (inv *inventory) hasMount(mountpath string) bool {
+	if inv == nil {
+		return false
+	}
+	inv.m.Lock()
+	defer inv.m.Unlock()
+	_, ok := inv.Mounts[mountpath]
+	return ok
+}
+
+// staleVolumes returns copies of the known volumes marked as stale
+func (inv *inventory) staleVolumes() ([]*volume.Volume, bool) {
+	if inv == nil {
+		return nil, false
+	}
+	inv.m.Lock()
+	defer inv.m.Unlock()
+	if inv.UpdatedAt.IsZero() {
+		return nil, false
+	}
+	vols := make([]*volume.Volume, 0)
+	for _, v := range inv.Volumes {
+		vols = append(vols, staleCopy(v))
+	}
+	return vols, true
+}
+
+// staleVolume returns a copy of a known volume marked as stale
+func (inv *inventory) staleVolume(name string) (*volume.Volume, bool) {
+	if inv == nil {
+		return nil, false
+	}
+	inv.m.Lock()
+	defer inv.m.Unlock()
+	v, ok := inv.Volumes[name]
+	if !ok {
+		return nil, false
+	}
+	return staleCopy(v), true
+}
+
+func staleCopy(v *inventoryVolume) *volume.Volume {
+	c := *v.Volume
+	c.Status = make(map[string]interface{})
+	for k, s := range v.Volume.Status {
+		c.Status[k] = s
+	}
+	c.Status["stale"] = true
+	c.Status["staleSince"] = v.UpdatedAt.Format(time.RFC3339)
+	return &c
+}
+
+// flush writes the inventory file, like before the plugin exits
+func (inv *inventory) flush() {
+	if inv == nil {
+		return
+	}
+	inv.m.Lock()
+	defer inv.m.Unlock()
+	inv.save()
+}
+
+// save writes the inventory file. Must be called with inv.m held
+func (inv *inventory) save() {
+	if inv.file == "" {
+		return
+	}
+	data, err := json.Marshal(inv)
+	if err != nil {
+		logrus.Warnf("error encoding inventory: %s", err)
+		return
+	}
+	if err := writeFileAtomic(inv.file, data, 0600); err != nil {
+		logrus.Warnf("error writing inventory file %s: %s", inv.file, err)
+	}
+}
+
+// withCephReadTimeout runs a read only request, returning errCephReadTimeout if it doesn't complete
+// within cephReadTimeout. The request keeps running in background, so it must be safe to abandon.
+// The timeout isn't recorded in the health breaker, as the request may be slow for other reasons
+// than Ceph. The Ceph commands it runs record their own failures and timeouts
+func (d *cephRBDVolumeDriver) withCephReadTimeout(fn func() (interface{}, error)) (interface{}, error) {
+	if d.cephReadTimeout <= 0 {
+		return fn()
+	}
+	type result struct {
+		value interface{}
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		value, err := fn()
+		done <- result{value, err}
+	}()
+	select {
+	case r := <-done:
+		return r.value, r.err
+	case <-time.After(d.cephReadTimeout):
+		return nil, errCephReadTimeout
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/go-plugins-helpers/volume"
+)
+
+func TestInventoryPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cepher-inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "inventory.json")
+
+	inv, err := loadInventory(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := inv.staleVolumes(); ok {
+		t.Fatal("expected no volumes in a new inventory")
+	}
+	inv.setVolume(&volume.Volume{Name: "volumes/a", Status: map[string]interface{}{"sizeBytes": 100}})
+	inv.setVolumes([]*volume.Volume{{Name: "volumes/a"}, {Name: "volumes/b"}})
+	inv.setMount("/mnt/cepher/volumes/a", &Volume{Pool: "volumes", Name: "a", Mountpath: "/mnt/cepher/volumes/a"})
+
+	inv, err = loadInventory(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vols, ok := inv.staleVolumes()
+	if !ok || len(vols) != 2 {
+		t.Fatalf("expected 2 volumes but got %v", vols)
+	}
+	v, ok := inv.staleVolume("volumes/a")
+	if !ok || v.Status["stale"] != true || v.Status["sizeBytes"] == nil {
+		t.Fatalf("expected stale volume with details from get but got %+v", v)
+	}
+	if !inv.hasMount("/mnt/cepher/volumes/a") {
+		t.Fatal("expected mount to be persisted")
+	}
+	inv.setMount("/mnt/cepher/volumes/a", nil)
+	inv.removeVolume("volumes/b")
+	if inv.hasMount("/mnt/cepher/volumes/a") {
+		t.Fatal("expected mount to be removed")
+	}
+	if _, ok := inv.staleVolume("volumes/b"); ok {
+		t.Fatal("expected volume to be removed")
+	}
+}
+
+func TestWithCephReadTimeout(t *testing.T) {
+	d := &cephRBDVolumeDriver{cephReadTimeout: 10 * time.Millisecond, health: newClusterHealth(1, time.Minute)}
+	if _, err := d.withCephReadTimeout(func() (interface{}, error) {
+		time.Sleep(time.Second)
+		return nil, nil
+	}); err != errCephReadTimeout {
+		t.Fatalf("expected timeout but got %v", err)
+	}
+	if err := d.health.checkAvailable("create"); err != nil {
+		t.Fatalf("expected read timeouts not to open the breaker but got %s", err)
+	}
+	value, err := d.withCephReadTimeout(func() (interface{}, error) {
+		return "ok", nil
+	})
+	if err != nil || value != "ok" {
+		t.Fatalf("expected result but got %v %v", value, err)
+	}
+}
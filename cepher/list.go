@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// imageListCache keeps the result of listing the images of all pools, filtered by listLabels, for
+// a short time, because Docker calls List often (e.g. for each 'docker volume ls'). A nil cache
+// caches nothing
+type imageListCache struct {
+	m       sync.Mutex
+	images  []string
+	expires time.Time
+}
+
+func (c *imageListCache) get() ([]string, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.images == nil || time.Now().After(c.expires) {
+		return nil, false
+	}
+	return c.images, true
+}
+
+func (c *imageListCache) set(images []string, ttl time.Duration) {
+	if c == nil || ttl <= 0 {
+		return
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.images = images
+	c.expires = time.Now().Add(ttl)
+}
+
+// invalidate must be called when images are created, removed or renamed
+func (c *imageListCache) invalidate() {
+	if c == nil {
+		return
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.images = nil
+}
+
+// listImagesFromAllPools lists the images of the RBD pools whose labels match listLabels. Trashed
+// images are not listed
+// returns array with 'poolName/imageName' items
+func (d *cephRBDVolumeDriver) listImagesFromAllPools() ([]string, error) {
+	if images, ok := d.imageListCache.get(); ok {
+		logrus.Debugf("Using cached image list")
+		return images, nil
+	}
+
+	pools, err := d.listPools()
+	if err != nil {
+		return nil, err
+	}
+
+	workers := d.listWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	var m sync.Mutex
+	poolImages := make(map[string][]string)
+	errs := make([]string, 0)
+	for _, pool := range pools {
+		wg.Add(1)
+		go func(pool string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			images, err := d.rbdPoolImageList(pool)
+			m.Lock()
+			defer m.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("pool %s: %s", pool, err))
+				return
+			}
+			poolImages[pool] = images
+		}(pool)
+	}
+	wg.Wait()
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("error listing images: %s", strings.Join(errs, "; "))
+	}
+
+	allImages := make([]string, 0)
+	for _, pool := range pools {
+		for _, image := range poolImages[pool] {
+			if isTrashImageName(image) || isWarmImageName(image) {
+				continue
+			}
+			allImages = append(allImages, fmt.Sprintf("%s/%s", pool, image))
+		}
+	}
+	allImages = d.filterImagesByLabels(allImages)
+	d.imageListCache.set(allImages, d.listCacheTTL)
+	return allImages, nil
+}
+
+// listPools returns the pools whose images are listed as volumes: the allowlist in listPoolNames or the
+// replicated pools with the rbd application enabled. The default pool is always listed
+func (d *cephRBDVolumeDriver) listPools() ([]string, error) {
+	pools := make([]string, 0)
+	if d.listPoolNames != "" {
+		for _, pool := range strings.Split(d.listPoolNames, ",") {
+			if pool = strings.TrimSpace(pool); pool != "" {
+				pools = append(pools, pool)
+			}
+		}
+	} else {
+		rbdPools, err := rbdPools()
+		if err != nil {
+			return nil, err
+		}
+		pools = rbdPools
+	}
+	for _, pool := range pools {
+		if pool == d.defaultCephPool {
+			return pools, nil
+		}
+	}
+	return append(pools, d.defaultCephPool), nil
+}
+
+// rbdPools returns the replicated pools with the rbd application enabled. Erasure coded pools
+// only hold data of images in other pools and CephFS/RGW pools don't have RBD Images
+func rbdPools() ([]string, error) {
+	result, err := ExecShellTimeout(listShellTimeout, "ceph", "osd", "pool", "ls", "detail", "--format", "json")
+	if err != nil {
+		return nil, err
+	}
+	return parseRBDPools(result)
+}
+
+func parseRBDPools(poolsDetail string) ([]string, error) {
+	var pools []struct {
+		Name                string                     `json:"pool_name"`
+		Type                int                        `json:"type"`
+		ApplicationMetadata map[string]json.RawMessage `json:"application_metadata"`
+	}
+	if err := json.Unmarshal([]byte(poolsDetail), &pools); err != nil {
+		return nil, err
+	}
+	rbd := make([]string, 0)
+	for _, p := range pools {
+		// type 3 is erasure
+		if p.Type == 3 {
+			continue
+		}
+		if _, ok := p.ApplicationMetadata["rbd"]; ok {
+			rbd = append(rbd, p.Name)
+		}
+	}
+	sort.Strings(rbd)
+	return rbd, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRBDPools(t *testing.T) {
+	detail := `[
+		{"pool_name":"volumes","type":1,"application_metadata":{"rbd":{}}},
+		{"pool_name":"ecdata","type":3,"application_metadata":{"rbd":{}}},
+		{"pool_name":"cephfs_data","type":1,"application_metadata":{"cephfs":{"data":"cephfs"}}},
+		{"pool_name":".rgw.root","type":1,"application_metadata":{"rgw":{}}},
+		{"pool_name":"backups","type":1,"application_metadata":{"rbd":{}}}
+	]`
+	pools, err := parseRBDPools(detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pools, []string{"backups", "volumes"}) {
+		t.Fatalf("expected only replicated rbd pools but got %v", pools)
+	}
+}
+
+func TestListPoolsAllowlist(t *testing.T) {
+	d := &cephRBDVolumeDriver{defaultCephPool: "volumes", listPoolNames: "fast, slow"}
+	pools, err := d.listPools()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(pools, []string{"fast", "slow", "volumes"}) {
+		t.Fatalf("expected allowlisted pools and the default pool but got %v", pools)
+	}
+}
+
+func TestIsTrashImageName(t *testing.T) {
+	for name, trash := range map[string]bool{"trash_0_myimage": true, "trash_12_my_image": true, "myimage": false, "trash_myimage": false, "trashy": false} {
+		if isTrashImageName(name) != trash {
+			t.Fatalf("expected isTrashImageName(%s) to be %v", name, trash)
+		}
+	}
+}
+
+func TestImageListCache(t *testing.T) {
+	c := &imageListCache{}
+	if _, ok := c.get(); ok {
+		t.Fatal("expected empty cache")
+	}
+	c.set([]string{"volumes/a"}, time.Minute)
+	if images, ok := c.get(); !ok || len(images) != 1 {
+		t.Fatalf("expected cached images but got %v", images)
+	}
+	c.invalidate()
+	if _, ok := c.get(); ok {
+		t.Fatal("expected invalidated cache")
+	}
+	c.set([]string{"volumes/a"}, time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if _, ok := c.get(); ok {
+		t.Fatal("expected expired cache")
+	}
+	var nilCache *imageListCache
+	nilCache.set([]string{"volumes/a"}, time.Minute)
+	if _, ok := nilCache.get(); ok {
+		t.Fatal("expected nil cache to cache nothing")
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// lockHolder describes who holds a lock. It is stored along with each acquired lock.
+// AcquiredAt is set by the lock implementation when the lock is acquired
+type lockHolder struct {
+	Hostname   string    `json:"hostname"`
+	NodeID     string    `json:"nodeId"`
+	CallerID   string    `json:"callerId,omitempty"`
+	Mode       string    `json:"mode"`  // 'ro' or 'rw'
+	Owner      string    `json:"owner"` // lock backend session/lease ID
+	Addresses  []string  `json:"addresses,omitempty"`
+	AcquiredAt time.Time `json:"acquiredAt"`
+}
+
+func (h lockHolder) String() string {
+	return fmt.Sprintf("host=%s node=%s caller=%s mode=%s owner=%s since=%s", h.Hostname, h.NodeID, h.CallerID, h.Mode, h.Owner, h.AcquiredAt.Format(time.RFC3339))
+}
+
+// lockSession tells when the lock backend session is lost, along with the locks held by it.
+// A nil lockSession is never lost
+type lockSession struct {
+	m    sync.Mutex
+	lost chan struct{}
+}
+
+func newLockSession() *lockSession {
+	return &lockSession{lost: make(chan struct{})}
+}
+
+// done returns a channel that is closed when the current session is lost
+func (s *lockSession) done() <-chan struct{} {
+	if s == nil {
+		return nil
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.lost
+}
+
+// markLost closes the channel of the lost session. Later calls to done track the next session
+func (s *lockSession) markLost() {
+	if s == nil {
+		return
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	close(s.lost)
+	s.lost = make(chan struct{})
+}
+
+// volumeLock is a distributed read/write lock over a single key
+type volumeLock interface {
+	// RLock acquires a shared lock. Will obey context for the deadline or canceling of lock acquirement
+	RLock(ctx context.Context) error
+	// RWLock acquires an exclusive lock. Will obey context for the deadline or canceling of lock acquirement
+	RWLock(ctx context.Context) error
+	// Unlock releases a previously acquired lock
+	Unlock() error
+}
+
+// lockProvider creates locks on a specific lock backend (etcd, consul, local file)
+type lockProvider interface {
+	// NewLock returns a lock for the given key. The lock is not acquired yet.
+	// holder is stored along with the lock while it is held
+	NewLock(key string, holder lockHolder) volumeLock
+	// Holders returns the current holders of the lock with the given key
+	Holders(key string) ([]lockHolder, error)
+	// Locks returns the keys of the locks currently held under prefix
+	Locks(prefix string) ([]string, error)
+	// ForceRelease releases the lock with the given key held by the owner
+	// session/lease, even if it belongs to another host. Releases it for all owners if owner is empty
+	ForceRelease(key string, owner string) error
+	// RequestRelease asks the current holders of the lock to release it as soon as possible.
+	// The request is withdrawn by calling the returned function
+	RequestRelease(key string, requester lockHolder) (func(), error)
+	// ReleaseRequests returns the pending release requests for the lock
+	ReleaseRequests(key string) ([]lockHolder, error)
+	// ID identifies the session/lease that owns the locks created by this provider
+	ID() string
+	// Close releases the backend session and all locks held by it
+	Close() error
+}
+
+// newLockProvider creates the lock provider selected by lockBackend.
+// onSessionLost is called whenever the backend session expires and all locks held by it are lost.
+// Returns nil without error when no lock backend is configured
+func (d *cephRBDVolumeDriver) newLockProvider(onSessionLost func()) (lockProvider, error) {
+	switch d.lockBackend {
+	case "", "etcd":
+		if d.lockEtcdServers == "" {
+			return nil, nil
+		}
+		logrus.Debugf("Using ETCD lock backend at %s", d.lockEtcdServers)
+		return newEtcdLockProvider(d.etcdClientConfig(), d.lockTimeoutMillis, onSessionLost)
+	case "consul":
+		if d.lockConsulServers == "" {
+			return nil, errors.New("lock-consul parameter is required for lock backend 'consul'")
+		}
+		logrus.Debugf("Using Consul lock backend at %s", d.lockConsulServers)
+		return newConsulLockProvider(d.lockConsulServers, d.lockTimeoutMillis, onSessionLost)
+	case "file":
+		if d.lockFileDir == "" {
+			return nil, errors.New("lock-file-dir parameter is required for lock backend 'file'")
+		}
+		logrus.Warnf("Using local file lock backend at %s. Locks are NOT shared between hosts", d.lockFileDir)
+		return newFileLockProvider(d.lockFileDir)
+	default:
+		return nil, fmt.Errorf("unknown lock backend '%s'. Options are 'etcd', 'consul' or 'file'", d.lockBackend)
+	}
+}
+
+// etcdClientConfig returns the ETCD connection settings of the driver
+func (d *cephRBDVolumeDriver) etcdClientConfig() etcdClientConfig {
+	return etcdClientConfig{
+		servers:     d.lockEtcdServers,
+		certFile:    d.lockEtcdCertFile,
+		keyFile:     d.lockEtcdKeyFile,
+		caFile:      d.lockEtcdCAFile,
+		username:    d.lockEtcdUsername,
+		password:    d.lockEtcdPassword,
+		prefix:      d.lockEtcdPrefix,
+		dialTimeout: d.lockEtcdDialTimeout,
+	}
+}
+
+// lockKeyFromEntry returns the lock key of a backend entry in the form [lock key]/read/[id] or [lock key]/write[/id]
+func lockKeyFromEntry(entry string) string {
+	if i := strings.LastIndex(entry, "/read/"); i > 0 {
+		return entry[:i]
+	}
+	if i := strings.LastIndex(entry, "/write"); i > 0 {
+		return entry[:i]
+	}
+	return ""
+}
+
+// uniqueLockKeys returns the sorted lock keys of the given backend entries
+func uniqueLockKeys(entries []string) []string {
+	found := make(map[string]bool)
+	keys := make([]string, 0)
+	for _, e := range entries {
+		key := lockKeyFromEntry(e)
+		if key != "" && !found[key] {
+			found[key] = true
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// newLockHolder returns the holder description for a lock acquired by this host
+func (d *cephRBDVolumeDriver) newLockHolder(callerID string, readonly bool) lockHolder {
+	mode := "rw"
+	if readonly {
+		mode = "ro"
+	}
+	return lockHolder{
+		Hostname:  d.hostname,
+		NodeID:    d.nodeID,
+		CallerID:  callerID,
+		Mode:      mode,
+		Owner:     d.locks.ID(),
+		Addresses: d.hostAddresses,
+	}
+}
+
+// describeLockHolders returns a human readable description of the current holders of a lock
+func (d *cephRBDVolumeDriver) describeLockHolders(key string) string {
+	holders, err := d.locks.Holders(key)
+	if err != nil {
+		return fmt.Sprintf("unknown lock holders (%s)", err)
+	}
+	if len(holders) == 0 {
+		return "no lock holders found"
+	}
+	desc := make([]string, 0)
+	for _, h := range holders {
+		desc = append(desc, h.String())
+	}
+	return "lock held by [" + strings.Join(desc, "; ") + "]"
+}
+
+// defaultLockWait is the lock-wait used when none is configured
+const defaultLockWait = "10s"
+
+// failFastLockWait is how long a lock is waited for with lock-wait=fail-fast
+const failFastLockWait = 1 * time.Second
+
+// lockWaitImageMetaKey is the RBD Image metadata key where the volume lock-wait option is stored
+const lockWaitImageMetaKey = "cepher.lock-wait"
+
+// parseLockWait parses a lock-wait setting: 'fail-fast', 'wait' (waits until the lock is
+// acquired, returned as 0) or a duration like '30s'
+func parseLockWait(value string) (time.Duration, error) {
+	switch value {
+	case "fail-fast":
+		return failFastLockWait, nil
+	case "wait":
+		return 0, nil
+	}
+	wait, err := time.ParseDuration(value)
+	if err != nil || wait <= 0 {
+		return 0, fmt.Errorf("invalid lock-wait '%s'. Options are 'fail-fast', 'wait' or a positive duration like '30s'", value)
+	}
+	return wait, nil
+}
+
+// lockWaitContext returns a context for acquiring a lock within wait. A zero wait never expires
+func lockWaitContext(wait time.Duration) (context.Context, context.CancelFunc) {
+	if wait == 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), wait)
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// consulLockProvider uses Consul sessions for distributed RW locks.
+// All keys acquired by the session are deleted by Consul when the session is invalidated
+type consulLockProvider struct {
+	servers []string
+	client  *http.Client
+	ttl     time.Duration
+	m       sync.RWMutex
+	session string
+	closed  bool
+}
+
+type consulKVEntry struct {
+	Key         string `json:"Key"`
+	Session     string `json:"Session"`
+	Value       []byte `json:"Value"`
+	ModifyIndex uint64 `json:"ModifyIndex"`
+}
+
+func newConsulLockProvider(servers string, lockTimeoutMillis uint64, onSessionLost func()) (*consulLockProvider, error) {
+	logrus.Debugf("Setting up Consul client to %s", servers)
+	p := &consulLockProvider{
+		client: &http.Client{},
+		ttl:    time.Duration(lockTimeoutMillis) * time.Millisecond,
+	}
+	for _, s := range strings.Split(servers, ",") {
+		if !strings.HasPrefix(s, "http://") && !strings.HasPrefix(s, "https://") {
+			s = "http://" + s
+		}
+		p.servers = append(p.servers, strings.TrimSuffix(s, "/"))
+	}
+	// consul doesn't accept session TTLs lower than 10s
+	if p.ttl < 10*time.Second {
+		p.ttl = 10 * time.Second
+	}
+
+	logrus.Debugf("Creating Consul Lock Session")
+	session, err := p.createSession()
+	if err != nil {
+		return nil, err
+	}
+	p.session = session
+	logrus.Debugf("Consul lock session ok %s", session)
+
+	// starts routine to renew the session and to recover it when it is invalidated
+	go func() {
+		for {
+			time.Sleep(p.ttl / 3)
+			if p.isClosed() {
+				return
+			}
+			err := p.renewSession()
+			if err == nil {
+				continue
+			}
+			logrus.Errorf("Consul session renew failed: %s", err)
+			if onSessionLost != nil {
+				onSessionLost()
+			}
+			for {
+				time.Sleep(time.Second * 10)
+				logrus.Debugf("recreating Consul session")
+				session, err := p.createSession()
+				if err != nil {
+					logrus.Debugf("error recreating Consul session: %s", err.Error())
+					continue
+				}
+				p.m.Lock()
+				p.session = session
+				p.m.Unlock()
+				logrus.Debugf("Consul session recreated %s", session)
+				break
+			}
+		}
+	}()
+
+	return p, nil
+}
+
+func (p *consulLockProvider) currentSession() string {
+	p.m.RLock()
+	defer p.m.RUnlock()
+	return p.session
+}
+
+func (p *consulLockProvider) isClosed() bool {
+	p.m.RLock()
+	defer p.m.RUnlock()
+	return p.closed
+}
+
+func (p *consulLockProvider) NewLock(key string, holder lockHolder) volumeLock {
+	return &consulRWMutex{p: p, pfx: strings.TrimPrefix(key, "/") + "/", holder: holder}
+}
+
+func (p *consulLockProvider) Holders(key string) ([]lockHolder, error) {
+	return p.getHolders(strings.TrimPrefix(key, "/") + "/")
+}
+
+func (p *consulLockProvider) RequestRelease(key string, requester lockHolder) (func(), error) {
+	requestKey := fmt.Sprintf("cepher-release/%s/%s", strings.TrimPrefix(key, "/"), uuid.New().String())
+	ok, err := p.acquire(context.Background(), requestKey, requester)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("couldn't acquire release request key %s", requestKey)
+	}
+	return func() {
+		if err := p.deleteKey(requestKey); err != nil {
+			logrus.Warnf("error deleting release request %s: %s", requestKey, err)
+		}
+	}, nil
+}
+
+func (p *consulLockProvider) ReleaseRequests(key string) ([]lockHolder, error) {
+	return p.getHolders("cepher-release/" + strings.TrimPrefix(key, "/") + "/")
+}
+
+// getHolders returns the holders stored as JSON values in the held keys under prefix
+func (p *consulLockProvider) getHolders(prefix string) ([]lockHolder, error) {
+	entries, _, err := p.list(context.Background(), prefix, 0)
+	if err != nil {
+		return nil, err
+	}
+	holders := make([]lockHolder, 0)
+	for _, e := range entries {
+		var holder lockHolder
+		if err := json.Unmarshal(e.Value, &holder); err != nil {
+			logrus.Warnf("ignoring invalid lock holder at %s: %s", e.Key, err)
+			continue
+		}
+		holders = append(holders, holder)
+	}
+	return holders, nil
+}
+
+func (p *consulLockProvider) Locks(prefix string) ([]string, error) {
+	entries, _, err := p.list(context.Background(), strings.TrimPrefix(prefix, "/"), 0)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0)
+	for _, e := range entries {
+		keys = append(keys, "/"+e.Key)
+	}
+	return uniqueLockKeys(keys), nil
+}
+
+func (p *consulLockProvider) ForceRelease(key string, owner string) error {
+	entries, _, err := p.list(context.Background(), strings.TrimPrefix(key, "/")+"/", 0)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if owner != "" && e.Session != owner {
+			continue
+		}
+		logrus.Infof("Deleting lock key %s owned by session %s", e.Key, e.Session)
+		if err := p.deleteKey(e.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *consulLockProvider) ID() string {
+	return p.currentSession()
+}
+
+func (p *consulLockProvider) Close() error {
+	p.m.Lock()
+	p.closed = true
+	p.m.Unlock()
+	_, _, err := p.call(context.Background(), "PUT", "/v1/session/destroy/"+p.currentSession(), nil, nil)
+	return err
+}
+
+func (p *consulLockProvider) createSession() (string, error) {
+	hostname, _ := os.Hostname()
+	body := map[string]string{
+		"Name":      fmt.Sprintf("cepher-%s", hostname),
+		"TTL":       fmt.Sprintf("%ds", int(p.ttl.Seconds())),
+		"Behavior":  "delete",
+		"LockDelay": "0s",
+	}
+	resp, _, err := p.call(context.Background(), "PUT", "/v1/session/create", nil, body)
+	if err != nil {
+		return "", err
+	}
+	var session struct {
+		ID string `json:"ID"`
+	}
+	if err := json.Unmarshal(resp, &session); err != nil {
+		return "", err
+	}
+	return session.ID, nil
+}
+
+func (p *consulLockProvider) renewSession() error {
+	_, _, err := p.call(context.Background(), "PUT", "/v1/session/renew/"+p.currentSession(), nil, nil)
+	return err
+}
+
+// acquire tries to acquire key for the current session storing value in it. Returns false if it is held by another session
+func (p *consulLockProvider) acquire(ctx context.Context, key string, value interface{}) (bool, error) {
+	resp, _, err := p.call(ctx, "PUT", "/v1/kv/"+key, url.Values{"acquire": {p.currentSession()}}, value)
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(string(resp)) == "true", nil
+}
+
+func (p *consulLockProvider) deleteKey(key string) error {
+	_, _, err := p.call(context.Background(), "DELETE", "/v1/kv/"+key, nil, nil)
+	return err
+}
+
+// list returns the keys under prefix that are currently held by a session.
+// If index is greater than zero, blocks until the prefix changes after index or ctx is done
+func (p *consulLockProvider) list(ctx context.Context, prefix string, index uint64) ([]consulKVEntry, uint64, error) {
+	params := url.Values{"recurse": {"true"}}
+	if index > 0 {
+		wait := 30 * time.Second
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < wait {
+			wait = time.Until(deadline)
+			if wait <= 0 {
+				return nil, 0, context.DeadlineExceeded
+			}
+		}
+		params.Set("index", strconv.FormatUint(index, 10))
+		params.Set("wait", fmt.Sprintf("%dms", wait.Nanoseconds()/int64(time.Millisecond)))
+	}
+	resp, header, err := p.call(ctx, "GET", "/v1/kv/"+prefix, params, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	newIndex, _ := strconv.ParseUint(header.Get("X-Consul-Index"), 10, 64)
+	if resp == nil {
+		return nil, newIndex, nil
+	}
+	var entries []consulKVEntry
+	if err := json.Unmarshal(resp, &entries); err != nil {
+		return nil, 0, err
+	}
+	held := make([]consulKVEntry, 0)
+	for _, e := range entries {
+		if e.Session != "" {
+			held = append(held, e)
+		}
+	}
+	return held, newIndex, nil
+}
+
+// call performs a Consul HTTP API call, trying each server in order. A 404 response returns nil body without error
+func (p *consulLockProvider) call(ctx context.Context, method, path string, params url.Values, body interface{}) ([]byte, http.Header, error) {
+	var lastErr error
+	for _, server := range p.servers {
+		u := server + path
+		if len(params) > 0 {
+			u = u + "?" + params.Encode()
+		}
+		var reader io.Reader
+		if body != nil {
+			b, err := json.Marshal(body)
+			if err != nil {
+				return nil, nil, err
+			}
+			reader = bytes.NewReader(b)
+		}
+		req, err := http.NewRequest(method, u, reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		resp, err := p.client.Do(req.WithContext(ctx))
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, nil, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode == http.StatusNotFound && method == "GET" {
+			return nil, resp.Header, nil
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, nil, fmt.Errorf("consul %s %s returned status %d: %s", method, path, resp.StatusCode, strings.TrimSpace(string(data)))
+		}
+		return data, resp.Header, nil
+	}
+	return nil, nil, lastErr
+}
+
+// consulRWMutex is a writer preferring RW lock over Consul KV.
+// Writers hold the key [prefix]write and readers hold the keys [prefix]read/[uuid]
+type consulRWMutex struct {
+	p      *consulLockProvider
+	pfx    string
+	holder lockHolder
+	myKey  string
+}
+
+func (rwm *consulRWMutex) RLock(ctx context.Context) error {
+	writeKey := rwm.pfx + "write"
+	var index uint64
+	for {
+		// wait until no writer holds the lock
+		entries, newIndex, err := rwm.p.list(ctx, writeKey, index)
+		if err != nil {
+			return err
+		}
+		index = newIndex
+		if len(entries) > 0 {
+			continue
+		}
+
+		key := rwm.pfx + "read/" + uuid.New().String()
+		rwm.holder.AcquiredAt = time.Now().UTC()
+		ok, err := rwm.p.acquire(ctx, key, rwm.holder)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("couldn't acquire read key %s", key)
+		}
+
+		// a writer may have acquired the lock meanwhile. back off in this case
+		entries, _, err = rwm.p.list(ctx, writeKey, 0)
+		if err != nil || len(entries) > 0 {
+			if dErr := rwm.p.deleteKey(key); dErr != nil {
+				logrus.Warnf("error deleting read key %s from consul: %s", key, dErr)
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		rwm.myKey = key
+		return nil
+	}
+}
+
+func (rwm *consulRWMutex) RWLock(ctx context.Context) error {
+	writeKey := rwm.pfx + "write"
+	var index uint64
+	for {
+		rwm.holder.AcquiredAt = time.Now().UTC()
+		ok, err := rwm.p.acquire(ctx, writeKey, rwm.holder)
+		if err != nil {
+			return err
+		}
+		if ok {
+			break
+		}
+		_, index, err = rwm.p.list(ctx, writeKey, index)
+		if err != nil {
+			return err
+		}
+	}
+
+	// wait for the current readers to go away
+	index = 0
+	for {
+		readers, newIndex, err := rwm.p.list(ctx, rwm.pfx+"read/", index)
+		if err != nil {
+			if dErr := rwm.p.deleteKey(writeKey); dErr != nil {
+				return fmt.Errorf("error getting lock: %s; error deleting key %s from consul: %s", err, writeKey, dErr)
+			}
+			return err
+		}
+		if len(readers) == 0 {
+			break
+		}
+		index = newIndex
+	}
+	rwm.myKey = writeKey
+	return nil
+}
+
+func (rwm *consulRWMutex) Unlock() error {
+	if rwm.myKey == "" {
+		return errors.New("lock cannot be released because it was not acquired yet")
+	}
+	if err := rwm.p.deleteKey(rwm.myKey); err != nil {
+		return err
+	}
+	rwm.myKey = ""
+	return nil
+}
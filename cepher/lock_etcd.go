@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/concurrency"
+	"github.com/coreos/etcd/clientv3/namespace"
+	"github.com/coreos/etcd/pkg/transport"
+	"github.com/flaviostutz/etcd-lock/etcdlock"
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// lock holders are stored apart from the lock keys, because every key under
+// the lock prefix blocks write locks
+const etcdLockHoldersPrefix = "/cepher-holders"
+
+const etcdReleaseRequestsPrefix = "/cepher-release"
+
+// etcdClientConfig describes how to connect to the ETCD cluster
+type etcdClientConfig struct {
+	servers     string
+	certFile    string
+	keyFile     string
+	caFile      string
+	username    string
+	password    string
+	prefix      string // all keys are stored under this prefix, so that many clusters can share one ETCD
+	dialTimeout time.Duration
+}
+
+// newEtcdClient creates an ETCD client with optional TLS, authentication and key prefix
+func newEtcdClient(c etcdClientConfig) (*clientv3.Client, error) {
+	logrus.Debugf("Setting up ETCD client to %s", c.servers)
+	endpoints := strings.Split(c.servers, ",")
+	config := clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: c.dialTimeout,
+		Username:    c.username,
+		Password:    c.password,
+	}
+
+	if c.certFile != "" || c.keyFile != "" || c.caFile != "" {
+		if (c.certFile == "") != (c.keyFile == "") {
+			return nil, fmt.Errorf("both ETCD client certificate and key files must be set")
+		}
+		tlsInfo := transport.TLSInfo{
+			CertFile:      c.certFile,
+			KeyFile:       c.keyFile,
+			TrustedCAFile: c.caFile,
+		}
+		tlsConfig, err := tlsInfo.ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("error loading ETCD TLS configuration: %s", err)
+		}
+		config.TLS = tlsConfig
+	} else {
+		for _, e := range endpoints {
+			if strings.HasPrefix(e, "https://") {
+				// use system CAs
+				config.TLS = &tls.Config{}
+				break
+			}
+		}
+	}
+	if c.username != "" && config.TLS == nil {
+		logrus.Warnf("ETCD authentication is enabled without TLS. Credentials are sent in plaintext")
+	}
+
+	cli, err := clientv3.New(config)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := normalizeEtcdPrefix(c.prefix)
+	if prefix != "" {
+		logrus.Debugf("Using ETCD key prefix %s", prefix)
+		cli.KV = namespace.NewKV(cli.KV, prefix)
+		cli.Watcher = namespace.NewWatcher(cli.Watcher, prefix)
+		cli.Lease = namespace.NewLease(cli.Lease, prefix)
+	}
+	logrus.Debugf("ETCD client initiated")
+	return cli, nil
+}
+
+// normalizeEtcdPrefix returns the prefix in the form /a/b, or "" for no prefix
+func normalizeEtcdPrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return ""
+	}
+	return "/" + prefix
+}
+
+// etcdLockProvider uses etcd leases for distributed RW locks
+type etcdLockProvider struct {
+	client  *clientv3.Client
+	ttl     int
+	m       sync.RWMutex
+	session *concurrency.Session
+	closed  bool
+}
+
+func newEtcdLockProvider(config etcdClientConfig, lockTimeoutMillis uint64, onSessionLost func()) (*etcdLockProvider, error) {
+	cli, err := newEtcdClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &etcdLockProvider{
+		client: cli,
+		ttl:    int(lockTimeoutMillis / 1000),
+	}
+
+	logrus.Debugf("Creating ETCD Lock Session")
+	p.session, err = concurrency.NewSession(cli, concurrency.WithTTL(p.ttl))
+	if err != nil {
+		return nil, err
+	}
+	logrus.Debugf("ETCD lock session ok %v", p.session)
+
+	// starts routine to recover session when lease is orphaned, expires, or is otherwise no longer being refreshed.
+	go func() {
+		for {
+			<-p.currentSession().Done()
+			if p.isClosed() {
+				return
+			}
+			logrus.Errorf("ETCD session channel was closed")
+			if onSessionLost != nil {
+				onSessionLost()
+			}
+			for {
+				time.Sleep(time.Second * 10)
+				logrus.Debugf("recreating ETCD session")
+				session, err := concurrency.NewSession(cli, concurrency.WithTTL(p.ttl))
+				if err != nil {
+					logrus.Debugf("error recreating ETCD session: %s", err.Error())
+					continue
+				}
+				p.m.Lock()
+				p.session = session
+				p.m.Unlock()
+				logrus.Debugf("ETCD session recreated %v", session)
+				break
+			}
+		}
+	}()
+
+	return p, nil
+}
+
+func (p *etcdLockProvider) currentSession() *concurrency.Session {
+	p.m.RLock()
+	defer p.m.RUnlock()
+	return p.session
+}
+
+func (p *etcdLockProvider) isClosed() bool {
+	p.m.RLock()
+	defer p.m.RUnlock()
+	return p.closed
+}
+
+func (p *etcdLockProvider) NewLock(key string, holder lockHolder) volumeLock {
+	session := p.currentSession()
+	return &etcdRWMutex{
+		session: session,
+		mutex:   etcdlock.NewRWMutex(session, key),
+		key:     key,
+		holder:  holder,
+	}
+}
+
+func (p *etcdLockProvider) Holders(key string) ([]lockHolder, error) {
+	return p.getHolders(etcdLockHoldersPrefix + key + "/")
+}
+
+func (p *etcdLockProvider) RequestRelease(key string, requester lockHolder) (func(), error) {
+	value, err := json.Marshal(requester)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	session := p.currentSession()
+	requestKey := fmt.Sprintf("%s%s/%s", etcdReleaseRequestsPrefix, key, uuid.New().String())
+	if _, err := p.client.Put(ctx, requestKey, string(value), clientv3.WithLease(session.Lease())); err != nil {
+		return nil, err
+	}
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if _, err := p.client.Delete(ctx, requestKey); err != nil {
+			logrus.Warnf("error deleting release request %s: %s", requestKey, err)
+		}
+	}, nil
+}
+
+func (p *etcdLockProvider) ReleaseRequests(key string) ([]lockHolder, error) {
+	return p.getHolders(etcdReleaseRequestsPrefix + key + "/")
+}
+
+// getHolders returns the holders stored as JSON values under prefix
+func (p *etcdLockProvider) getHolders(prefix string) ([]lockHolder, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := p.client.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	holders := make([]lockHolder, 0)
+	for _, kv := range resp.Kvs {
+		var holder lockHolder
+		if err := json.Unmarshal(kv.Value, &holder); err != nil {
+			logrus.Warnf("ignoring invalid lock holder at %s: %s", string(kv.Key), err)
+			continue
+		}
+		holders = append(holders, holder)
+	}
+	return holders, nil
+}
+
+func (p *etcdLockProvider) Locks(prefix string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := p.client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]string, 0)
+	for _, kv := range resp.Kvs {
+		entries = append(entries, string(kv.Key))
+	}
+	return uniqueLockKeys(entries), nil
+}
+
+func (p *etcdLockProvider) ForceRelease(key string, owner string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, prefix := range []string{key + "/", etcdLockHoldersPrefix + key + "/"} {
+		resp, err := p.client.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+		if err != nil {
+			return err
+		}
+		for _, kv := range resp.Kvs {
+			if owner != "" && fmt.Sprintf("%x", kv.Lease) != owner {
+				continue
+			}
+			logrus.Infof("Deleting lock key %s owned by lease %x", string(kv.Key), kv.Lease)
+			if _, err := p.client.Delete(ctx, string(kv.Key)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *etcdLockProvider) ID() string {
+	return fmt.Sprintf("%x", p.currentSession().Lease())
+}
+
+func (p *etcdLockProvider) Close() error {
+	p.m.Lock()
+	p.closed = true
+	p.m.Unlock()
+	if err := p.currentSession().Close(); err != nil {
+		return err
+	}
+	return p.client.Close()
+}
+
+// etcdRWMutex wraps etcdlock.RWMutex and keeps the holder description in a
+// separate key attached to the same session lease while the lock is held
+type etcdRWMutex struct {
+	session   *concurrency.Session
+	mutex     *etcdlock.RWMutex
+	key       string
+	holder    lockHolder
+	holderKey string
+}
+
+func (rwm *etcdRWMutex) RLock(ctx context.Context) error {
+	if err := rwm.mutex.RLock(ctx); err != nil {
+		return err
+	}
+	return rwm.putHolder(ctx)
+}
+
+func (rwm *etcdRWMutex) RWLock(ctx context.Context) error {
+	if err := rwm.mutex.RWLock(ctx); err != nil {
+		return err
+	}
+	return rwm.putHolder(ctx)
+}
+
+func (rwm *etcdRWMutex) putHolder(ctx context.Context) error {
+	rwm.holder.AcquiredAt = time.Now().UTC()
+	value, err := json.Marshal(rwm.holder)
+	if err != nil {
+		return err
+	}
+	holderKey := fmt.Sprintf("%s%s/%s", etcdLockHoldersPrefix, rwm.key, uuid.New().String())
+	if _, err := rwm.session.Client().Put(ctx, holderKey, string(value), clientv3.WithLease(rwm.session.Lease())); err != nil {
+		// holder information is informative only. keep the lock
+		logrus.Warnf("error storing lock holder for %s: %s", rwm.key, err)
+		return nil
+	}
+	rwm.holderKey = holderKey
+	return nil
+}
+
+func (rwm *etcdRWMutex) Unlock() error {
+	if err := rwm.mutex.Unlock(); err != nil {
+		return err
+	}
+	if rwm.holderKey != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if _, err := rwm.session.Client().Delete(ctx, rwm.holderKey); err != nil {
+			logrus.Warnf("error deleting lock holder %s: %s", rwm.holderKey, err)
+		}
+		rwm.holderKey = ""
+	}
+	return nil
+}
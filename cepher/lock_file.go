@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// fileLockProvider uses flock(2) on local files. Locks are visible only to
+// processes on the same host, so it is meant for single host/development setups
+type fileLockProvider struct {
+	dir string
+}
+
+func newFileLockProvider(dir string) (*fileLockProvider, error) {
+	err := os.MkdirAll(dir, os.ModeDir|os.FileMode(int(0700)))
+	if err != nil {
+		return nil, err
+	}
+	return &fileLockProvider{dir: filepath.Clean(dir)}, nil
+}
+
+func (p *fileLockProvider) lockPath(key string) string {
+	return filepath.Join(p.dir, filepath.Clean("/"+key)+".lock")
+}
+
+func (p *fileLockProvider) NewLock(key string, holder lockHolder) volumeLock {
+	return &fileRWMutex{path: p.lockPath(key), holder: holder}
+}
+
+func (p *fileLockProvider) Holders(key string) ([]lockHolder, error) {
+	return readHolderFiles(p.lockPath(key) + ".holders")
+}
+
+func (p *fileLockProvider) RequestRelease(key string, requester lockHolder) (func(), error) {
+	requestFile, err := writeHolderFile(p.lockPath(key)+".release", requester)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		os.Remove(requestFile)
+	}, nil
+}
+
+func (p *fileLockProvider) ReleaseRequests(key string) ([]lockHolder, error) {
+	return readHolderFiles(p.lockPath(key) + ".release")
+}
+
+// readHolderFiles returns the holders stored as JSON files in dir
+func readHolderFiles(holdersDir string) ([]lockHolder, error) {
+	holders := make([]lockHolder, 0)
+	files, err := ioutil.ReadDir(holdersDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return holders, nil
+		}
+		return nil, err
+	}
+	for _, f := range files {
+		data, err := ioutil.ReadFile(filepath.Join(holdersDir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var holder lockHolder
+		if err := json.Unmarshal(data, &holder); err != nil {
+			logrus.Warnf("ignoring invalid lock holder at %s: %s", f.Name(), err)
+			continue
+		}
+		holders = append(holders, holder)
+	}
+	return holders, nil
+}
+
+func (p *fileLockProvider) Locks(prefix string) ([]string, error) {
+	keys := make([]string, 0)
+	err := filepath.Walk(p.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, ".lock") {
+			return nil
+		}
+		key := strings.TrimSuffix(strings.TrimPrefix(path, p.dir), ".lock")
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		// lock files are kept after unlock. check if it is really held
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err == nil {
+			syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+			return nil
+		}
+		keys = append(keys, key)
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// ForceRelease removes the lock file so that new lockers use a fresh file. flocks
+// can't be released for a single owner, so all holders of the key lose the lock
+func (p *fileLockProvider) ForceRelease(key string, owner string) error {
+	if owner != "" {
+		holders, err := p.Holders(key)
+		if err != nil {
+			return err
+		}
+		found := false
+		for _, h := range holders {
+			if h.Owner == owner {
+				found = true
+			}
+		}
+		if !found {
+			logrus.Infof("No lock for %s held by %s found", key, owner)
+			return nil
+		}
+	}
+	path := p.lockPath(key)
+	logrus.Infof("Deleting lock file %s", path)
+	if err := os.RemoveAll(path + ".holders"); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (p *fileLockProvider) ID() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%s-%d", hostname, os.Getpid())
+}
+
+func (p *fileLockProvider) Close() error {
+	return nil
+}
+
+// fileRWMutex holds a shared (read) or exclusive (write) flock on a file while locked.
+// Holders are written to [lock file].holders/[uuid]
+type fileRWMutex struct {
+	path       string
+	holder     lockHolder
+	file       *os.File
+	holderFile string
+}
+
+func (rwm *fileRWMutex) RLock(ctx context.Context) error {
+	return rwm.lock(ctx, syscall.LOCK_SH)
+}
+
+func (rwm *fileRWMutex) RWLock(ctx context.Context) error {
+	return rwm.lock(ctx, syscall.LOCK_EX)
+}
+
+func (rwm *fileRWMutex) lock(ctx context.Context, how int) error {
+	err := os.MkdirAll(filepath.Dir(rwm.path), os.ModeDir|os.FileMode(int(0700)))
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(rwm.path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	for {
+		err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+		if err == nil {
+			rwm.file = file
+			rwm.putHolder(how == syscall.LOCK_EX)
+			return nil
+		}
+		if err != syscall.EWOULDBLOCK {
+			file.Close()
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			file.Close()
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// putHolder writes the holder file. An exclusive holder removes leftovers from crashed processes first
+func (rwm *fileRWMutex) putHolder(exclusive bool) {
+	holdersDir := rwm.path + ".holders"
+	if exclusive {
+		os.RemoveAll(holdersDir)
+	}
+	rwm.holder.AcquiredAt = time.Now().UTC()
+	holderFile, err := writeHolderFile(holdersDir, rwm.holder)
+	if err != nil {
+		logrus.Warnf("error storing lock holder for %s: %s", rwm.path, err)
+		return
+	}
+	rwm.holderFile = holderFile
+}
+
+// writeHolderFile stores holder as a new JSON file in dir and returns its path
+func writeHolderFile(dir string, holder lockHolder) (string, error) {
+	if err := os.MkdirAll(dir, os.ModeDir|os.FileMode(int(0700))); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(holder)
+	if err != nil {
+		return "", err
+	}
+	holderFile := filepath.Join(dir, uuid.New().String())
+	if err := ioutil.WriteFile(holderFile, data, 0600); err != nil {
+		return "", err
+	}
+	return holderFile, nil
+}
+
+func (rwm *fileRWMutex) Unlock() error {
+	if rwm.file == nil {
+		return errors.New("lock cannot be released because it was not acquired yet")
+	}
+	if rwm.holderFile != "" {
+		os.Remove(rwm.holderFile)
+		rwm.holderFile = ""
+	}
+	err := syscall.Flock(int(rwm.file.Fd()), syscall.LOCK_UN)
+	rwm.file.Close()
+	rwm.file = nil
+	return err
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestFileLockProvider(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cepher-locks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	p, err := newFileLockProvider(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const key = "/cepher-mount/volumes/image1"
+	holder := lockHolder{Hostname: "host1", NodeID: "node1", CallerID: "caller1", Mode: "ro"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	read1 := p.NewLock(key, holder)
+	if err := read1.RLock(ctx); err != nil {
+		t.Fatalf("first read lock error: %s", err)
+	}
+	read2 := p.NewLock(key, holder)
+	if err := read2.RLock(ctx); err != nil {
+		t.Fatalf("read locks must be shared but got error: %s", err)
+	}
+	holders, err := p.Holders(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(holders) != 2 || holders[0].Hostname != "host1" || holders[0].CallerID != "caller1" || holders[0].AcquiredAt.IsZero() {
+		t.Fatalf("expected two holders for host1/caller1 but got %v", holders)
+	}
+
+	wctx, wcancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer wcancel()
+	write := p.NewLock(key, holder)
+	if err := write.RWLock(wctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected write lock to time out while read locks are held but got %v", err)
+	}
+
+	if err := read1.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := read2.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if err := write.RWLock(ctx); err != nil {
+		t.Fatalf("expected write lock after read locks release but got %s", err)
+	}
+	if err := p.NewLock(key, holder).RLock(wctx); err == nil {
+		t.Fatal("expected read lock to fail while write lock is held")
+	}
+	if err := write.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	if holders, _ := p.Holders(key); len(holders) != 0 {
+		t.Fatalf("expected no holders after unlock but got %v", holders)
+	}
+	if err := write.Unlock(); err == nil {
+		t.Fatal("expected error unlocking a lock that is not held")
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLockWait(t *testing.T) {
+	cases := map[string]time.Duration{
+		"fail-fast": failFastLockWait,
+		"wait":      0,
+		"30s":       30 * time.Second,
+		"2m":        2 * time.Minute,
+	}
+	for value, expected := range cases {
+		wait, err := parseLockWait(value)
+		if err != nil {
+			t.Fatalf("unexpected error parsing %s: %s", value, err)
+		}
+		if wait != expected {
+			t.Fatalf("expected %v for %s but got %v", expected, value, wait)
+		}
+	}
+	for _, value := range []string{"", "forever", "-5s", "0s"} {
+		if _, err := parseLockWait(value); err == nil {
+			t.Fatalf("expected error parsing '%s'", value)
+		}
+	}
+}
+
+func TestNormalizeEtcdPrefix(t *testing.T) {
+	cases := map[string]string{
+		"":         "",
+		"/":        "",
+		"swarm1":   "/swarm1",
+		"/swarm1/": "/swarm1",
+		"/a/b":     "/a/b",
+	}
+	for prefix, expected := range cases {
+		if p := normalizeEtcdPrefix(prefix); p != expected {
+			t.Fatalf("expected '%s' for '%s' but got '%s'", expected, prefix, p)
+		}
+	}
+}
+
+func TestLockSession(t *testing.T) {
+	s := newLockSession()
+	lost := s.done()
+	s.markLost()
+	select {
+	case <-lost:
+	default:
+		t.Fatal("expected lost session to be done")
+	}
+	select {
+	case <-s.done():
+		t.Fatal("expected next session not to be done")
+	default:
+	}
+
+	var nilSession *lockSession
+	nilSession.markLost()
+	if nilSession.done() != nil {
+		t.Fatal("expected nil session never to be done")
+	}
+}
@@ -3,11 +3,18 @@
 package main
 
 import (
+	"encoding/base64"
 	"flag"
+	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
+	"github.com/docker/go-connections/sockets"
 	"github.com/docker/go-plugins-helpers/volume"
 	"github.com/sirupsen/logrus"
 	// "go-plugins-helpers/volume"
@@ -15,24 +22,177 @@ import (
 
 const VERSION = "1.1.1-beta"
 
+// envFlags maps the documented ENV configurations to flags. ENVs are used as the flag
+// values unless the flag is also set in the command line
+var envFlags = map[string]string{
+	"LOG_LEVEL":                    "loglevel",
+	"CEPH_CLUSTER_NAME":            "cluster",
+	"CEPH_USER":                    "user",
+	"CEPH_AUTH":                    "auth",
+	"MONITOR_HOSTS":                "monitors",
+	"CEPH_CONF_FILE":               "config-source",
+	"CEPH_KEYRING_FILE":            "keyring-source",
+	"MOUNT_PATH":                   "mount",
+	"DEFAULT_POOL_NAME":            "pool",
+	"DEFAULT_POOL_CREATE":          "pool-create",
+	"DEFAULT_POOL_PG_NUM":          "poolPgNum",
+	"DEFAULT_POOL_QUOTA_MAX_BYTES": "pool-quota-max-bytes",
+	"POOL_SIZE":                    "pool-size",
+	"POOL_MIN_SIZE":                "pool-min-size",
+	"POOL_CRUSH_RULE":              "pool-crush-rule",
+	"POOL_AUTOSCALE_MODE":          "pool-autoscale-mode",
+	"POOL_COMPRESSION_MODE":        "pool-compression-mode",
+	"POOL_QUOTA_MAX_OBJECTS":       "pool-quota-max-objects",
+	"ENABLE_AUTO_CREATE_VOLUMES":   "create",
+	"ENABLE_AUTO_CREATE_POOLS":     "create-pools",
+	"DEFAULT_IMAGE_SIZE":           "size",
+	"DEFAULT_IMAGE_FS":             "fs",
+	"DEFAULT_IMAGE_FEATURES":       "features",
+	"DEFAULT_IMAGE_DATA_POOL":      "data-pool",
+	"DATA_POOL_ERASURE_PROFILE":    "data-pool-erasure-profile",
+	"VOLUME_REMOVE_ACTION":         "remove-action",
+	"USE_RBD_KERNEL_MODULE":        "kernel-module",
+	"LOCK_BACKEND":                 "lock-backend",
+	"ETCD_URL":                     "lock-etcd",
+	"ETCD_CERT_FILE":               "lock-etcd-cert",
+	"ETCD_KEY_FILE":                "lock-etcd-key",
+	"ETCD_CA_FILE":                 "lock-etcd-ca",
+	"ETCD_USERNAME":                "lock-etcd-user",
+	"ETCD_PASSWORD":                "lock-etcd-password",
+	"ETCD_PREFIX":                  "lock-etcd-prefix",
+	"CONSUL_URL":                   "lock-consul",
+	"LOCK_WAIT":                    "lock-wait",
+	"LOCK_HANDOFF":                 "lock-handoff",
+	"CRYPT_KEY_PROVIDER":           "crypt-key-provider",
+	"CRYPT_KEY_FILE":               "crypt-key-file",
+	"CRYPT_KEY_URL":                "crypt-key-url",
+	"NODE_ID":                      "node-id",
+	"LIST_LABELS":                  "list-labels",
+	"LIST_POOLS":                   "list-pools",
+	"LIST_WORKERS":                 "list-workers",
+	"LIST_CACHE_TTL":               "list-cache-ttl",
+	"INVENTORY_FILE":               "inventory-file",
+	"CEPH_READ_TIMEOUT":            "ceph-read-timeout",
+	"HEALTH_CHECK_INTERVAL":        "health-check-interval",
+	"BREAKER_THRESHOLD":            "breaker-threshold",
+	"BREAKER_COOLDOWN":             "breaker-cooldown",
+	"TIMEOUT_DEFAULT":              "timeout",
+	"TIMEOUT_MAP":                  "timeout-map",
+	"TIMEOUT_MKFS":                 "timeout-mkfs",
+	"TIMEOUT_FSCK":                 "timeout-fsck",
+	"TIMEOUT_LIST":                 "timeout-list",
+	"MAX_IMAGE_SIZE":               "max-image-size",
+	"MAX_VOLUMES":                  "max-volumes",
+	"MAX_PROVISIONED":              "max-provisioned",
+	"OVERCOMMIT_RATIO":             "overcommit-ratio",
+	"POOL_LIMITS":                  "pool-limits",
+	"WARM_POOL":                    "warm-pool",
+	"WARM_POOL_INTERVAL":           "warm-pool-interval",
+	"RECONCILE_INTERVAL":           "reconcile-interval",
+	"ORPHAN_GRACE_PERIOD":          "orphan-grace-period",
+	"RECONCILE_FIX":                "reconcile-fix",
+	"DOCKER_SOCKET":                "docker-socket",
+	"METRICS_ADDR":                 "metrics-addr",
+	"DEVICE_HEALTH_INTERVAL":       "device-health-interval",
+	"DEVICE_CANARY_TIMEOUT":        "device-canary-timeout",
+	"DEVICE_RECOVERY":              "device-recovery",
+	"SHUTDOWN_TIMEOUT":             "shutdown-timeout",
+	"SHUTDOWN_LOCKS":               "shutdown-locks",
+}
+
+// envFileFlags maps base64 encoded ENVs to the file flags they are written for.
+// Managed plugins can't mount files, so certificates may be passed this way
+var envFileFlags = map[string]string{
+	"ETCD_CERT_BASE64": "lock-etcd-cert",
+	"ETCD_KEY_BASE64":  "lock-etcd-key",
+	"ETCD_CA_BASE64":   "lock-etcd-ca",
+}
+
 func main() {
 	versionFlag := flag.Bool("version", false, "Print version")
-	logLevel := flag.String("loglevel", "debug", "debug, info, warning, error")
-	cephCluster := flag.String("cluster", "", "Ceph cluster") // less likely to run multiple clusters on same hardware
+	logLevel := flag.String("loglevel", "info", "debug, info, warning, error")
+	cephCluster := flag.String("cluster", "ceph", "Ceph cluster") // less likely to run multiple clusters on same hardware
 	cephUser := flag.String("user", "admin", "Ceph user")
 	defaultCephPool := flag.String("pool", "volumes", "Default Ceph Pool for RBD operations")
+	createDefaultPool := flag.Bool("pool-create", true, "Create the default pool during initialization if it doesn't exist")
+	defaultPoolQuotaMaxBytes := flag.String("pool-quota-max-bytes", "", "Max bytes quota set on the default pool when it is created")
+	poolSize := flag.String("pool-size", "", "Number of replicas of the pools created by cepher. Defaults to the cluster default")
+	poolMinSize := flag.String("pool-min-size", "", "Minimum number of replicas for I/O of the pools created by cepher. Defaults to the cluster default")
+	poolCrushRule := flag.String("pool-crush-rule", "", "CRUSH rule of the pools created by cepher. Defaults to the cluster default")
+	poolAutoscaleMode := flag.String("pool-autoscale-mode", "", "PG autoscale mode of the pools created by cepher. 'on', 'off' or 'warn'")
+	poolCompressionMode := flag.String("pool-compression-mode", "", "Compression mode of the pools created by cepher. 'none', 'passive', 'aggressive' or 'force'")
+	poolQuotaMaxObjects := flag.String("pool-quota-max-objects", "", "Max objects quota of the pools created by cepher")
+	poolPrepareTimeout := flag.Duration("pool-prepare-timeout", 5*time.Minute, "How long to retry the default pool preparation while the Ceph monitors are unreachable")
 	rootMountDir := flag.String("mount", "/mnt/cepher", "Mount directory for volumes on host")
 	cephConfigFile := flag.String("config", "/etc/ceph/ceph.conf", "Ceph cluster config") // more likely to have config file pointing to cluster
+	cephConfigSrcFile := flag.String("config-source", "", "File to copy the Ceph cluster config from, like a Docker secret. Checked for changes periodically. The config may also come from the base64 CEPH_CONF_BASE64 env or the /[cluster]/ceph.conf ETCD key")
+	cephKeyringFile := flag.String("keyring", "/etc/ceph/keyring", "Ceph keyring file written by the plugin")
+	cephKeyringSrcFile := flag.String("keyring-source", "", "File to copy the Ceph keyring from, like a Docker secret. Checked for changes periodically. The keyring may also come from the base64 CEPH_KEYRING_BASE64 env or the /[cluster]/keyring ETCD key, which is watched for rotation")
+	cephMonitors := flag.String("monitors", "", "Comma separated list of Ceph monitor-ip:port. Used to generate the Ceph cluster config when no other config source is found")
+	cephAuth := flag.String("auth", "cephx", "Ceph auth for the generated Ceph cluster config. 'none' or 'cephx'")
 	canCreateVolumes := flag.Bool("create", false, "Can auto Create RBD Images")
 	canCreatePools := flag.Bool("create-pools", false, "Can auto Create RBD Pools")
-	defaultImageSizeMB := flag.Int("size", 3*1024, "RBD Image size to Create (in MB) (default: 3072=3GB)")
+	defaultImageSizeMB := flag.Int("size", 100, "RBD Image size to Create (in MB)")
 	defaultImageFSType := flag.String("fs", "xfs", "FS type for the created RBD Image (must have mkfs.type)")
-	defaultImageFeatures := flag.String("features", "layering,stripping,exclusive-lock,object-map", "Initial RBD Image features for new images")
+	defaultImageFeatures := flag.String("features", "layering,striping,exclusive-lock,object-map,fast-diff,journaling", "Initial RBD Image features for new images")
+	defaultDataPool := flag.String("data-pool", "", "Erasure coded pool for the data of new RBD Images. Image metadata stays in the image pool. Created if it doesn't exist and create-pools is enabled")
+	defaultDataPoolEC := flag.String("data-pool-erasure-profile", "default", "Erasure code profile used when creating data pools")
 	defaultRemoveAction := flag.String("remove-action", "rename", "Action to be performed when receiving a command to 'remove' a volume. Options are: 'ignore' (won't remove image from Ceph), 'delete' (will delete image from Ceph - irreversible!) or 'rename' (renames the corresponding Ceph Image to trash_[incremental counter]_[image name])")
 	defaultPoolPgNum := flag.String("poolPgNum", "100", "Number of PGs for the pools created by cepher (default: 100)")
 	useRBDKernelModule := flag.Bool("kernel-module", false, "If true, will use the Linux Kernel RBD module for mapping Ceph Images to block devices, which has greater performance, but currently supports only features 'layering', 'striping' and 'exclusive-lock'. Else, use rbd-nbd Ceph library (apt-get install rbd-nbd) which supports all Ceph image features available")
+	lockBackend := flag.String("lock-backend", "etcd", "Backend used for distributed lock management. Options are 'etcd', 'consul' or 'file' (single host only, for development)")
 	lockEtcdServers := flag.String("lock-etcd", "", "ETCD server addresses used for distributed lock management. ex.: 192.168.1.1:2379,192.168.1.2:2379")
-	lockTimeoutMillis := flag.Uint64("lock-timeout", 10*1000, "If a host with a mounted device stops sending lock refreshs, it will be release to another host to mount the image after this time")
+	lockEtcdCertFile := flag.String("lock-etcd-cert", "", "Client certificate file for TLS connections to ETCD")
+	lockEtcdKeyFile := flag.String("lock-etcd-key", "", "Client certificate key file for TLS connections to ETCD")
+	lockEtcdCAFile := flag.String("lock-etcd-ca", "", "CA bundle file used to verify the ETCD server certificates. Defaults to the system CAs")
+	lockEtcdUsername := flag.String("lock-etcd-user", "", "ETCD user name for authentication")
+	lockEtcdPassword := flag.String("lock-etcd-password", "", "ETCD user password. Prefer the ETCD_PASSWORD env, which is not shown in the process list")
+	lockEtcdPrefix := flag.String("lock-etcd-prefix", "", "Prefix for all keys stored in ETCD, so that many clusters can share the same ETCD. ex.: /swarm1")
+	lockEtcdDialTimeout := flag.Duration("lock-etcd-dial-timeout", 5*time.Second, "Timeout for connecting to ETCD")
+	lockConsulServers := flag.String("lock-consul", "", "Consul agent addresses used for distributed lock management when lock-backend is 'consul'. ex.: 192.168.1.1:8500,192.168.1.2:8500")
+	lockFileDir := flag.String("lock-file-dir", "/var/lib/cepher/locks", "Directory for lock files when lock-backend is 'file'")
+	lockTimeoutMillis := flag.Uint64("lock-timeout", 10*1000, "Lock session TTL. If a host with a mounted device stops sending lock refreshs, it will be release to another host to mount the image after this time")
+	lockWait := flag.String("lock-wait", defaultLockWait, "Default time to wait for a lock held by another host. 'fail-fast', 'wait' (until released) or a duration. Maybe overridden by the 'lock-wait' volume option")
+	lockHandoff := flag.Bool("lock-handoff", false, "Ask the holders of a mount lock to release it while waiting for it. Holders unmap the image before releasing the lock when its last container stops")
+	cryptKeyProvider := flag.String("crypt-key-provider", "", "Key provider for encrypted volumes. 'file' (keys derived from crypt-key-file), 'etcd' (random keys stored in lock-etcd) or 'http' (random keys stored in a key service at crypt-key-url). Encrypted volumes are disabled if empty")
+	cryptKeyFile := flag.String("crypt-key-file", "", "Master key file used by the 'file' key provider. Must have the same contents in all hosts")
+	cryptKeyURL := flag.String("crypt-key-url", "", "Base URL of the key service used by the 'http' key provider. Keys are stored with PUT, GET and DELETE [url]/[key id]. The bearer token is read from the CRYPT_KEY_TOKEN env")
+	listLabels := flag.String("list-labels", "", "Only list volumes with these labels. ex.: 'team=web,backup' lists volumes with label 'team' set to 'web' and any 'backup' label")
+	listPoolNames := flag.String("list-pools", "", "Comma separated pools whose images are listed as volumes. Defaults to the replicated pools with the rbd application enabled")
+	listWorkers := flag.Int("list-workers", 4, "Number of pools listed in parallel")
+	listCacheTTL := flag.Duration("list-cache-ttl", 5*time.Second, "Time the list of images is reused for volume list requests. 0 disables the cache")
+	inventoryFile := flag.String("inventory-file", "/var/lib/cepher/inventory.json", "File where the known volumes and local mounts are kept. Used for volume list, get and path requests when the Ceph cluster doesn't respond. Empty keeps it only in memory")
+	cephReadTimeout := flag.Duration("ceph-read-timeout", 5*time.Second, "Time to wait for the Ceph cluster on volume list, get and path requests before answering from the local inventory. 0 always waits")
+	healthCheckInterval := flag.Duration("health-check-interval", 30*time.Second, "Interval of the Ceph cluster health checks. Volume creation is rejected while the cluster is in HEALTH_ERR or near full. 0 disables the checks")
+	breakerThreshold := flag.Int("breaker-threshold", 3, "Consecutive failures to reach the Ceph cluster that open the circuit breaker. While open, create, remove and mount requests fail right away")
+	breakerCooldown := flag.Duration("breaker-cooldown", 30*time.Second, "Time the circuit breaker stays open before a request is let through to probe the cluster")
+	maxImageSize := flag.String("max-image-size", "", "Maximum size of new images in any pool, in MB or with a K, M, G, T or P suffix. ex.: 2T. Empty allows any size")
+	maxVolumes := flag.String("max-volumes", "", "Maximum number of volumes in any pool. Empty allows any number")
+	maxProvisioned := flag.String("max-provisioned", "", "Maximum sum of the image sizes in any pool, in MB or with a K, M, G, T or P suffix. Empty allows any size")
+	overcommitRatio := flag.String("overcommit-ratio", "3", "Times the sum of the image sizes may exceed the pool capacity and its bytes quota. Images are thin provisioned, so only written data uses space. 0 disables the check")
+	poolLimitsSpec := flag.String("pool-limits", "", "Per pool overrides of max-image-size, max-volumes, max-provisioned and overcommit-ratio. ex.: 'volumes:max-image-size=1T,max-volumes=100;fast:overcommit-ratio=1'")
+	warmPoolSpec := flag.String("warm-pool", "", "Profiles of pre-formatted images kept ready for volume creation. ex.: 'ci:pool=volumes,size=1024,fstype=ext4,features=layering+striping,count=3'. Profile settings default to the image defaults. Empty disables the warm pool")
+	warmPoolInterval := flag.Duration("warm-pool-interval", 30*time.Second, "Interval between warm pool refills")
+	reconcileInterval := flag.Duration("reconcile-interval", time.Minute, "Interval between checks for state left behind: empty mount directories, devices with no mount, mount locks of volumes not mounted and mounts not used by any container. 0 disables the checks")
+	orphanGracePeriod := flag.Duration("orphan-grace-period", 10*time.Minute, "Time a device, mount or mount lock may stay unused before the reconciler reports it")
+	reconcileFix := flag.String("reconcile-fix", findingOrphanDevice, "Kinds of findings fixed by the reconciler, comma separated: empty-mountdir, orphan-device, stale-lock, unreferenced-mount or 'all'. Other findings are only reported. Empty only reports")
+	dockerSocket := flag.String("docker-socket", "/var/run/docker.sock", "Docker Engine API socket, used to find mounts not used by any running container. The check is skipped if the socket doesn't exist")
+	deviceHealthInterval := flag.Duration("device-health-interval", 30*time.Second, "Interval between health checks of the mapped devices: rbd-nbd daemon and connection, and a canary read. 0 disables the checks")
+	deviceCanaryTimeout := flag.Duration("device-canary-timeout", 10*time.Second, "Time the canary read of a mapped device may take before the device is flagged unhealthy")
+	deviceRecovery := flag.Bool("device-recovery", true, "If true, rbd-nbd devices whose daemon died or disconnected are reattached to their image with 'rbd-nbd attach'")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 8*time.Second, "Time operations in progress may take to finish when the plugin is stopped. Keep it below the time Docker waits for plugins to stop")
+	shutdownLocks := flag.String("shutdown-locks", shutdownKeepLocks, "What happens to the locks of this host when the plugin is stopped: 'keep' leaves the session to expire, so volumes still mounted stay locked, 'release' closes the lock session, releasing them right away if no volume is still mounted, and 'handoff' unmounts the volumes requested by other hosts first")
+	metricsAddr := flag.String("metrics-addr", "", "Address of the HTTP server with Prometheus metrics at /metrics and the reconciler events at /events. ex.: ':9292'. Empty disables it")
+	flag.DurationVar(&defaultShellTimeout, "timeout", defaultShellTimeout, "Timeout of Ceph and shell commands without a specific timeout")
+	flag.DurationVar(&mapShellTimeout, "timeout-map", mapShellTimeout, "Timeout for mapping and unmapping images and opening encrypted devices")
+	flag.DurationVar(&mkfsShellTimeout, "timeout-mkfs", mkfsShellTimeout, "Timeout for formatting new images")
+	flag.DurationVar(&fsckShellTimeout, "timeout-fsck", fsckShellTimeout, "Timeout for checking filesystems before mounting")
+	flag.DurationVar(&listShellTimeout, "timeout-list", listShellTimeout, "Timeout for listing pools and images")
+	nodeID := flag.String("node-id", "", "Node identification stored along with the locks held by this host. Defaults to /etc/machine-id or the hostname")
+	if err := applyEnvFlags(); err != nil {
+		logrus.Errorf("%s", err)
+		os.Exit(1)
+	}
 	flag.Parse()
 
 	logrus.Infof("useRBDKernelModule=%v", *useRBDKernelModule)
@@ -54,33 +214,111 @@ func main() {
 	// 	return
 	// }
 
-	logrus.Infof("====Starting Cepher plugin version %s====", VERSION)
+	poolDefaults := poolOptions{
+		pgNum:           *defaultPoolPgNum,
+		size:            *poolSize,
+		minSize:         *poolMinSize,
+		crushRule:       *poolCrushRule,
+		autoscaleMode:   *poolAutoscaleMode,
+		compressionMode: *poolCompressionMode,
+		quotaMaxObjects: *poolQuotaMaxObjects,
+	}
 
 	driver := &cephRBDVolumeDriver{
 		cephCluster:          *cephCluster,
 		cephUser:             *cephUser,
 		defaultCephPool:      *defaultCephPool,
+		createDefaultPool:    *createDefaultPool,
+		defaultPoolQuota:     *defaultPoolQuotaMaxBytes,
+		poolPrepareTimeout:   *poolPrepareTimeout,
+		poolDefaults:         poolDefaults,
 		rootMountDir:         *rootMountDir,
 		cephConfigFile:       *cephConfigFile,
+		cephConfigSrcFile:    *cephConfigSrcFile,
+		cephConfigBase64:     os.Getenv("CEPH_CONF_BASE64"),
+		cephKeyringFile:      *cephKeyringFile,
+		cephKeyringSrcFile:   *cephKeyringSrcFile,
+		cephKeyringBase64:    os.Getenv("CEPH_KEYRING_BASE64"),
+		cephMonitors:         *cephMonitors,
+		cephAuth:             *cephAuth,
 		canCreateVolumes:     *canCreateVolumes,
 		canCreatePools:       *canCreatePools,
 		defaultImageSizeMB:   *defaultImageSizeMB,
 		defaultImageFSType:   *defaultImageFSType,
 		defaultImageFeatures: *defaultImageFeatures,
+		defaultDataPool:      *defaultDataPool,
+		defaultDataPoolEC:    *defaultDataPoolEC,
 		defaultRemoveAction:  *defaultRemoveAction,
 		defaultPoolPgNum:     *defaultPoolPgNum,
 		useRBDKernelModule:   *useRBDKernelModule,
+		lockBackend:          *lockBackend,
 		lockEtcdServers:      *lockEtcdServers,
+		lockEtcdCertFile:     *lockEtcdCertFile,
+		lockEtcdKeyFile:      *lockEtcdKeyFile,
+		lockEtcdCAFile:       *lockEtcdCAFile,
+		lockEtcdUsername:     *lockEtcdUsername,
+		lockEtcdPassword:     *lockEtcdPassword,
+		lockEtcdPrefix:       *lockEtcdPrefix,
+		lockEtcdDialTimeout:  *lockEtcdDialTimeout,
+		lockConsulServers:    *lockConsulServers,
+		lockFileDir:          *lockFileDir,
 		lockTimeoutMillis:    *lockTimeoutMillis,
+		lockWait:             *lockWait,
+		lockHandoff:          *lockHandoff,
+		cryptKeyProvider:     *cryptKeyProvider,
+		cryptKeyFile:         *cryptKeyFile,
+		cryptKeyURL:          *cryptKeyURL,
+		cryptKeyToken:        os.Getenv("CRYPT_KEY_TOKEN"),
+		nodeID:               *nodeID,
+		listLabels:           *listLabels,
+		listPoolNames:        *listPoolNames,
+		listWorkers:          *listWorkers,
+		listCacheTTL:         *listCacheTTL,
+		imageListCache:       &imageListCache{},
+		inventoryFile:        *inventoryFile,
+		cephReadTimeout:      *cephReadTimeout,
+		healthCheckInterval:  *healthCheckInterval,
+		breakerThreshold:     *breakerThreshold,
+		breakerCooldown:      *breakerCooldown,
+		maxImageSize:         *maxImageSize,
+		maxVolumes:           *maxVolumes,
+		maxProvisioned:       *maxProvisioned,
+		overcommitRatio:      *overcommitRatio,
+		poolLimitsSpec:       *poolLimitsSpec,
+		warmPoolSpec:         *warmPoolSpec,
+		warmPoolInterval:     *warmPoolInterval,
+		reconcileInterval:    *reconcileInterval,
+		orphanGracePeriod:    *orphanGracePeriod,
+		reconcileFix:         *reconcileFix,
+		dockerSocket:         *dockerSocket,
+		metricsAddr:          *metricsAddr,
+		deviceHealthInterval: *deviceHealthInterval,
+		deviceCanaryTimeout:  *deviceCanaryTimeout,
+		deviceRecovery:       *deviceRecovery,
+		shutdownTimeout:      *shutdownTimeout,
+		shutdownLocks:        *shutdownLocks,
 		m:                    &sync.Mutex{},
 	}
 
+	// administrative subcommands, like 'cepher locks list'
+	if flag.NArg() > 0 {
+		if err := driver.runAdminCommand(flag.Args()); err != nil {
+			logrus.Errorf("%s", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	logrus.Infof("====Starting Cepher plugin version %s====", VERSION)
+
 	logrus.Debugf("Initializing driver instance")
 	err := driver.init()
-	logrus.Debugf("etcdLockSession=%v", driver.etcdLockSession)
+	logrus.Debugf("locks=%v", driver.locks)
 	logrus.Debugf("volumeMountLocks=%v", driver.volumeMountLocks)
 	if err != nil {
+		// serving without the lock provider or the default pool could map images on several hosts
 		logrus.Errorf("error during driver initialization: %s", err)
+		os.Exit(1)
 	}
 
 	logrus.Debugf("Creating Docker VolumeDriver Handler")
@@ -95,8 +333,59 @@ func main() {
 	}
 
 	// open socket
-	err = h.ServeUnix(socketAddress, currentGid())
+	listener, err := sockets.NewUnixSocket(socketAddress, currentGid())
 	if err != nil {
 		logrus.Errorf("Unable to create UNIX socket: %v", err)
+		return
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- h.Serve(listener)
+	}()
+
+	// stop accepting requests on plugin disable or upgrade and let operations in progress finish
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	select {
+	case sig := <-signals:
+		logrus.Infof("Received %s", sig)
+		listener.Close()
+		os.Remove(socketAddress)
+		driver.shutdown(driver.shutdownTimeout)
+	case err := <-served:
+		logrus.Errorf("Error serving UNIX socket: %v", err)
+		os.Remove(socketAddress)
+	}
+}
+
+// applyEnvFlags sets the flags from the ENV configurations. Must be called before flag.Parse()
+// so that command line flags take precedence
+func applyEnvFlags() error {
+	for env, name := range envFileFlags {
+		value := os.Getenv(env)
+		if value == "" {
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return fmt.Errorf("error decoding %s: %s", env, err)
+		}
+		file := filepath.Join("/etc/cepher/etcd", strings.ToLower(strings.TrimSuffix(env, "_BASE64"))+".pem")
+		if err := writeFileAtomic(file, data, 0600); err != nil {
+			return fmt.Errorf("error writing %s to %s: %s", env, file, err)
+		}
+		if err := flag.Set(name, file); err != nil {
+			return err
+		}
+	}
+	for env, name := range envFlags {
+		value := os.Getenv(env)
+		if value == "" {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value '%s' for %s: %s", value, env, err)
+		}
 	}
+	return nil
 }
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// image metadata key prefixes of the volume create options and labels. Docker passes the
+// create options only to the host where the volume is created, so they are kept with the image
+const (
+	optionImageMetaPrefix = "cepher.opt."
+	labelImageMetaPrefix  = "cepher.label."
+)
+
+// labelOptionPrefix is the prefix of the create options that are volume labels (ex.: -o label.team=web)
+const labelOptionPrefix = "label."
+
+var metaKeyRegexp = regexp.MustCompile(`^[-_.[:alnum:]]+$`)
+
+// isUpdatableOption returns true for the create options that are stored again when an existing volume
+// is created, because they take effect on existing images. Other options only apply to new images
+func isUpdatableOption(option string) bool {
+	if option == "lock-wait" || option == "mount-options" {
+		return true
+	}
+	for _, q := range qosOptions {
+		if q.option == option {
+			return true
+		}
+	}
+	return false
+}
+
+// volumeMetadata is the create options and labels stored with the image
+type volumeMetadata struct {
+	Options map[string]string `json:"options"`
+	Labels  map[string]string `json:"labels"`
+	State   string            `json:"state,omitempty"`
+	// FormatPending is the filesystem type of images waiting for their first mount to be formatted
+	FormatPending string `json:"formatPending,omitempty"`
+}
+
+// splitCreateOptions separates the labels from the other create options
+func splitCreateOptions(createOptions map[string]string) (options map[string]string, labels map[string]string, err error) {
+	options = make(map[string]string)
+	labels = make(map[string]string)
+	for k, v := range createOptions {
+		if strings.HasPrefix(k, labelOptionPrefix) {
+			label := strings.TrimPrefix(k, labelOptionPrefix)
+			if !metaKeyRegexp.MatchString(label) {
+				return nil, nil, fmt.Errorf("invalid label name '%s'. Use letters, numbers, '-', '_' and '.'", label)
+			}
+			labels[label] = v
+			continue
+		}
+		if !metaKeyRegexp.MatchString(k) {
+			return nil, nil, fmt.Errorf("invalid option name '%s'", k)
+		}
+		options[k] = v
+	}
+	return options, labels, nil
+}
+
+// storeVolumeMetadata stores the create options and labels in the image metadata
+func (d *cephRBDVolumeDriver) storeVolumeMetadata(pool, name string, meta volumeMetadata) error {
+	for k, v := range meta.Options {
+		if err := d.setImageMeta(pool, name, optionImageMetaPrefix+k, v); err != nil {
+			return fmt.Errorf("error storing option %s on RBD Image %s/%s: %s", k, pool, name, err)
+		}
+	}
+	for k, v := range meta.Labels {
+		if err := d.setImageMeta(pool, name, labelImageMetaPrefix+k, v); err != nil {
+			return fmt.Errorf("error storing label %s on RBD Image %s/%s: %s", k, pool, name, err)
+		}
+	}
+	return nil
+}
+
+// loadVolumeMetadata returns the create options and labels stored in the image metadata
+func (d *cephRBDVolumeDriver) loadVolumeMetadata(pool, name string) (volumeMetadata, error) {
+	meta := volumeMetadata{Options: make(map[string]string), Labels: make(map[string]string)}
+	out, err := d.rbdsh(pool, "image-meta", "list", name, "--format", "json")
+	if err != nil {
+		return meta, err
+	}
+	return meta, parseVolumeMetadata(out, &meta)
+}
+
+// parseVolumeMetadata parses the output of 'rbd image-meta list --format json'
+func parseVolumeMetadata(out string, meta *volumeMetadata) error {
+	if strings.TrimSpace(out) == "" {
+		return nil
+	}
+	all := make(map[string]string)
+	if err := json.Unmarshal([]byte(out), &all); err != nil {
+		return fmt.Errorf("error parsing image metadata: %s", err)
+	}
+	for k, v := range all {
+		if strings.HasPrefix(k, optionImageMetaPrefix) {
+			meta.Options[strings.TrimPrefix(k, optionImageMetaPrefix)] = v
+		} else if strings.HasPrefix(k, labelImageMetaPrefix) {
+			meta.Labels[strings.TrimPrefix(k, labelImageMetaPrefix)] = v
+		} else if k == stateImageMetaKey {
+			meta.State = v
+		} else if k == formatPendingImageMetaKey {
+			meta.FormatPending = v
+		}
+	}
+	return nil
+}
+
+// parseLabelFilter parses label filters like 'team=web,backup'. A label without value
+// matches volumes having the label with any value
+func parseLabelFilter(filter string) map[string]*string {
+	labels := make(map[string]*string)
+	for _, f := range strings.Split(filter, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		parts := strings.SplitN(f, "=", 2)
+		if len(parts) == 2 {
+			value := parts[1]
+			labels[parts[0]] = &value
+		} else {
+			labels[parts[0]] = nil
+		}
+	}
+	return labels
+}
+
+// matchLabels returns true if labels has all the filter labels
+func matchLabels(labels map[string]string, filter map[string]*string) bool {
+	for k, v := range filter {
+		value, ok := labels[k]
+		if !ok || (v != nil && value != *v) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchListLabels returns true if the labels of the image match listLabels
+func (d *cephRBDVolumeDriver) matchListLabels(pool, name string) bool {
+	filter := parseLabelFilter(d.listLabels)
+	if len(filter) == 0 {
+		return true
+	}
+	meta, err := d.loadVolumeMetadata(pool, name)
+	if err != nil {
+		logrus.Warnf("couldn't get labels of %s/%s. Hiding it from the list: %s", pool, name, err)
+		return false
+	}
+	return matchLabels(meta.Labels, filter)
+}
+
+// filterImagesByLabels removes the 'pool/name' images whose labels don't match listLabels.
+// Each image needs its own 'rbd image-meta list', so listWorkers images are checked in parallel
+func (d *cephRBDVolumeDriver) filterImagesByLabels(images []string) []string {
+	if len(parseLabelFilter(d.listLabels)) == 0 {
+		return images
+	}
+	workers := d.listWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	matches := make([]bool, len(images))
+	for i, image := range images {
+		parts := strings.SplitN(image, "/", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, pool, name string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			matches[i] = d.matchListLabels(pool, name)
+		}(i, parts[0], parts[1])
+	}
+	wg.Wait()
+	filtered := make([]string, 0)
+	for i, image := range images {
+		if matches[i] {
+			filtered = append(filtered, image)
+		}
+	}
+	return filtered
+}
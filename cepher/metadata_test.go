@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSplitCreateOptions(t *testing.T) {
+	options, labels, err := splitCreateOptions(map[string]string{"size": "200", "label.team": "web", "label.backup": ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(options) != 1 || options["size"] != "200" {
+		t.Fatalf("unexpected options %v", options)
+	}
+	if len(labels) != 2 || labels["team"] != "web" {
+		t.Fatalf("unexpected labels %v", labels)
+	}
+	if _, _, err := splitCreateOptions(map[string]string{"label.a b": "x"}); err == nil {
+		t.Fatal("expected error for invalid label name")
+	}
+}
+
+func TestParseVolumeMetadata(t *testing.T) {
+	meta := volumeMetadata{Options: make(map[string]string), Labels: make(map[string]string)}
+	out := `{"cepher.opt.fstype":"ext4","cepher.label.team":"web","cepher.lock-wait":"10s","conf_rbd_qos_iops_limit":"100"}`
+	if err := parseVolumeMetadata(out, &meta); err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.Options) != 1 || meta.Options["fstype"] != "ext4" {
+		t.Fatalf("unexpected options %v", meta.Options)
+	}
+	if len(meta.Labels) != 1 || meta.Labels["team"] != "web" {
+		t.Fatalf("unexpected labels %v", meta.Labels)
+	}
+}
+
+func TestMatchLabels(t *testing.T) {
+	filter := parseLabelFilter("team=web, backup")
+	if !matchLabels(map[string]string{"team": "web", "backup": "daily"}, filter) {
+		t.Fatal("expected labels to match")
+	}
+	if matchLabels(map[string]string{"team": "db", "backup": "daily"}, filter) {
+		t.Fatal("expected different label value not to match")
+	}
+	if matchLabels(map[string]string{"team": "web"}, filter) {
+		t.Fatal("expected missing label not to match")
+	}
+	if !matchLabels(map[string]string{}, parseLabelFilter("")) {
+		t.Fatal("expected empty filter to match")
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	out, err := ExecShellTimeout(defaultShellTimeout, "printf", "%s", shellQuote("it's a $value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "it's a $value" {
+		t.Fatalf("expected value to be passed unchanged but got '%s'", out)
+	}
+}
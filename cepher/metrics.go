@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+)
+
+// serveMetrics serves the Prometheus metrics at /metrics and the recent reconciler findings and
+// device health changes as JSON at /events
+func (d *cephRBDVolumeDriver) serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		d.reconcileReport.writeMetrics(w)
+		d.deviceHealth.writeMetrics(w)
+	})
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		events := append(d.reconcileReport.recentEvents(), d.deviceHealth.recentEvents()...)
+		if events == nil {
+			events = make([]reconcileFinding, 0)
+		}
+		sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(events); err != nil {
+			logrus.Warnf("error writing events: %s", err)
+		}
+	})
+	logrus.Infof("Serving metrics at %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logrus.Errorf("error serving metrics at %s: %s", addr, err)
+	}
+}
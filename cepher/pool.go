@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// cephNameRegexp matches the Ceph object names taken from volume options, like crush rules and
+// erasure code profiles. Same characters as pool and image names, as they end up in shell commands
+var cephNameRegexp = regexp.MustCompile(`^[-_.[:alnum:]]+$`)
+
+// quotaBytesRegexp matches byte quotas like 1073741824, 10G or 10Gi
+var quotaBytesRegexp = regexp.MustCompile(`^[0-9]+([KMGTPE]i?)?$`)
+
+// poolOptions are the settings applied to the pools created by cepher. Empty values keep the cluster defaults
+type poolOptions struct {
+	pgNum           string
+	size            string // number of replicas
+	minSize         string
+	crushRule       string
+	erasureProfile  string // creates an erasure coded pool, usable as an RBD data pool, instead of a replicated one
+	autoscaleMode   string // on, off or warn
+	quotaMaxBytes   string
+	quotaMaxObjects string
+	compressionMode string // none, passive, aggressive or force
+}
+
+// poolCreateOptions are the volume create options that may override the pool defaults. There is
+// no erasure code profile option, as RBD keeps image headers and omap in the image pool, which must
+// be replicated. Image data goes to erasure coded pools with the data-pool option
+var poolCreateOptions = []string{
+	"pool-pg-num",
+	"pool-size",
+	"pool-min-size",
+	"pool-crush-rule",
+	"pool-autoscale-mode",
+	"pool-quota-max-bytes",
+	"pool-quota-max-objects",
+	"pool-compression-mode",
+}
+
+// withCreateOptions returns a copy of the pool options overridden by the 'pool-*' volume create options
+func (o poolOptions) withCreateOptions(options map[string]string) (poolOptions, error) {
+	if options["pool-erasure-profile"] != "" {
+		return o, errors.New("pool-erasure-profile is not supported, as RBD images need a replicated pool. Use data-pool and data-pool-erasure-profile to store the image data in an erasure coded pool")
+	}
+	fields := map[string]*string{
+		"pool-pg-num":            &o.pgNum,
+		"pool-size":              &o.size,
+		"pool-min-size":          &o.minSize,
+		"pool-crush-rule":        &o.crushRule,
+		"pool-autoscale-mode":    &o.autoscaleMode,
+		"pool-quota-max-bytes":   &o.quotaMaxBytes,
+		"pool-quota-max-objects": &o.quotaMaxObjects,
+		"pool-compression-mode":  &o.compressionMode,
+	}
+	for _, name := range poolCreateOptions {
+		if value, ok := options[name]; ok && value != "" {
+			*fields[name] = value
+		}
+	}
+	return o, o.validate()
+}
+
+// hasPoolCreateOptions returns true if any 'pool-*' option was given
+func hasPoolCreateOptions(options map[string]string) bool {
+	for _, name := range poolCreateOptions {
+		if options[name] != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func (o poolOptions) validate() error {
+	numbers := map[string]string{
+		"pg-num":            o.pgNum,
+		"size":              o.size,
+		"min-size":          o.minSize,
+		"quota-max-objects": o.quotaMaxObjects,
+	}
+	for name, value := range numbers {
+		if value == "" {
+			continue
+		}
+		if n, err := strconv.Atoi(value); err != nil || n < 0 {
+			return fmt.Errorf("invalid pool %s '%s'. Must be a positive number", name, value)
+		}
+	}
+	names := map[string]string{
+		"crush-rule":      o.crushRule,
+		"erasure-profile": o.erasureProfile,
+	}
+	for name, value := range names {
+		if value != "" && !cephNameRegexp.MatchString(value) {
+			return fmt.Errorf("invalid pool %s '%s'. Use letters, numbers, '-', '_' and '.'", name, value)
+		}
+	}
+	if o.quotaMaxBytes != "" && !quotaBytesRegexp.MatchString(o.quotaMaxBytes) {
+		return fmt.Errorf("invalid pool quota-max-bytes '%s'. Must be a number of bytes, optionally with a K, M, G, T, P or E suffix", o.quotaMaxBytes)
+	}
+	if o.erasureProfile != "" && (o.size != "" || o.minSize != "") {
+		return errors.New("pool size and min-size can't be set for erasure coded pools. They are defined by the erasure code profile")
+	}
+	if err := validateEnum("pool autoscale-mode", o.autoscaleMode, "on", "off", "warn"); err != nil {
+		return err
+	}
+	return validateEnum("pool compression-mode", o.compressionMode, "none", "passive", "aggressive", "force")
+}
+
+// validateEnum returns an error if value is not empty and is not one of options
+func validateEnum(name, value string, options ...string) error {
+	if value == "" {
+		return nil
+	}
+	for _, o := range options {
+		if value == o {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid %s '%s'. Options are %s", name, value, strings.Join(options, ", "))
+}
+
+// createPoolArgs returns the arguments for 'ceph osd pool create'
+func (o poolOptions) createPoolArgs(pool string) []string {
+	pgNum := o.pgNum
+	if pgNum == "" {
+		pgNum = "100"
+	}
+	args := []string{"osd", "pool", "create", pool, pgNum, pgNum}
+	if o.erasureProfile != "" {
+		args = append(args, "erasure", o.erasureProfile)
+	} else {
+		args = append(args, "replicated")
+	}
+	if o.crushRule != "" {
+		args = append(args, o.crushRule)
+	}
+	return args
+}
+
+// poolSettings returns the 'ceph osd pool set' settings to be applied after the pool creation
+func (o poolOptions) poolSettings() [][]string {
+	settings := make([][]string, 0)
+	if o.erasureProfile != "" {
+		// required for RBD data on erasure coded pools
+		settings = append(settings, []string{"allow_ec_overwrites", "true"})
+	}
+	if o.size != "" {
+		settings = append(settings, []string{"size", o.size})
+	}
+	if o.minSize != "" {
+		settings = append(settings, []string{"min_size", o.minSize})
+	}
+	if o.autoscaleMode != "" {
+		settings = append(settings, []string{"pg_autoscale_mode", o.autoscaleMode})
+	}
+	if o.compressionMode != "" {
+		settings = append(settings, []string{"compression_mode", o.compressionMode})
+	}
+	return settings
+}
+
+// applyPoolOptions applies the settings and quotas of the pool options to an existing pool
+func applyPoolOptions(pool string, o poolOptions) error {
+	for _, setting := range o.poolSettings() {
+		logrus.Infof("setting %s of pool '%s' to %s", setting[0], pool, setting[1])
+		if _, err := shWithDefaultTimeout("ceph", "osd", "pool", "set", pool, setting[0], setting[1]); err != nil {
+			return fmt.Errorf("error setting %s of pool '%s': %s", setting[0], pool, err)
+		}
+	}
+	quotas := [][]string{{"max_bytes", o.quotaMaxBytes}, {"max_objects", o.quotaMaxObjects}}
+	for _, quota := range quotas {
+		if quota[1] == "" {
+			continue
+		}
+		logrus.Infof("setting quota %s of pool '%s' to %s", quota[0], pool, quota[1])
+		if _, err := shWithDefaultTimeout("ceph", "osd", "pool", "set-quota", pool, quota[0], quota[1]); err != nil {
+			return fmt.Errorf("error setting quota %s of pool '%s': %s", quota[0], pool, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPoolOptions(t *testing.T) {
+	defaults := poolOptions{pgNum: "64", size: "2"}
+	o, err := defaults.withCreateOptions(map[string]string{"pool-size": "1", "pool-crush-rule": "ssd", "pool-compression-mode": "aggressive", "size": "100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if defaults.size != "2" {
+		t.Fatal("defaults must not be changed by create options")
+	}
+	want := []string{"osd", "pool", "create", "p1", "64", "64", "replicated", "ssd"}
+	if args := o.createPoolArgs("p1"); !reflect.DeepEqual(args, want) {
+		t.Fatalf("expected %v but got %v", want, args)
+	}
+	wantSettings := [][]string{{"size", "1"}, {"compression_mode", "aggressive"}}
+	if settings := o.poolSettings(); !reflect.DeepEqual(settings, wantSettings) {
+		t.Fatalf("expected %v but got %v", wantSettings, settings)
+	}
+
+	if _, err := defaults.withCreateOptions(map[string]string{"pool-quota-max-bytes": "10Gi"}); err != nil {
+		t.Fatalf("expected quota with suffix to be valid: %s", err)
+	}
+
+	// erasure coded pools are only created as data pools
+	o = poolOptions{pgNum: "32", erasureProfile: "k2m1"}
+	if err := o.validate(); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"osd", "pool", "create", "p2", "32", "32", "erasure", "k2m1"}
+	if args := o.createPoolArgs("p2"); !reflect.DeepEqual(args, want) {
+		t.Fatalf("expected %v but got %v", want, args)
+	}
+	if settings := o.poolSettings(); len(settings) != 1 || settings[0][0] != "allow_ec_overwrites" {
+		t.Fatalf("expected allow_ec_overwrites for erasure coded pools but got %v", settings)
+	}
+
+	invalid := []map[string]string{
+		{"pool-size": "three"},
+		{"pool-autoscale-mode": "always"},
+		{"pool-compression-mode": "zstd"},
+		{"pool-erasure-profile": "k2m1"},
+		{"pool-erasure-profile": "k2m1", "pool-size": "3"},
+		{"pool-crush-rule": "ssd; touch /tmp/x"},
+		{"pool-erasure-profile": "$(reboot)"},
+		{"pool-quota-max-bytes": "10G && reboot"},
+	}
+	if err := (poolOptions{erasureProfile: "k2m1", size: "3"}).validate(); err == nil {
+		t.Fatal("expected error for size of erasure coded pool")
+	}
+	for _, options := range invalid {
+		if _, err := defaults.withCreateOptions(options); err == nil {
+			t.Fatalf("expected error for %v", options)
+		}
+	}
+}
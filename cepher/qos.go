@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+)
+
+// qosOptions maps the volume create options to the librbd QoS settings. They are stored as
+// 'conf_' image metadata, which overrides the librbd config for the image
+var qosOptions = []struct {
+	option string
+	config string
+}{
+	{"iops-limit", "rbd_qos_iops_limit"},
+	{"read-iops-limit", "rbd_qos_read_iops_limit"},
+	{"write-iops-limit", "rbd_qos_write_iops_limit"},
+	{"bps-limit", "rbd_qos_bps_limit"},
+	{"read-bps-limit", "rbd_qos_read_bps_limit"},
+	{"write-bps-limit", "rbd_qos_write_bps_limit"},
+}
+
+// parseQoSOptions returns the librbd QoS settings for the QoS create options found in options.
+// A limit of 0 removes it
+func parseQoSOptions(options map[string]string) (map[string]uint64, error) {
+	limits := make(map[string]uint64)
+	for _, q := range qosOptions {
+		value, ok := options[q.option]
+		if !ok || value == "" {
+			continue
+		}
+		limit, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s '%s'. Must be a positive number or 0 for no limit", q.option, value)
+		}
+		limits[q.config] = limit
+	}
+	return limits, nil
+}
+
+// applyQoS stores the QoS limits on the image. They take effect on running mappings when librbd
+// is notified of the image metadata change. The RBD kernel module doesn't support QoS
+func (d *cephRBDVolumeDriver) applyQoS(pool, name string, limits map[string]uint64) error {
+	if len(limits) == 0 {
+		return nil
+	}
+	if d.useRBDKernelModule {
+		logrus.Warnf("QoS limits of %s/%s are not enforced by the RBD kernel module", pool, name)
+	}
+	for config, limit := range limits {
+		key := "conf_" + config
+		if limit == 0 {
+			logrus.Infof("Removing %s from %s/%s", config, pool, name)
+			if err := d.removeImageMeta(pool, name, key); err != nil {
+				return fmt.Errorf("error removing %s from %s/%s: %s", config, pool, name, err)
+			}
+			continue
+		}
+		logrus.Infof("Setting %s of %s/%s to %d", config, pool, name, limit)
+		if err := d.setImageMeta(pool, name, key, strconv.FormatUint(limit, 10)); err != nil {
+			return fmt.Errorf("error setting %s of %s/%s: %s", config, pool, name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestParseQoSOptions(t *testing.T) {
+	limits, err := parseQoSOptions(map[string]string{"iops-limit": "500", "write-bps-limit": "0", "size": "100"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(limits) != 2 || limits["rbd_qos_iops_limit"] != 500 {
+		t.Fatalf("unexpected limits %v", limits)
+	}
+	if limit, ok := limits["rbd_qos_write_bps_limit"]; !ok || limit != 0 {
+		t.Fatalf("expected write bps limit to be removed but got %v", limits)
+	}
+	for _, value := range []string{"-1", "10M", "fast"} {
+		if _, err := parseQoSOptions(map[string]string{"bps-limit": value}); err == nil {
+			t.Fatalf("expected error for bps-limit '%s'", value)
+		}
+	}
+}
@@ -0,0 +1,627 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// mappedDevice is a device mapped by the plugin
+type mappedDevice struct {
+	Pool     string    `json:"pool"`
+	Name     string    `json:"name"`
+	MappedAt time.Time `json:"mappedAt"`
+}
+
+func (inv *inventory) setMapped(device, pool, name string) {
+	if inv == nil {
+		return
+	}
+	inv.m.Lock()
+	defer inv.m.Unlock()
+	if inv.Mapped == nil {
+		inv.Mapped = make(map[string]*mappedDevice)
+	}
+	inv.Mapped[device] = &mappedDevice{Pool: pool, Name: name, MappedAt: time.Now()}
+	inv.save()
+}
+
+func (inv *inventory) removeMapped(device string) {
+	if inv == nil {
+		return
+	}
+	inv.m.Lock()
+	defer inv.m.Unlock()
+	if _, ok := inv.Mapped[device]; !ok {
+		return
+	}
+	delete(inv.Mapped, device)
+	inv.save()
+}
+
+// mappedDevices returns copies of the devices mapped by the plugin
+func (inv *inventory) mappedDevices() map[string]mappedDevice {
+	devices := make(map[string]mappedDevice)
+	if inv == nil {
+		return devices
+	}
+	inv.m.Lock()
+	defer inv.m.Unlock()
+	for device, m := range inv.Mapped {
+		devices[device] = *m
+	}
+	return devices
+}
+
+// kinds of reconciliation findings
+const (
+	findingEmptyMountDir     = "empty-mountdir"
+	findingOrphanDevice      = "orphan-device"
+	findingStaleLock         = "stale-lock"
+	findingUnreferencedMount = "unreferenced-mount"
+)
+
+var findingKinds = []string{findingEmptyMountDir, findingOrphanDevice, findingStaleLock, findingUnreferencedMount}
+
+// reconcileFinding is something left behind found by the reconciler, reported as an event
+type reconcileFinding struct {
+	Kind     string    `json:"kind"`
+	Volume   string    `json:"volume,omitempty"`
+	Device   string    `json:"device,omitempty"`
+	Path     string    `json:"path,omitempty"`
+	Detail   string    `json:"detail"`
+	Fixed    bool      `json:"fixed"`
+	FixError string    `json:"fixError,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// parseReconcileFix parses the finding kinds fixed by the reconciler, like 'orphan-device,stale-lock' or 'all'
+func parseReconcileFix(spec string) (map[string]bool, error) {
+	fix := make(map[string]bool)
+	for _, kind := range strings.Split(spec, ",") {
+		kind = strings.TrimSpace(kind)
+		switch {
+		case kind == "":
+		case kind == "all":
+			for _, k := range findingKinds {
+				fix[k] = true
+			}
+		case isFindingKind(kind):
+			fix[kind] = true
+		default:
+			return nil, fmt.Errorf("invalid reconcile fix '%s'. Options are 'all', %s", kind, strings.Join(findingKinds, ", "))
+		}
+	}
+	return fix, nil
+}
+
+func isFindingKind(kind string) bool {
+	for _, k := range findingKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// watchReconcile reconciles the host state with the plugin state periodically
+func (d *cephRBDVolumeDriver) watchReconcile(interval time.Duration) {
+	for d.sleepOrStop(interval) {
+		findings, err := d.runReconcile()
+		if err != nil {
+			logrus.Warnf("error reconciling host state: %s", err)
+		}
+		d.reconcileReport.record(findings, err)
+	}
+}
+
+// runReconcile runs a reconciliation. Docker is queried before the driver mutex is taken, so that
+// the plugin doesn't wait for Docker while Docker may be waiting for the plugin
+func (d *cephRBDVolumeDriver) runReconcile() ([]reconcileFinding, error) {
+	referenced, err := d.dockerReferencedMounts()
+	if err != nil {
+		logrus.Warnf("unable to get the volumes used by Docker containers. Skipping unreferenced mounts check: %s", err)
+	}
+	d.m.Lock()
+	defer d.m.Unlock()
+	return d.reconcile(referenced)
+}
+
+// reconcile looks for mount directories with nothing mounted, devices with no mount, mount locks
+// held by this host for volumes that are not mounted and mounts not used by any running container
+// (when referenced is not nil). The findings of the kinds in reconcileFixKinds are fixed.
+// Things younger than orphanGracePeriod and creates in progress are left alone.
+// Must be called with d.m held, so that no mount is in progress
+func (d *cephRBDVolumeDriver) reconcile(referenced map[string]bool) ([]reconcileFinding, error) {
+	mapped, err := d.listMappedDevices()
+	if err != nil {
+		return nil, fmt.Errorf("error getting mapped devices: %s", err)
+	}
+	volumes, err := d.currentVolumes()
+	if err != nil {
+		return nil, err
+	}
+	cryptMappings, err := listCryptMappings()
+	if err != nil {
+		return nil, fmt.Errorf("error getting dm-crypt mappings: %s", err)
+	}
+	mounts, err := d.listMounts()
+	if err != nil {
+		return nil, fmt.Errorf("error getting current mounts: %s", err)
+	}
+	tracked := d.inventory.mappedDevices()
+
+	findings := make([]reconcileFinding, 0)
+	findings = append(findings, d.reconcileOrphanDevices(mapped, volumes, mounts, cryptMappings, tracked)...)
+	findings = append(findings, d.reconcileEmptyMountDirs(volumes, mounts)...)
+	lockFindings, err := d.reconcileStaleLocks(d.mountedVolumeNames(volumes, tracked, mounts, cryptMappings))
+	if err != nil {
+		logrus.Warnf("%s", err)
+	}
+	findings = append(findings, lockFindings...)
+	if referenced != nil {
+		findings = append(findings, d.reconcileUnreferencedMounts(volumes, referenced, tracked)...)
+	}
+
+	for i := range findings {
+		f := &findings[i]
+		f.Time = time.Now()
+		fields := logrus.Fields{"event": "reconcile", "kind": f.Kind, "volume": f.Volume, "device": f.Device, "path": f.Path, "fixed": f.Fixed}
+		if f.FixError != "" {
+			fields["fixError"] = f.FixError
+		}
+		logrus.WithFields(fields).Warnf("Reconciler found %s: %s", f.Kind, f.Detail)
+	}
+	return findings, nil
+}
+
+// reconcileOrphanDevices finds mapped devices that are not mounted, nor exposed as block devices.
+// Only devices mapped by the plugin are unmapped. Devices mapped by others are only reported
+func (d *cephRBDVolumeDriver) reconcileOrphanDevices(mapped []*Volume, volumes map[string]*Volume, mounts []*Volume, cryptMappings map[string]string, tracked map[string]mappedDevice) []reconcileFinding {
+	inUse := make(map[string]bool)
+	for _, v := range volumes {
+		inUse[v.Device] = true
+	}
+	creating := make(map[string]bool)
+	for _, name := range d.inventory.pendingCreates() {
+		creating[name] = true
+	}
+
+	findings := make([]reconcileFinding, 0)
+	systemMapped := make(map[string]bool)
+	for _, v := range mapped {
+		systemMapped[v.Device] = true
+		if inUse[v.Device] || creating[v.Pool+"/"+v.Name] {
+			continue
+		}
+		f := reconcileFinding{Kind: findingOrphanDevice, Volume: v.Pool + "/" + v.Name, Device: v.Device}
+		t, ok := tracked[v.Device]
+		if ok && (t.Pool != v.Pool || t.Name != v.Name) {
+			// the device was unmapped outside the plugin and reused for another image
+			d.inventory.removeMapped(v.Device)
+			ok = false
+		}
+		if !ok {
+			f.Detail = "device is mapped but not mounted. It was not mapped by the plugin, so it is left alone"
+			findings = append(findings, f)
+			continue
+		}
+		if time.Since(t.MappedAt) < d.orphanGracePeriod {
+			continue
+		}
+		f.Detail = fmt.Sprintf("device mapped by the plugin at %s is not mounted", t.MappedAt.Format(time.RFC3339))
+		if d.reconcileFixKinds[f.Kind] {
+			d.fixFinding(&f, func() error {
+				return d.releaseVolumeDevice(v.Device, cryptMappings[v.Device])
+			})
+		}
+		findings = append(findings, f)
+	}
+
+	// forget devices unmapped outside the plugin. Devices still mounted are not listed when their
+	// rbd-nbd daemon died, and are kept for the device health monitor to reattach them
+	for device, t := range tracked {
+		if !systemMapped[device] && d.deviceMountpath(t.Pool, t.Name, device, mounts, cryptMappings) == "" {
+			d.inventory.removeMapped(device)
+		}
+	}
+	return findings
+}
+
+// reconcileEmptyMountDirs finds mount directories under rootMountDir with nothing mounted
+func (d *cephRBDVolumeDriver) reconcileEmptyMountDirs(volumes map[string]*Volume, mounts []*Volume) []reconcileFinding {
+	findings := make([]reconcileFinding, 0)
+	mountpoints := make(map[string]bool)
+	for _, m := range mounts {
+		mountpoints[m.Mountpath] = true
+	}
+	dirs, err := filepath.Glob(filepath.Join(d.rootMountDir, "*", "*"))
+	if err != nil {
+		logrus.Warnf("error listing mount directories: %s", err)
+		return findings
+	}
+	for _, dir := range dirs {
+		if _, mounted := volumes[dir]; mounted || mountpoints[dir] {
+			// mounts of unhealthy devices are not listed as volumes, and reading them may hang
+			continue
+		}
+		fi, err := os.Stat(dir)
+		if err != nil || !fi.IsDir() {
+			continue
+		}
+		f := reconcileFinding{Kind: findingEmptyMountDir, Path: dir, Volume: filepath.Base(filepath.Dir(dir)) + "/" + strings.Split(filepath.Base(dir), ":")[0]}
+		entries, err := ioutil.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		if len(entries) > 1 || (len(entries) == 1 && entries[0].Name() != blockDeviceNodeName) {
+			f.Detail = "nothing is mounted, but the directory has files, written while the volume wasn't mounted. It is left alone"
+			findings = append(findings, f)
+			continue
+		}
+		f.Detail = "nothing is mounted at the mount directory"
+		if d.reconcileFixKinds[f.Kind] {
+			d.fixFinding(&f, func() error {
+				if err := removeBlockDevice(dir); err != nil {
+					return err
+				}
+				return os.Remove(dir)
+			})
+		}
+		findings = append(findings, f)
+	}
+	return findings
+}
+
+// mountedVolumeNames returns the 'pool/name' of the volumes mounted on this host. Devices whose
+// rbd-nbd daemon died are missing from volumes, so the tracked devices that are still mounted and
+// the volumes this plugin instance holds mount locks for are mounted too
+func (d *cephRBDVolumeDriver) mountedVolumeNames(volumes map[string]*Volume, tracked map[string]mappedDevice, mounts []*Volume, cryptMappings map[string]string) map[string]bool {
+	mounted := make(map[string]bool)
+	for _, v := range volumes {
+		mounted[v.Pool+"/"+v.Name] = true
+	}
+	for device, t := range tracked {
+		if d.deviceMountpath(t.Pool, t.Name, device, mounts, cryptMappings) != "" {
+			mounted[t.Pool+"/"+t.Name] = true
+		}
+	}
+	for volumeName := range d.volumeMountLocks {
+		mounted[volumeName] = true
+	}
+	return mounted
+}
+
+// reconcileStaleLocks finds mount locks held by this host for volumes that are not mounted
+func (d *cephRBDVolumeDriver) reconcileStaleLocks(mounted map[string]bool) ([]reconcileFinding, error) {
+	findings := make([]reconcileFinding, 0)
+	if d.locks == nil {
+		return findings, nil
+	}
+	prefix := lockKindPrefixes["mount"]
+	keys, err := d.locks.Locks(prefix)
+	if err != nil {
+		return findings, fmt.Errorf("error listing mount locks: %s", err)
+	}
+	for _, key := range keys {
+		volumeName := strings.TrimPrefix(key, prefix)
+		if mounted[volumeName] {
+			continue
+		}
+		holders, err := d.locks.Holders(key)
+		if err != nil {
+			logrus.Warnf("error getting holders of %s: %s", key, err)
+			continue
+		}
+		own := make([]lockHolder, 0)
+		for _, h := range holders {
+			if d.isOwnLockHolder(h) {
+				own = append(own, h)
+			}
+		}
+		for _, h := range own {
+			if time.Since(h.AcquiredAt) < d.orphanGracePeriod {
+				continue
+			}
+			f := reconcileFinding{Kind: findingStaleLock, Volume: volumeName, Detail: fmt.Sprintf("mount lock held by this host since %s for caller %s, but the volume is not mounted", h.AcquiredAt.Format(time.RFC3339), h.CallerID)}
+			if d.reconcileFixKinds[f.Kind] {
+				d.fixFinding(&f, func() error {
+					return d.releaseMountLocks(volumeName, key, own)
+				})
+			}
+			findings = append(findings, f)
+			break
+		}
+	}
+	return findings, nil
+}
+
+// isOwnLockHolder returns true if the lock is held by this host. Locks of previous runs of the
+// plugin have another session, so they are matched by node ID
+func (d *cephRBDVolumeDriver) isOwnLockHolder(h lockHolder) bool {
+	return h.Owner == d.locks.ID() || (d.nodeID != "" && h.NodeID == d.nodeID)
+}
+
+// releaseMountLocks releases the mount locks held by this host for the volume. Locks known by this
+// plugin instance are unlocked. Otherwise the sessions of holders are force released, like the
+// locks of a previous run still within its session TTL
+func (d *cephRBDVolumeDriver) releaseMountLocks(volumeName, key string, holders []lockHolder) error {
+	parts := strings.SplitN(volumeName, "/", 2)
+	if mutexes, found := d.volumeMountLocks[volumeName]; found && len(parts) == 2 {
+		for callerID := range mutexes {
+			if err := d.unlockMountVolume(parts[0], parts[1], callerID); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	released := make(map[string]bool)
+	for _, h := range holders {
+		if h.Owner == "" || released[h.Owner] {
+			continue
+		}
+		if err := d.locks.ForceRelease(key, h.Owner); err != nil {
+			return err
+		}
+		released[h.Owner] = true
+	}
+	return nil
+}
+
+// reconcileUnreferencedMounts finds mounted volumes that are not used by any running container
+func (d *cephRBDVolumeDriver) reconcileUnreferencedMounts(volumes map[string]*Volume, referenced map[string]bool, tracked map[string]mappedDevice) []reconcileFinding {
+	findings := make([]reconcileFinding, 0)
+	for mountpath, v := range volumes {
+		if referenced[mountpath] {
+			continue
+		}
+		if t, ok := tracked[v.Device]; ok && time.Since(t.MappedAt) < d.orphanGracePeriod {
+			// the container may not have started yet
+			continue
+		}
+		f := reconcileFinding{Kind: findingUnreferencedMount, Volume: v.Pool + "/" + v.Name, Device: v.Device, Path: mountpath, Detail: "volume is mounted but no running container uses it"}
+		if d.reconcileFixKinds[f.Kind] {
+			vol := v
+			d.fixFinding(&f, func() error {
+				return d.releaseMount(vol)
+			})
+		}
+		findings = append(findings, f)
+	}
+	return findings
+}
+
+// releaseMount unmounts a volume, unmaps its device and releases its mount locks
+func (d *cephRBDVolumeDriver) releaseMount(vol *Volume) error {
+	var err error
+	if vol.Block {
+		err = removeBlockDevice(vol.Mountpath)
+	} else {
+		err = d.unmountPath(vol.Mountpath)
+	}
+	if err != nil {
+		return fmt.Errorf("error unmounting %s: %s", vol.Mountpath, err)
+	}
+	if err := d.releaseVolumeDevice(vol.Device, vol.CryptName); err != nil {
+		return fmt.Errorf("error unmapping %s: %s", vol.Device, err)
+	}
+	d.inventory.setMount(vol.Mountpath, nil)
+	volumeName := vol.Pool + "/" + vol.Name
+	if _, found := d.volumeMountLocks[volumeName]; found {
+		return d.releaseMountLocks(volumeName, volumeMountLockKey(volumeName), nil)
+	}
+	return nil
+}
+
+func (d *cephRBDVolumeDriver) fixFinding(f *reconcileFinding, fix func() error) {
+	if err := fix(); err != nil {
+		f.FixError = err.Error()
+		return
+	}
+	f.Fixed = true
+}
+
+// dockerReferencedMounts returns the mount paths of the volumes used by running containers,
+// queried from the Docker Engine API. Returns nil if the Docker socket isn't available
+func (d *cephRBDVolumeDriver) dockerReferencedMounts() (map[string]bool, error) {
+	if d.dockerSocket == "" {
+		return nil, nil
+	}
+	if _, err := os.Stat(d.dockerSocket); err != nil {
+		logrus.Debugf("Docker socket %s not available: %s", d.dockerSocket, err)
+		return nil, nil
+	}
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", d.dockerSocket)
+			},
+		},
+	}
+	resp, err := client.Get("http://docker/containers/json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Docker API returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return d.parseDockerContainerMounts(body)
+}
+
+// parseDockerContainerMounts parses the output of the Docker API containers list
+func (d *cephRBDVolumeDriver) parseDockerContainerMounts(body []byte) (map[string]bool, error) {
+	var containers []struct {
+		Mounts []struct {
+			Type string `json:"Type"`
+			Name string `json:"Name"`
+		} `json:"Mounts"`
+	}
+	if err := json.Unmarshal(body, &containers); err != nil {
+		return nil, fmt.Errorf("error parsing Docker containers: %s", err)
+	}
+	referenced := make(map[string]bool)
+	for _, c := range containers {
+		for _, m := range c.Mounts {
+			if m.Type != "volume" || m.Name == "" {
+				continue
+			}
+			pool, name, _, readonly, err := d.parseImagePoolName(m.Name)
+			if err != nil {
+				continue
+			}
+			referenced[d.mountpoint(pool, name, readonly)] = true
+		}
+	}
+	return referenced, nil
+}
+
+// reconcileReport keeps the results of the reconciliations for the metrics and events endpoints.
+// A nil reconcileReport keeps nothing
+type reconcileReport struct {
+	m        sync.Mutex
+	runs     uint64
+	failures uint64
+	lastRun  time.Time
+	findings map[string]int    // findings of the last run, by kind
+	fixed    map[string]uint64 // fixed findings since start, by kind
+	events   []reconcileFinding
+}
+
+// maxReconcileEvents is the number of recent findings kept for the events endpoint
+const maxReconcileEvents = 200
+
+func newReconcileReport() *reconcileReport {
+	return &reconcileReport{findings: make(map[string]int), fixed: make(map[string]uint64)}
+}
+
+func (r *reconcileReport) record(findings []reconcileFinding, err error) {
+	if r == nil {
+		return
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.runs++
+	r.lastRun = time.Now()
+	if err != nil {
+		r.failures++
+		return
+	}
+	r.findings = make(map[string]int)
+	for _, f := range findings {
+		r.findings[f.Kind]++
+		if f.Fixed {
+			r.fixed[f.Kind]++
+		}
+	}
+	r.events = append(r.events, findings...)
+	if len(r.events) > maxReconcileEvents {
+		r.events = r.events[len(r.events)-maxReconcileEvents:]
+	}
+}
+
+// recentEvents returns the recent findings, newest last
+func (r *reconcileReport) recentEvents() []reconcileFinding {
+	if r == nil {
+		return nil
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	events := make([]reconcileFinding, len(r.events))
+	copy(events, r.events)
+	return events
+}
+
+// writeMetrics writes the reconciliation metrics in the Prometheus text format
+func (r *reconcileReport) writeMetrics(w io.Writer) {
+	if r == nil {
+		return
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	fmt.Fprintln(w, "# HELP cepher_reconcile_runs_total Reconciliations run")
+	fmt.Fprintln(w, "# TYPE cepher_reconcile_runs_total counter")
+	fmt.Fprintf(w, "cepher_reconcile_runs_total %d\n", r.runs)
+	fmt.Fprintln(w, "# HELP cepher_reconcile_failures_total Reconciliations that failed")
+	fmt.Fprintln(w, "# TYPE cepher_reconcile_failures_total counter")
+	fmt.Fprintf(w, "cepher_reconcile_failures_total %d\n", r.failures)
+	if !r.lastRun.IsZero() {
+		fmt.Fprintln(w, "# HELP cepher_reconcile_last_run_timestamp_seconds Time of the last reconciliation")
+		fmt.Fprintln(w, "# TYPE cepher_reconcile_last_run_timestamp_seconds gauge")
+		fmt.Fprintf(w, "cepher_reconcile_last_run_timestamp_seconds %d\n", r.lastRun.Unix())
+	}
+	fmt.Fprintln(w, "# HELP cepher_reconcile_findings Findings of the last reconciliation")
+	fmt.Fprintln(w, "# TYPE cepher_reconcile_findings gauge")
+	for _, kind := range findingKinds {
+		fmt.Fprintf(w, "cepher_reconcile_findings{kind=%q} %d\n", kind, r.findings[kind])
+	}
+	fmt.Fprintln(w, "# HELP cepher_reconcile_fixed_total Findings fixed by the reconciler")
+	fmt.Fprintln(w, "# TYPE cepher_reconcile_fixed_total counter")
+	for _, kind := range findingKinds {
+		fmt.Fprintf(w, "cepher_reconcile_fixed_total{kind=%q} %d\n", kind, r.fixed[kind])
+	}
+}
+
+// releaseStaleMappings unmaps the devices of an image left mapped by the plugin, like after a failed
+// unmount, so that it can be mapped again. Must be called with d.m and the image mount lock held
+func (d *cephRBDVolumeDriver) releaseStaleMappings(pool, name string, volumes map[string]*Volume) error {
+	inUse := make(map[string]bool)
+	for _, v := range volumes {
+		inUse[v.Device] = true
+	}
+	var mapped map[string]*Volume
+	var cryptMappings map[string]string
+	for device, t := range d.inventory.mappedDevices() {
+		if t.Pool != pool || t.Name != name || inUse[device] {
+			continue
+		}
+		if mapped == nil {
+			var err error
+			if mapped, err = d.mappedDevicesByDevice(); err != nil {
+				return err
+			}
+			if cryptMappings, err = listCryptMappings(); err != nil {
+				return fmt.Errorf("error getting dm-crypt mappings: %s", err)
+			}
+		}
+		if v, ok := mapped[device]; !ok || v.Pool != pool || v.Name != name {
+			// unmapped outside the plugin. The device may be in use by another image now
+			d.inventory.removeMapped(device)
+			continue
+		}
+		logrus.Infof("Unmapping stale device %s of RBD Image %s/%s before mapping it again", device, pool, name)
+		if err := d.releaseVolumeDevice(device, cryptMappings[device]); err != nil {
+			return fmt.Errorf("error unmapping stale device %s of RBD Image %s/%s: %s", device, pool, name, err)
+		}
+	}
+	return nil
+}
+
+func (d *cephRBDVolumeDriver) mappedDevicesByDevice() (map[string]*Volume, error) {
+	mapped, err := d.listMappedDevices()
+	if err != nil {
+		return nil, fmt.Errorf("error getting mapped devices: %s", err)
+	}
+	devices := make(map[string]*Volume)
+	for _, v := range mapped {
+		devices[v.Device] = v
+	}
+	return devices, nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMappedDevices(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cepher-inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "inventory.json")
+
+	inv, err := loadInventory(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv.setMapped("/dev/nbd0", "volumes", "a")
+	inv.setMapped("/dev/nbd1", "volumes", "b")
+	inv.removeMapped("/dev/nbd1")
+
+	inv, err = loadInventory(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices := inv.mappedDevices()
+	if len(devices) != 1 || devices["/dev/nbd0"].Name != "a" || devices["/dev/nbd0"].MappedAt.IsZero() {
+		t.Fatalf("expected /dev/nbd0 to be tracked but got %+v", devices)
+	}
+
+	var nilInventory *inventory
+	nilInventory.setMapped("/dev/nbd0", "volumes", "a")
+	if len(nilInventory.mappedDevices()) != 0 {
+		t.Fatal("expected no devices in nil inventory")
+	}
+}
+
+func TestParseReconcileFix(t *testing.T) {
+	fix, err := parseReconcileFix("orphan-device, stale-lock")
+	if err != nil || len(fix) != 2 || !fix[findingOrphanDevice] || !fix[findingStaleLock] {
+		t.Fatalf("unexpected fix kinds %v: %v", fix, err)
+	}
+	fix, err = parseReconcileFix("all")
+	if err != nil || len(fix) != len(findingKinds) {
+		t.Fatalf("expected all kinds but got %v: %v", fix, err)
+	}
+	fix, err = parseReconcileFix("")
+	if err != nil || len(fix) != 0 {
+		t.Fatalf("expected no kinds but got %v: %v", fix, err)
+	}
+	if _, err := parseReconcileFix("orphan-device,everything"); err == nil {
+		t.Fatal("expected error for unknown kind")
+	}
+}
+
+func TestParseDockerContainerMounts(t *testing.T) {
+	d := cephRBDVolumeDriver{rootMountDir: "/mnt/cepher", defaultCephPool: "volumes"}
+	body := []byte(`[
+		{"Id": "a", "Mounts": [
+			{"Type": "volume", "Name": "volumes/db", "Driver": "cepher", "Destination": "/data"},
+			{"Type": "bind", "Source": "/etc/hosts", "Destination": "/etc/hosts"}
+		]},
+		{"Id": "b", "Mounts": [{"Type": "volume", "Name": "volumes/backup#ro", "Driver": "cepher", "Destination": "/backup"}]}
+	]`)
+	referenced, err := d.parseDockerContainerMounts(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(referenced) != 2 || !referenced["/mnt/cepher/volumes/db:rw"] || !referenced["/mnt/cepher/volumes/backup:ro"] {
+		t.Fatalf("unexpected referenced mounts %v", referenced)
+	}
+	if _, err := d.parseDockerContainerMounts([]byte("not json")); err == nil {
+		t.Fatal("expected error for invalid body")
+	}
+}
+
+func TestReconcileEmptyMountDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cepher-mounts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	empty := filepath.Join(dir, "volumes", "empty:rw")
+	mounted := filepath.Join(dir, "volumes", "mounted:rw")
+	written := filepath.Join(dir, "volumes", "written:rw")
+	hung := filepath.Join(dir, "volumes", "hung:rw")
+	for _, p := range []string{empty, mounted, written, hung} {
+		if err := os.MkdirAll(p, 0775); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(written, "data"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	d := cephRBDVolumeDriver{rootMountDir: dir, reconcileFixKinds: map[string]bool{findingEmptyMountDir: true}}
+	findings := d.reconcileEmptyMountDirs(map[string]*Volume{mounted: {Pool: "volumes", Name: "mounted"}}, []*Volume{{Device: "/dev/nbd3", Mountpath: hung}})
+	if len(findings) != 2 {
+		t.Fatalf("expected 2 findings but got %+v", findings)
+	}
+	for _, f := range findings {
+		switch f.Path {
+		case empty:
+			if !f.Fixed || f.Volume != "volumes/empty" {
+				t.Fatalf("expected empty dir to be removed but got %+v", f)
+			}
+		case written:
+			if f.Fixed {
+				t.Fatalf("expected dir with files to be left alone but got %+v", f)
+			}
+		default:
+			t.Fatalf("unexpected finding %+v", f)
+		}
+	}
+	if _, err := os.Stat(empty); !os.IsNotExist(err) {
+		t.Fatal("expected empty mount dir to be removed")
+	}
+	if _, err := os.Stat(filepath.Join(written, "data")); err != nil {
+		t.Fatal("expected files to be kept")
+	}
+}
+
+func TestReconcileReport(t *testing.T) {
+	r := newReconcileReport()
+	r.record([]reconcileFinding{
+		{Kind: findingOrphanDevice, Device: "/dev/nbd0", Fixed: true},
+		{Kind: findingStaleLock, Volume: "volumes/a"},
+	}, nil)
+	r.record(nil, errors.New("rbd unavailable"))
+	for i := 0; i < maxReconcileEvents+10; i++ {
+		r.record([]reconcileFinding{{Kind: findingEmptyMountDir}}, nil)
+	}
+	if events := r.recentEvents(); len(events) != maxReconcileEvents {
+		t.Fatalf("expected %d events but got %d", maxReconcileEvents, len(events))
+	}
+
+	var buf bytes.Buffer
+	r.writeMetrics(&buf)
+	metrics := buf.String()
+	for _, expected := range []string{
+		"cepher_reconcile_runs_total 212\n",
+		"cepher_reconcile_failures_total 1\n",
+		`cepher_reconcile_findings{kind="empty-mountdir"} 1` + "\n",
+		`cepher_reconcile_findings{kind="orphan-device"} 0` + "\n",
+		`cepher_reconcile_fixed_total{kind="orphan-device"} 1` + "\n",
+	} {
+		if !strings.Contains(metrics, expected) {
+			t.Fatalf("expected %q in metrics:\n%s", expected, metrics)
+		}
+	}
+
+	var nilReport *reconcileReport
+	nilReport.record(nil, nil)
+	if nilReport.recentEvents() != nil {
+		t.Fatal("expected no events in nil report")
+	}
+}
+
+func TestIsOwnLockHolder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cepher-own-locks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	locks, err := newFileLockProvider(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := cephRBDVolumeDriver{locks: locks, nodeID: "node1"}
+	if !d.isOwnLockHolder(lockHolder{NodeID: "node1", Owner: "previous-run"}) {
+		t.Fatal("expected lock of a previous run of this host to be its own")
+	}
+	if !d.isOwnLockHolder(lockHolder{NodeID: "node1", Owner: locks.ID()}) {
+		t.Fatal("expected lock of this session to be its own")
+	}
+	if d.isOwnLockHolder(lockHolder{NodeID: "node2", Owner: "other"}) {
+		t.Fatal("expected lock of another host not to be its own")
+	}
+}
+
+func TestReconcileStaleLocksOfMountedDeadDevice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cepher-stale-locks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	locks, err := newFileLockProvider(filepath.Join(dir, "locks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := cephRBDVolumeDriver{
+		locks:             locks,
+		nodeID:            "node1",
+		rootMountDir:      filepath.Join(dir, "mnt"),
+		reconcileFixKinds: map[string]bool{findingStaleLock: true},
+	}
+	key := d.mountLockKey("volumes", "a")
+	if err := locks.NewLock(key, lockHolder{NodeID: "node1", Owner: locks.ID()}).RWLock(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// the rbd-nbd daemon of /dev/nbd0 died, so it is not listed as mapped, but it is still mounted
+	tracked := map[string]mappedDevice{"/dev/nbd0": {Pool: "volumes", Name: "a"}}
+	mounts := []*Volume{{Device: "/dev/nbd0", Mountpath: filepath.Join(dir, "mnt", "volumes", "a")}}
+	findings, err := d.reconcileStaleLocks(d.mountedVolumeNames(map[string]*Volume{}, tracked, mounts, map[string]string{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 0 {
+		t.Fatalf("expected no stale lock for a mounted volume but got %+v", findings)
+	}
+	if holders, err := locks.Holders(key); err != nil || len(holders) != 1 {
+		t.Fatalf("expected mount lock of a mounted volume to be kept but got %v %v", holders, err)
+	}
+
+	// once unmounted, the lock is stale
+	findings, err = d.reconcileStaleLocks(d.mountedVolumeNames(map[string]*Volume{}, tracked, nil, map[string]string{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(findings) != 1 || !findings[0].Fixed {
+		t.Fatalf("expected stale lock to be released but got %+v", findings)
+	}
+}
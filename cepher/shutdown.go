@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// values of the shutdown-locks policy, which tells what happens to the locks of this host on shutdown
+// The lock session is only revoked when no volume is still mounted, as revoking it would let other
+// hosts mount volumes this host is still attached to
+const (
+	// the lock session is revoked, so that all locks of this host are released right away
+	shutdownReleaseLocks = "release"
+	// volumes requested by other hosts are unmounted first, then the lock session is revoked
+	shutdownHandoffLocks = "handoff"
+	// the lock session is left to expire, so volumes still mounted stay locked for its TTL
+	shutdownKeepLocks = "keep"
+)
+
+func validateShutdownLocks(policy string) error {
+	switch policy {
+	case shutdownReleaseLocks, shutdownHandoffLocks, shutdownKeepLocks:
+		return nil
+	}
+	return fmt.Errorf("invalid shutdown locks policy '%s'. Must be '%s', '%s' or '%s'", policy, shutdownReleaseLocks, shutdownHandoffLocks, shutdownKeepLocks)
+}
+
+// sleepOrStop waits for interval. Returns false if the plugin is shutting down
+func (d *cephRBDVolumeDriver) sleepOrStop(interval time.Duration) bool {
+	select {
+	case <-time.After(interval):
+		return true
+	case <-d.stopping:
+		return false
+	}
+}
+
+// operationTracker tracks the API requests and background loops in progress, so that shutdown can
+// wait for them. No operation starts after stop. A nil tracker tracks nothing
+type operationTracker struct {
+	m       sync.Mutex
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+// start registers an operation. Returns false if the tracker is stopped
+func (t *operationTracker) start() bool {
+	if t == nil {
+		return true
+	}
+	t.m.Lock()
+	defer t.m.Unlock()
+	if t.stopped {
+		return false
+	}
+	t.wg.Add(1)
+	return true
+}
+
+// done must be called when an operation registered by start finishes
+func (t *operationTracker) done() {
+	if t == nil {
+		return
+	}
+	t.wg.Done()
+}
+
+// stop refuses new operations and waits for the ones in progress up to timeout. Returns false on timeout
+func (t *operationTracker) stop(timeout time.Duration) bool {
+	if t == nil {
+		return true
+	}
+	t.m.Lock()
+	t.stopped = true
+	t.m.Unlock()
+	return waitTimeout(&t.wg, timeout)
+}
+
+// startRequest registers an API request. Returns an error if the plugin is shutting down.
+// The request must call d.operations.done() when it finishes
+func (d *cephRBDVolumeDriver) startRequest(op string) error {
+	if !d.operations.start() {
+		err := fmt.Errorf("plugin is shutting down. %s refused", op)
+		logrus.Warnf("%s", err)
+		return err
+	}
+	return nil
+}
+
+// goBackground runs loop in background. Shutdown waits for it to return, so it must return when
+// the plugin is shutting down
+func (d *cephRBDVolumeDriver) goBackground(loop func()) {
+	if !d.operations.start() {
+		return
+	}
+	go func() {
+		defer d.operations.done()
+		loop()
+	}()
+}
+
+// stopContext returns a context that is cancelled when the plugin shuts down or done is closed
+func (d *cephRBDVolumeDriver) stopContext(done <-chan struct{}) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-d.stopping:
+		case <-done:
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	return ctx, cancel
+}
+
+// shutdown stops the plugin gracefully. New requests are refused, background loops are stopped and
+// the requests and loops in progress may finish within timeout. The driver mutex is kept afterwards.
+// Then the locks are released according to shutdownLocks and the inventory is written
+func (d *cephRBDVolumeDriver) shutdown(timeout time.Duration) {
+	logrus.Infof("Shutting down. Waiting up to %s for operations in progress", timeout)
+	if d.stopping != nil {
+		close(d.stopping)
+	}
+	deadline := time.Now().Add(timeout)
+
+	idle := d.operations.stop(timeout)
+	// the lock state is read under the driver mutex, which operations still in progress may hold
+	locked := d.lockWithin(time.Until(deadline))
+	if idle && locked {
+		logrus.Infof("Operations in progress finished")
+	} else {
+		logrus.Warnf("Operations still in progress after %s. They will be interrupted, and interrupted creates are rolled back on the next start", timeout)
+	}
+	if locked {
+		d.releaseLocksOnShutdown(idle)
+	} else if d.locks != nil {
+		logrus.Warnf("Keeping the lock session until it expires, as the mounted volumes can't be read while operations are in progress")
+	}
+	d.inventory.flush()
+	logrus.Infof("Shutdown complete")
+}
+
+// lockWithin takes the driver mutex, waiting up to timeout. Returns false on timeout, in which case
+// the mutex is taken whenever it is released, so that no other operation runs afterwards
+func (d *cephRBDVolumeDriver) lockWithin(timeout time.Duration) bool {
+	locked := make(chan struct{})
+	go func() {
+		d.m.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// releaseLocksOnShutdown releases the locks of this host according to shutdownLocks. Volumes are
+// only handed over if no operation is in progress (idle). Must be called with d.m held
+func (d *cephRBDVolumeDriver) releaseLocksOnShutdown(idle bool) {
+	if d.locks == nil {
+		return
+	}
+	switch d.shutdownLocks {
+	case shutdownKeepLocks:
+		if mounted := d.mountLockedVolumes(); len(mounted) > 0 {
+			logrus.Infof("Keeping mount locks of volumes %v until the lock session expires", mounted)
+		}
+		return
+	case shutdownHandoffLocks:
+		if idle {
+			d.handoffOnShutdown()
+		} else {
+			logrus.Warnf("Skipping handoff of volumes, as operations are still in progress")
+		}
+	}
+
+	if mounted := d.mountLockedVolumes(); len(mounted) > 0 {
+		logrus.Warnf("Keeping the lock session until it expires, as volumes %v are still mounted on this host", mounted)
+		return
+	}
+	if err := d.locks.Close(); err != nil {
+		logrus.Warnf("error closing lock session: %s. Locks are released when it expires", err)
+		return
+	}
+	logrus.Infof("Lock session closed")
+}
+
+// mountLockedVolumes returns the names of the volumes this host holds mount locks for
+func (d *cephRBDVolumeDriver) mountLockedVolumes() []string {
+	mounted := make([]string, 0)
+	for volumeName := range d.volumeMountLocks {
+		mounted = append(mounted, volumeName)
+	}
+	sort.Strings(mounted)
+	return mounted
+}
+
+// handoffOnShutdown unmounts the volumes requested by other hosts, so that they can be mapped
+// there right away
+func (d *cephRBDVolumeDriver) handoffOnShutdown() {
+	if len(d.releaseRequests) == 0 {
+		return
+	}
+	volumes, err := d.currentVolumes()
+	if err != nil {
+		logrus.Warnf("error getting mounted volumes for handoff: %s", err)
+		return
+	}
+	for _, v := range volumes {
+		volumeName := v.Pool + "/" + v.Name
+		requests, requested := d.releaseRequests[volumeName]
+		if !requested {
+			continue
+		}
+		logrus.Infof("Handing over volume %s to %v on shutdown", volumeName, requests)
+		if err := d.releaseMount(v); err != nil {
+			logrus.Warnf("error handing over volume %s: %s", volumeName, err)
+			continue
+		}
+		delete(d.releaseRequests, volumeName)
+	}
+}
+
+// waitTimeout waits for wg up to timeout. Returns false on timeout
+func waitTimeout(wg *sync.WaitGroup, timeout time.Duration) bool {
+	if wg == nil {
+		return true
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
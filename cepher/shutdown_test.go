@@ -0,0 +1,165 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// closeRecordingLockProvider records whether the lock session was closed
+type closeRecordingLockProvider struct {
+	*fileLockProvider
+	closed bool
+}
+
+func (p *closeRecordingLockProvider) Close() error {
+	p.closed = true
+	return nil
+}
+
+func TestValidateShutdownLocks(t *testing.T) {
+	for _, policy := range []string{shutdownReleaseLocks, shutdownHandoffLocks, shutdownKeepLocks} {
+		if err := validateShutdownLocks(policy); err != nil {
+			t.Fatalf("expected %s to be valid: %s", policy, err)
+		}
+	}
+	if err := validateShutdownLocks("drop"); err == nil {
+		t.Fatal("expected error for unknown policy")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cepher-shutdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	inv, err := loadInventory(filepath.Join(dir, "inventory.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, err := newFileLockProvider(filepath.Join(dir, "locks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, policy := range []string{shutdownReleaseLocks, shutdownKeepLocks} {
+		locks := &closeRecordingLockProvider{fileLockProvider: files}
+		d := cephRBDVolumeDriver{
+			m:                &sync.Mutex{},
+			stopping:         make(chan struct{}),
+			operations:       &operationTracker{},
+			inventory:        inv,
+			locks:            locks,
+			shutdownLocks:    policy,
+			volumeMountLocks: make(map[string]map[string]volumeLock),
+		}
+
+		// operations in progress finish before the plugin stops, like mounts waiting for their
+		// mount lock outside the driver mutex
+		if err := d.startRequest("mount"); err != nil {
+			t.Fatal(err)
+		}
+		d.m.Lock()
+		finished := false
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			d.m.Unlock()
+			time.Sleep(50 * time.Millisecond)
+			finished = true
+			d.operations.done()
+		}()
+		loopStopped := false
+		d.goBackground(func() {
+			d.sleepOrStop(time.Hour)
+			loopStopped = true
+		})
+		d.shutdown(5 * time.Second)
+		if !finished {
+			t.Fatal("expected shutdown to wait for the operation in progress")
+		}
+		if !loopStopped {
+			t.Fatal("expected shutdown to wait for background loops to stop")
+		}
+		if d.sleepOrStop(time.Hour) {
+			t.Fatal("expected background loops to stop")
+		}
+		if err := d.startRequest("mount"); err == nil {
+			t.Fatal("expected requests to be refused after shutdown")
+		}
+		if locks.closed != (policy == shutdownReleaseLocks) {
+			t.Fatalf("unexpected lock session state with policy %s: closed=%v", policy, locks.closed)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "inventory.json")); err != nil {
+		t.Fatalf("expected inventory to be written: %s", err)
+	}
+
+	// operations that don't finish in time don't hold the plugin. The lock session is kept, as the
+	// mounted volumes can't be read while they hold the driver mutex
+	locks := &closeRecordingLockProvider{fileLockProvider: files}
+	d := cephRBDVolumeDriver{
+		m:                &sync.Mutex{},
+		operations:       &operationTracker{},
+		locks:            locks,
+		shutdownLocks:    shutdownReleaseLocks,
+		volumeMountLocks: make(map[string]map[string]volumeLock),
+	}
+	d.m.Lock()
+	d.operations.start()
+	start := time.Now()
+	d.shutdown(50 * time.Millisecond)
+	if time.Since(start) > 2*time.Second {
+		t.Fatalf("expected shutdown to give up after its timeout, but took %s", time.Since(start))
+	}
+	if locks.closed {
+		t.Fatal("expected lock session to be kept while operations hold the driver mutex")
+	}
+}
+
+func TestStopContext(t *testing.T) {
+	d := cephRBDVolumeDriver{stopping: make(chan struct{})}
+	done := make(chan struct{})
+	ctx, cancel := d.stopContext(done)
+	defer cancel()
+	close(done)
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected context to be cancelled when done is closed")
+	}
+
+	ctx, cancel = d.stopContext(nil)
+	defer cancel()
+	close(d.stopping)
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("expected context to be cancelled on shutdown")
+	}
+}
+
+func TestShutdownKeepsSessionOfMountedVolumes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cepher-shutdown-mounted")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files, err := newFileLockProvider(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	locks := &closeRecordingLockProvider{fileLockProvider: files}
+	d := cephRBDVolumeDriver{
+		locks:            locks,
+		shutdownLocks:    shutdownReleaseLocks,
+		volumeMountLocks: map[string]map[string]volumeLock{"volumes/a": {"caller1": nil}},
+	}
+	d.releaseLocksOnShutdown(true)
+	if locks.closed {
+		t.Fatal("expected lock session of a host with mounted volumes not to be closed")
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// imageParent is the parent snapshot of a cloned RBD Image
+type imageParent struct {
+	Pool     string `json:"pool"`
+	Image    string `json:"image"`
+	Snapshot string `json:"snapshot"`
+	Overlap  uint64 `json:"overlap"`
+}
+
+// imageSnapshot is an item of 'rbd snap ls --format json'
+type imageSnapshot struct {
+	ID        uint64 `json:"id"`
+	Name      string `json:"name"`
+	Size      uint64 `json:"size"`
+	Timestamp string `json:"timestamp"`
+}
+
+// imageDiskUsage is the output of 'rbd du --format json'
+type imageDiskUsage struct {
+	Images []struct {
+		Name            string `json:"name"`
+		Snapshot        string `json:"snapshot"`
+		ProvisionedSize uint64 `json:"provisioned_size"`
+		UsedSize        uint64 `json:"used_size"`
+	} `json:"images"`
+	TotalProvisionedSize uint64 `json:"total_provisioned_size"`
+	TotalUsedSize        uint64 `json:"total_used_size"`
+}
+
+// filesystemUsage is the usage of a locally mounted volume filesystem
+type filesystemUsage struct {
+	SizeBytes      uint64 `json:"sizeBytes"`
+	UsedBytes      uint64 `json:"usedBytes"`
+	AvailableBytes uint64 `json:"availableBytes"`
+	Inodes         uint64 `json:"inodes"`
+	InodesFree     uint64 `json:"inodesFree"`
+}
+
+// addImageStatus adds the image details shown by 'docker volume inspect' to status.
+// Details that can't be retrieved are reported as '[name]Error' instead of failing the request
+func (d *cephRBDVolumeDriver) addImageStatus(status map[string]interface{}, pool, name, mountPoint string, info *imageInfo) {
+	status["sizeBytes"] = info.Size
+	status["features"] = info.Features
+	status["format"] = info.Format
+	if len(info.Flags) > 0 {
+		status["flags"] = info.Flags
+	}
+	if info.Parent != nil {
+		status["parent"] = info.Parent
+	}
+
+	// without fast-diff, 'rbd du' reads every object of the image, which is too slow for each inspect
+	if !hasImageFeature(info, "fast-diff") {
+		status["usedBytesError"] = "not computed for images without the fast-diff feature"
+	} else if usage, err := d.rbdDiskUsage(pool, name); err != nil {
+		logrus.Warnf("couldn't get disk usage of %s/%s: %s", pool, name, err)
+		status["usedBytesError"] = err.Error()
+	} else {
+		for _, i := range usage.Images {
+			if i.Name == name && i.Snapshot == "" {
+				status["usedBytes"] = i.UsedSize
+			}
+		}
+		status["totalUsedBytes"] = usage.TotalUsedSize
+	}
+
+	snapshots, err := d.rbdSnapshots(pool, name)
+	if err != nil {
+		logrus.Warnf("couldn't list snapshots of %s/%s: %s", pool, name, err)
+		status["snapshotsError"] = err.Error()
+	} else {
+		status["snapshots"] = snapshots
+	}
+
+	device, cryptName, err := d.localDevice(pool, name)
+	if err != nil {
+		logrus.Warnf("couldn't find local device of %s/%s: %s", pool, name, err)
+		status["deviceError"] = err.Error()
+	} else if device != "" {
+		status["device"] = device
+		if cryptName != "" {
+			status["cryptDevice"] = "/dev/mapper/" + cryptName
+		}
+	}
+
+	if options, ok := status["options"].(map[string]string); ok && options["mode"] == modeBlock {
+		if mountPoint != "" {
+			status["blockDevice"] = filepath.Join(mountPoint, blockDeviceNodeName)
+		}
+	} else if mountPoint != "" {
+		fsUsage, err := statFilesystem(mountPoint)
+		if err != nil {
+			logrus.Warnf("couldn't get filesystem usage of %s: %s", mountPoint, err)
+			status["filesystemError"] = err.Error()
+		} else {
+			status["filesystem"] = fsUsage
+		}
+	}
+}
+
+// hasImageFeature returns true if the image has the feature enabled
+func hasImageFeature(info *imageInfo, feature string) bool {
+	for _, f := range info.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// rbdDiskUsage returns the provisioned and used sizes of the image and its snapshots.
+// Fast with the fast-diff image feature, otherwise all objects of the image are checked
+func (d *cephRBDVolumeDriver) rbdDiskUsage(pool, name string) (*imageDiskUsage, error) {
+	out, err := d.rbdsh(pool, "du", name, "--format", "json")
+	if err != nil {
+		return nil, err
+	}
+	var usage imageDiskUsage
+	if err := json.Unmarshal([]byte(out), &usage); err != nil {
+		return nil, fmt.Errorf("error parsing rbd du output: %s", err)
+	}
+	return &usage, nil
+}
+
+// rbdSnapshots returns the snapshots of the image
+func (d *cephRBDVolumeDriver) rbdSnapshots(pool, name string) ([]imageSnapshot, error) {
+	out, err := d.rbdsh(pool, "snap", "ls", name, "--format", "json")
+	if err != nil {
+		return nil, err
+	}
+	snapshots := make([]imageSnapshot, 0)
+	if err := json.Unmarshal([]byte(out), &snapshots); err != nil {
+		return nil, fmt.Errorf("error parsing rbd snap ls output: %s", err)
+	}
+	return snapshots, nil
+}
+
+// localDevice returns the device the image is mapped to in this host and its dm-crypt mapping,
+// if the image is encrypted
+func (d *cephRBDVolumeDriver) localDevice(pool, name string) (device string, cryptName string, err error) {
+	mapped, err := d.listMappedDevices()
+	if err != nil {
+		return "", "", err
+	}
+	for _, v := range mapped {
+		if v.Pool != pool || v.Name != name {
+			continue
+		}
+		cryptMappings, err := listCryptMappings()
+		if err != nil {
+			return v.Device, "", err
+		}
+		return v.Device, cryptMappings[v.Device], nil
+	}
+	return "", "", nil
+}
+
+// statFilesystem returns the usage of the filesystem mounted at path
+func statFilesystem(path string) (*filesystemUsage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return nil, err
+	}
+	bsize := uint64(st.Bsize)
+	return &filesystemUsage{
+		SizeBytes:      st.Blocks * bsize,
+		UsedBytes:      (st.Blocks - st.Bfree) * bsize,
+		AvailableBytes: st.Bavail * bsize,
+		Inodes:         st.Files,
+		InodesFree:     st.Ffree,
+	}, nil
+}
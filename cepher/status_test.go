@@ -0,0 +1,31 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+)
+
+func TestImageInfoParent(t *testing.T) {
+	out := `{"name":"clone1","size":104857600,"format":2,"features":["layering"],"flags":[],"parent":{"pool":"volumes","image":"base","snapshot":"gold","overlap":104857600}}`
+	var info imageInfo
+	if err := json.Unmarshal([]byte(out), &info); err != nil {
+		t.Fatal(err)
+	}
+	if info.Parent == nil || info.Parent.Image != "base" || info.Parent.Snapshot != "gold" {
+		t.Fatalf("unexpected parent %+v", info.Parent)
+	}
+	if !hasImageFeature(&info, "layering") || hasImageFeature(&info, "fast-diff") {
+		t.Fatalf("unexpected features %v", info.Features)
+	}
+}
+
+func TestStatFilesystem(t *testing.T) {
+	usage, err := statFilesystem(os.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if usage.SizeBytes == 0 || usage.UsedBytes > usage.SizeBytes || usage.AvailableBytes > usage.SizeBytes {
+		t.Fatalf("unexpected filesystem usage %+v", usage)
+	}
+}
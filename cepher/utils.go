@@ -6,19 +6,26 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"net"
 	"os/exec"
 	"os/user"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-cmd/cmd"
 	"github.com/sirupsen/logrus"
 )
 
+// shell command timeouts by operation class. Set from the timeout-* flags
 var (
 	defaultShellTimeout = 2 * 60 * time.Second
+	mapShellTimeout     = 60 * time.Second     // rbd map/unmap and cryptsetup open/close
+	mkfsShellTimeout    = 5 * 60 * time.Second // mkfs and luksFormat of new images
+	fsckShellTimeout    = 2 * 60 * time.Second // filesystem checks before mounting
+	listShellTimeout    = 30 * time.Second     // image and pool listing
 )
 
 // returns current user gid or 0
@@ -36,6 +43,22 @@ func currentGid() int {
 	return gid
 }
 
+// hostIPAddresses returns the non loopback IP addresses of this host
+func hostIPAddresses() []string {
+	var ips []string
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		logrus.Warnf("unable to get host IP addresses: %s", err)
+		return ips
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
+			ips = append(ips, ipnet.IP.String())
+		}
+	}
+	return ips
+}
+
 // sh is a simple os.exec Command tool, returns trimmed string output
 func sh(name string, args ...string) (string, error) {
 	cmd := exec.Command(name, args...)
@@ -57,7 +80,7 @@ type ShTimeoutError struct {
 }
 
 func (e ShTimeoutError) Error() string {
-	return fmt.Sprintf("Reached TIMEOUT on shell command")
+	return fmt.Sprintf("Reached TIMEOUT on shell command after %s", e.timeout)
 }
 
 // shWithDefaultTimeout will use the defaultShellTimeout so you dont have to pass one
@@ -121,6 +144,7 @@ func ExecShellTimeout(timeout time.Duration, command string, args ...string) (st
 	acmd := cmd.NewCmd("bash", "-c", command)
 	statusChan := acmd.Start() // non-blocking
 	running := true
+	var timedOut int32
 	// if ctx != nil {
 	// 	ctx.CmdRef = acmd
 	// }
@@ -133,6 +157,7 @@ func ExecShellTimeout(timeout time.Duration, command string, args ...string) (st
 			for running {
 				if time.Since(startTime) >= timeout {
 					logrus.Warnf("Stopping command execution because it is taking too long (%d seconds)", time.Since(startTime))
+					atomic.StoreInt32(&timedOut, 1)
 					acmd.Stop()
 				}
 				time.Sleep(1 * time.Second)
@@ -148,6 +173,9 @@ func ExecShellTimeout(timeout time.Duration, command string, args ...string) (st
 	out := GetCmdOutput(acmd)
 	status := acmd.Status()
 	logrus.Debugf("shell output (%d): %s", status.Exit, out)
+	if atomic.LoadInt32(&timedOut) == 1 {
+		return out, ShTimeoutError{timeout: timeout}
+	}
 	if status.Exit != 0 {
 		return out, fmt.Errorf("Failed to run command: '%s'; exit=%d; out=%s", command, status.Exit, out)
 	}
@@ -168,6 +196,11 @@ func GetCmdOutput(cmd *cmd.Cmd) string {
 	return out
 }
 
+// isTrashImageName returns true for the names generated by generateImageBackupName
+func isTrashImageName(name string) bool {
+	return trashImageNameRegexp.MatchString(name)
+}
+
 func generateImageBackupName(name string, nameList []string) (string, error) {
 	backupPrefix := "trash"
 	count := 0
@@ -190,3 +223,9 @@ func generateImageBackupName(name string, nameList []string) (string, error) {
 	}
 	return fmt.Sprintf("%s_%d_%s", backupPrefix, count, name), nil
 }
+
+// shellQuote quotes a value for the bash command line built by ExecShellTimeout,
+// so that values with spaces or shell characters are passed as a single argument
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
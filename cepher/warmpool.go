@@ -0,0 +1,266 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// warmImagePrefix starts the names of the pre-formatted images kept in the warm pool.
+// They are named warm_[profile]_[random id] and are not listed as volumes
+const warmImagePrefix = "warm_"
+
+var warmProfileNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9-]+$`)
+
+// warmProfile describes a kind of image kept pre-created and formatted, so that volume creates
+// with the same settings only have to rename one of them instead of waiting for mkfs
+type warmProfile struct {
+	name     string
+	pool     string
+	size     int
+	fstype   string
+	features string
+	dataPool string
+	count    int
+}
+
+// parseWarmProfiles parses profiles like 'ci:pool=volumes,size=1024,features=layering+striping,count=3;big:size=102400'.
+// Settings not given are taken from the driver defaults. count defaults to 1
+func (d *cephRBDVolumeDriver) parseWarmProfiles(spec string) ([]warmProfile, error) {
+	profiles := make([]warmProfile, 0)
+	for _, profileSpec := range strings.Split(spec, ";") {
+		profileSpec = strings.TrimSpace(profileSpec)
+		if profileSpec == "" {
+			continue
+		}
+		parts := strings.SplitN(profileSpec, ":", 2)
+		if !warmProfileNameRegexp.MatchString(parts[0]) {
+			return nil, fmt.Errorf("invalid warm pool profile name '%s'. Use letters, numbers and '-'", parts[0])
+		}
+		p := warmProfile{
+			name:     parts[0],
+			pool:     d.defaultCephPool,
+			size:     d.defaultImageSizeMB,
+			fstype:   d.defaultImageFSType,
+			features: d.defaultImageFeatures,
+			dataPool: d.defaultDataPool,
+			count:    1,
+		}
+		if len(parts) == 2 {
+			for _, kv := range strings.Split(parts[1], ",") {
+				nv := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+				if len(nv) != 2 {
+					return nil, fmt.Errorf("invalid setting '%s' in warm pool profile %s. Use [name]=[value]", kv, p.name)
+				}
+				if err := p.set(nv[0], nv[1]); err != nil {
+					return nil, fmt.Errorf("warm pool profile %s: %s", p.name, err)
+				}
+			}
+		}
+		if p.dataPool == p.pool {
+			p.dataPool = ""
+		}
+		profiles = append(profiles, p)
+	}
+	return profiles, nil
+}
+
+func (p *warmProfile) set(name, value string) error {
+	var err error
+	switch name {
+	case "pool":
+		p.pool = value
+	case "size":
+		p.size, err = strconv.Atoi(value)
+	case "fstype":
+		p.fstype = value
+	case "features":
+		// ',' separates the profile settings, so features are given like 'layering+striping'
+		p.features = strings.Replace(value, "+", ",", -1)
+	case "data-pool":
+		p.dataPool = value
+	case "count":
+		p.count, err = strconv.Atoi(value)
+	default:
+		return fmt.Errorf("unknown setting '%s'. Options are pool, size, fstype, features, data-pool and count", name)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid %s '%s': %s", name, value, err)
+	}
+	return nil
+}
+
+// matches returns true if images of the profile can be used for a volume created with these settings
+func (p warmProfile) matches(pool string, size int, fstype, features, dataPool string) bool {
+	return p.pool == pool && p.size == size && p.fstype == fstype && p.dataPool == dataPool &&
+		normalizeFeatures(p.features) == normalizeFeatures(features)
+}
+
+func normalizeFeatures(features string) string {
+	fs := make([]string, 0)
+	for _, f := range strings.Split(features, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			fs = append(fs, f)
+		}
+	}
+	sort.Strings(fs)
+	return strings.Join(fs, ",")
+}
+
+func (p warmProfile) imagePrefix() string {
+	return warmImagePrefix + p.name + "_"
+}
+
+// isWarmImageName returns true for the images kept in the warm pool
+func isWarmImageName(name string) bool {
+	return strings.HasPrefix(name, warmImagePrefix)
+}
+
+// claimWarmImage renames a warm image of a matching profile to name. Returns false if there
+// was no warm image available. Renames are atomic, so hosts never claim the same image
+func (d *cephRBDVolumeDriver) claimWarmImage(pool, name string, size int, fstype, features, dataPool string) (bool, error) {
+	for _, p := range d.warmProfiles {
+		if !p.matches(pool, size, fstype, features, dataPool) {
+			continue
+		}
+		images, err := d.warmImages(p)
+		if err != nil {
+			return false, err
+		}
+		for _, image := range images {
+			if _, err := d.rbdsh(pool, "rename", image, name); err != nil {
+				// claimed by another host in the meantime
+				logrus.Debugf("unable to claim warm image %s/%s: %s", pool, image, err)
+				continue
+			}
+			logrus.Infof("Claimed warm image %s/%s of profile %s for %s/%s", pool, image, p.name, pool, name)
+			d.imageListCache.invalidate()
+			return true, nil
+		}
+		logrus.Infof("Warm pool profile %s is empty. Creating image %s/%s", p.name, pool, name)
+	}
+	return false, nil
+}
+
+// warmImages returns the ready images of the profile
+func (d *cephRBDVolumeDriver) warmImages(p warmProfile) ([]string, error) {
+	images, err := d.rbdPoolImageList(p.pool)
+	if err != nil {
+		return nil, fmt.Errorf("error listing warm images of profile %s: %s", p.name, err)
+	}
+	warm := make([]string, 0)
+	for _, image := range images {
+		if !strings.HasPrefix(image, p.imagePrefix()) {
+			continue
+		}
+		initializing, _, err := d.isInitializing(p.pool, image)
+		if err != nil || initializing {
+			continue
+		}
+		warm = append(warm, image)
+	}
+	return warm, nil
+}
+
+// refillWarmPool keeps the warm pool filled. Only one host refills it at a time, the holder of the
+// warm pool lock. It stops refilling when its lock session is lost, as another host may take the
+// lock then, and waits for the lock again. Without a lock backend, every host refills it
+func (d *cephRBDVolumeDriver) refillWarmPool(interval time.Duration) {
+	if d.locks == nil {
+		d.refillWarmProfiles(interval, nil)
+		return
+	}
+	for {
+		lost := d.lockSession.done()
+		mutex := d.locks.NewLock("/cepher-warm-pool/refill", d.newLockHolder("", false))
+		ctx, cancel := d.stopContext(lost)
+		err := mutex.RWLock(ctx)
+		cancel()
+		if err != nil {
+			select {
+			case <-d.stopping:
+				return
+			case <-lost:
+				continue
+			default:
+			}
+			logrus.Warnf("error getting warm pool refill lock: %s", err)
+			if !d.sleepOrStop(interval) {
+				return
+			}
+			continue
+		}
+		logrus.Infof("This host is now refilling the warm pool")
+		if !d.refillWarmProfiles(interval, lost) {
+			return
+		}
+		logrus.Warnf("Lock session lost. This host stopped refilling the warm pool")
+	}
+}
+
+// refillWarmProfiles refills the profiles every interval. Returns false when the plugin shuts down
+// and true when lost is closed
+func (d *cephRBDVolumeDriver) refillWarmProfiles(interval time.Duration, lost <-chan struct{}) bool {
+	for {
+		for _, p := range d.warmProfiles {
+			d.refillWarmProfile(p, lost)
+		}
+		select {
+		case <-time.After(interval):
+		case <-d.stopping:
+			return false
+		case <-lost:
+			return true
+		}
+	}
+}
+
+func (d *cephRBDVolumeDriver) refillWarmProfile(p warmProfile, lost <-chan struct{}) {
+	if err := d.health.checkWritable(fmt.Sprintf("warm pool refill of profile %s", p.name)); err != nil {
+		logrus.Debugf("%s", err)
+		return
+	}
+	images, err := d.warmImages(p)
+	if err != nil {
+		logrus.Warnf("%s", err)
+		return
+	}
+	for i := len(images); i < p.count; i++ {
+		if !d.refillWarmImage(p, lost) {
+			return
+		}
+	}
+}
+
+// refillWarmImage adds an image to the warm pool. Returns false if no more images should be added,
+// as the plugin is shutting down or lost is closed. Shutdown waits for the image to be completed
+func (d *cephRBDVolumeDriver) refillWarmImage(p warmProfile, lost <-chan struct{}) bool {
+	select {
+	case <-d.stopping:
+		return false
+	case <-lost:
+		return false
+	default:
+	}
+	name := p.imagePrefix() + strings.Split(uuid.New().String(), "-")[0]
+	if err := d.checkCapacity(p.pool, p.dataPool, p.size, false); err != nil {
+		logrus.Warnf("Unable to refill warm pool profile %s: %s", p.name, err)
+		return false
+	}
+	if err := d.createRBDImage(p.pool, name, p.size, p.fstype, p.features, p.dataPool, false, false); err != nil {
+		logrus.Warnf("Unable to refill warm pool profile %s: %s", p.name, err)
+		return false
+	}
+	if err := d.finishCreate(p.pool, name); err != nil {
+		logrus.Warnf("Unable to refill warm pool profile %s: %s", p.name, err)
+		return false
+	}
+	logrus.Infof("Added warm image %s/%s to profile %s", p.pool, name, p.name)
+	return true
+}
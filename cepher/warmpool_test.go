@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestParseWarmProfiles(t *testing.T) {
+	d := &cephRBDVolumeDriver{defaultCephPool: "volumes", defaultImageSizeMB: 3072, defaultImageFSType: "xfs", defaultImageFeatures: "layering,striping"}
+	profiles, err := d.parseWarmProfiles("ci:size=1024,fstype=ext4,count=3; big:pool=large,features=striping+layering")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 2 {
+		t.Fatalf("expected 2 profiles but got %+v", profiles)
+	}
+	ci := profiles[0]
+	if ci.name != "ci" || ci.pool != "volumes" || ci.size != 1024 || ci.fstype != "ext4" || ci.count != 3 {
+		t.Fatalf("unexpected profile %+v", ci)
+	}
+	if !ci.matches("volumes", 1024, "ext4", "striping,layering", "") {
+		t.Fatal("expected profile to match")
+	}
+	if ci.matches("volumes", 2048, "ext4", "layering,striping", "") || ci.matches("other", 1024, "ext4", "layering,striping", "") {
+		t.Fatal("expected profile not to match")
+	}
+	big := profiles[1]
+	if big.pool != "large" || big.size != 3072 || big.count != 1 || !big.matches("large", 3072, "xfs", "layering,striping", "") {
+		t.Fatalf("unexpected profile %+v", big)
+	}
+
+	for _, spec := range []string{"c_i:count=1", "ci:count", "ci:count=x", "ci:color=blue"} {
+		if _, err := d.parseWarmProfiles(spec); err == nil {
+			t.Errorf("expected error for warm pool '%s'", spec)
+		}
+	}
+}
+
+func TestIsWarmImageName(t *testing.T) {
+	p := warmProfile{name: "ci"}
+	if !isWarmImageName(p.imagePrefix()+"1a2b3c4d") || isWarmImageName("myvolume") {
+		t.Fatal("unexpected warm image name detection")
+	}
+}
@@ -4,7 +4,7 @@ go 1.12
 
 require (
 	github.com/coreos/etcd v3.3.13+incompatible
-	github.com/docker/go-connections v0.4.0 // indirect
+	github.com/docker/go-connections v0.4.0
 	github.com/docker/go-plugins-helpers v0.0.0-20181025120712-1e6269c305b8
 	github.com/etcd-io/etcd v3.3.13+incompatible
 	github.com/flaviostutz/etcd-lock v0.0.0-20190819204906-6da71e29c9a5